@@ -2,155 +2,505 @@ package api
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
 	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
 	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
 	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/authuserctx"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/metrics"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/tracing"
 	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
-
-	httplogger "github.com/gleicon/go-httplogger"
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 // DbClient is for talking to the database
 type DbClient interface {
 	QueryRow(context.Context, string, ...interface{}) pgx.Row
 	Query(context.Context, string, ...interface{}) (pgx.Rows, error)
+	Exec(context.Context, string, ...interface{}) (pgconn.CommandTag, error)
+	Begin(context.Context) (pgx.Tx, error)
+	Ping(context.Context) error
 	Close()
 }
 
 type Config struct {
-	Port           int
-	Log            *log.Logger
+	Port int
+	// Base logger for the service. Nil means slog.Default().
+	Log            *slog.Logger
 	AuthServiceUrl string
-	DatabaseUrl    string
+	// Sent to the auth service with RPCs for authenticated users, like CreateApiKey: its
+	// -service-token
+	AuthServiceToken string
+	DatabaseUrl      string
+	// How long deleted notes can be restored from the trash. Zero means
+	// model.DefaultTrashRetention. cmd/purge reads the same -trash-retention.
+	TrashRetention time.Duration
+	// Rate limit for each authenticated user. A zero Rate means no limit.
+	UserRateLimit RateLimit
+	// Rate limit for requests that fail authentication, for each client IP. A zero Rate
+	// means no limit.
+	IpRateLimit RateLimit
+	// Port for the admin server, which serves Prometheus metrics at /metrics. Zero means no
+	// admin server.
+	AdminPort int
+	// Where to send trace spans. The zero value doesn't trace.
+	Tracing tracing.Config
 }
 
 type Service struct {
-	config     Config
-	authClient auth.Client
-	pool       DbClient
+	config      Config
+	authClient  auth.Client
+	pool        DbClient
+	userLimiter *rateLimiter
+	ipLimiter   *rateLimiter
+	metrics     *apiMetrics
 }
 
 func New(config Config) *Service {
 	return &Service{
-		config: config,
+		config:      config,
+		userLimiter: newRateLimiter(config.UserRateLimit),
+		ipLimiter:   newRateLimiter(config.IpRateLimit),
+		metrics:     newApiMetrics(),
 	}
 }
 
+// Read pagination, sort and filter options for a notes list from the URL query:
+//
+//	?limit=20&cursor=...&sort=-modified&tag=work&tag=urgent&tag_mode=any
+func listOptionsFromQuery(q url.Values) (model.ListOptions, error) {
+	var opts model.ListOptions
+	if l := q.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > model.MaxPageSize {
+			return opts, fmt.Errorf("invalid limit %q: must be between 1 and %d", l, model.MaxPageSize)
+		}
+		opts.Limit = limit
+	}
+
+	sort, err := model.ParseNoteSort(q.Get("sort"))
+	if err != nil {
+		return opts, fmt.Errorf("invalid sort %q", q.Get("sort"))
+	}
+	opts.Sort = sort
+	opts.Cursor = q.Get("cursor")
+
+	mode, err := model.ParseTagMode(q.Get("tag_mode"))
+	if err != nil {
+		return opts, fmt.Errorf("invalid tag_mode %q", q.Get("tag_mode"))
+	}
+	for _, tag := range q["tag"] {
+		// Allow the tag to be written as it is in a note, with the #
+		tag = strings.TrimPrefix(tag, "#")
+		if !model.ValidTag(tag) {
+			return opts, fmt.Errorf("invalid tag %q", tag)
+		}
+		opts.Tags = append(opts.Tags, tag)
+	}
+	opts.TagMode = mode
+	return opts, nil
+}
+
 // HTTP handler for getting notes for a particular user
-func (as *Service) handleMyNotes(w http.ResponseWriter, r *http.Request) {
+func (as *Service) handleMyNotes(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	// Get the authenticated user from the context -- this will have been written earlier
 	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
 	if !ok {
-		as.config.Log.Printf("api: route handler reached with invalid auth context")
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return errNoAuthContext
+	}
+
+	opts, err := listOptionsFromQuery(r.URL.Query())
+	if err != nil {
+		return newProblem(http.StatusBadRequest, CodeInvalidQuery, err.Error())
 	}
 
-	// Use the "model" layer to get a list of the owner's notes
-	notes, err := model.GetNotesForOwner(ctx, as.pool, owner)
+	// Use the "model" layer to get a page of the owner's notes
+	notes, next, err := model.GetNotesForOwner(ctx, as.pool, owner, opts)
 	if err != nil {
-		fmt.Printf("api: GetNotesForOwner failed: %v\n", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return modelProblem("GetNotesForOwner", err)
+	}
+
+	return writeNotes(w, r, notes, next)
+}
+
+// Write a page of notes back out as JSON, or 304 Not Modified if the client already has it
+func writeNotes(w http.ResponseWriter, r *http.Request, notes model.Notes, next string) error {
+	if notModified(w, r, notesETag(notes, next)) {
+		return nil
 	}
 
 	response := struct {
-		Notes model.Notes `json:"notes"`
+		Notes      model.Notes `json:"notes"`
+		NextCursor string      `json:"next_cursor,omitempty"`
 	}{
-		Notes: notes,
+		Notes:      notes,
+		NextCursor: next,
 	}
+	return writeJSON(w, http.StatusOK, response)
+}
 
-	// Convert the []Row into JSON
+// Convert a response into JSON and write it back out with the given status
+func writeJSON(w http.ResponseWriter, status int, response interface{}) error {
 	res, err := util.MarshalWithIndent(response, "")
 	if err != nil {
-		fmt.Printf("api: response marshal failed: %v\n", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return internalProblem(fmt.Errorf("response marshal failed: %w", err))
 	}
 
-	// Write it back out!
-	w.Header().Add("Content-Type", "text/json")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	w.Write(res)
+	return nil
 }
 
-// HTTP handler for getting notes for a particular user
-func (as *Service) handleMyNoteById(w http.ResponseWriter, r *http.Request) {
+// HTTP handler for getting a single note
+func (as *Service) handleMyNoteById(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	// Get the authenticated user from the context -- this will have been written earlier
-	_, ok := authuserctx.FromAuthenticatedContext(ctx)
+	user, ok := authuserctx.FromAuthenticatedContext(ctx)
 	if !ok {
-		as.config.Log.Printf("api: route handler reached with invalid auth context")
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return errNoAuthContext
 	}
 
-	// The URL.Path will be something like /1/my/notes/abc123.json.
-	// path.Base strips everything but "abc123.json". We then Replace out the ".json" to give us
-	// just the ID.
-	id := strings.Replace(path.Base(r.URL.Path), ".json", "", 1)
+	id := noteIdFromPath(r.URL.Path)
 	if id == "" {
-		fmt.Printf("api: no ID supplied: url path %v\n", r.URL.Path)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return errMissingIdInPath
 	}
 
-	// Use the "model" layer to get a list of the owner's notes
-	note, err := model.GetNoteById(ctx, as.pool, id)
+	// Use the "model" layer to get the note, if the user is allowed to see it
+	note, err := model.GetNoteById(ctx, as.pool, user, id)
 	if err != nil {
-		fmt.Printf("api: GetNoteById failed: %v\n", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return modelProblem("GetNoteById", err)
+	}
+
+	// The client may already have this version of the note cached
+	if notModified(w, r, noteETag(note)) {
+		return nil
+	}
+	return writeNote(w, http.StatusOK, note)
+}
+
+// HTTP handler for searching the notes of a particular user:
+//
+//	GET /1/my/notes/search.json?q=shopping+list&limit=10
+func (as *Service) handleSearchMyNotes(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		return errNoAuthContext
+	}
+
+	q := r.URL.Query()
+	query := strings.TrimSpace(q.Get("q"))
+	if query == "" {
+		return newProblem(http.StatusBadRequest, CodeInvalidQuery, "A search query is required in the q parameter.")
+	}
+	opts, err := listOptionsFromQuery(url.Values{"limit": q["limit"]})
+	if err != nil {
+		return newProblem(http.StatusBadRequest, CodeInvalidQuery, err.Error())
+	}
+
+	results, err := model.SearchNotesForOwner(ctx, as.pool, owner, query, opts.Limit)
+	if err != nil {
+		return modelProblem("SearchNotesForOwner", err)
 	}
 
+	response := struct {
+		Results []model.NoteSearchResult `json:"results"`
+	}{
+		Results: results,
+	}
+	return writeJSON(w, http.StatusOK, response)
+}
+
+// HTTP handler for listing the tags used by a particular user, with note counts
+func (as *Service) handleMyTags(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		return errNoAuthContext
+	}
+
+	tags, err := model.GetTagsForOwner(ctx, as.pool, owner)
+	if err != nil {
+		return modelProblem("GetTagsForOwner", err)
+	}
+
+	response := struct {
+		Tags []model.TagCount `json:"tags"`
+	}{
+		Tags: tags,
+	}
+	return writeJSON(w, http.StatusOK, response)
+}
+
+// HTTP handler for getting the tags used by a particular user as a tree, following the
+// hierarchy of /-separated tags like #work/projectA/meeting
+func (as *Service) handleMyTagTree(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		return errNoAuthContext
+	}
+
+	tree, err := model.GetTagTreeForOwner(ctx, as.pool, owner)
+	if err != nil {
+		return modelProblem("GetTagTreeForOwner", err)
+	}
+
+	response := struct {
+		Tags []*model.TagNode `json:"tags"`
+	}{
+		Tags: tree,
+	}
+	return writeJSON(w, http.StatusOK, response)
+}
+
+// Maximum size of a note create/update request body
+const maxNoteBodyBytes = 1 << 20
+
+// The body of a create or update request. Content is a pointer so that we can tell the
+// difference between "not supplied" and "supplied but empty".
+type noteInput struct {
+	Content *string `json:"content"`
+}
+
+// The URL.Path will be something like /1/my/note/abc123.json.
+// path.Base strips everything but "abc123.json". We then Replace out the ".json" to give us
+// just the ID.
+func noteIdFromPath(urlPath string) string {
+	return strings.Replace(path.Base(urlPath), ".json", "", 1)
+}
+
+// Decode the JSON body of a note write request
+func readNoteInput(w http.ResponseWriter, r *http.Request) (noteInput, error) {
+	var input noteInput
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxNoteBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&input); err != nil {
+		return input, fmt.Errorf("invalid note body: %w", err)
+	}
+	if input.Content == nil {
+		return input, errors.New("invalid note body: content is required")
+	}
+	return input, nil
+}
+
+// Write a single note back out as JSON with the given status
+func writeNote(w http.ResponseWriter, status int, note model.Note) error {
 	response := struct {
 		Note model.Note `json:"note"`
 	}{
 		Note: note,
 	}
 
-	// Convert the []Row into JSON
-	res, err := util.MarshalWithIndent(response, "")
+	w.Header().Set("ETag", noteETag(note))
+	return writeJSON(w, status, response)
+}
+
+// HTTP handler for creating a note owned by the authenticated user
+func (as *Service) handleCreateMyNote(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		return errNoAuthContext
+	}
+
+	input, err := readNoteInput(w, r)
 	if err != nil {
-		fmt.Printf("api: response marshal failed: %v\n", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return newProblem(http.StatusBadRequest, CodeInvalidBody, err.Error())
 	}
 
-	// Write it back out!
-	w.Header().Add("Content-Type", "text/json")
-	w.Write(res)
+	note, err := model.CreateNote(ctx, as.pool, owner, *input.Content)
+	if err != nil {
+		return modelProblem("CreateNote", err)
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/1/my/note/%s.json", note.Id))
+	return writeNote(w, http.StatusCreated, note)
+}
+
+// HTTP handler for replacing the content of a note owned by, or shared for writing with,
+// the authenticated user
+func (as *Service) handleUpdateMyNote(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		return errNoAuthContext
+	}
+
+	id := noteIdFromPath(r.URL.Path)
+	if id == "" {
+		return errMissingIdInPath
+	}
+
+	input, err := readNoteInput(w, r)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, CodeInvalidBody, err.Error())
+	}
+
+	// With If-Match, the note is only updated if the client has seen its current version
+	note, err := model.UpdateNoteIf(ctx, as.pool, user, id, *input.Content, ifMatchCondition(r))
+	if err != nil {
+		return modelProblem("UpdateNote", err)
+	}
+
+	return writeNote(w, http.StatusOK, note)
+}
+
+// HTTP handler for deleting a note owned by the authenticated user
+func (as *Service) handleDeleteMyNote(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		return errNoAuthContext
+	}
+
+	id := noteIdFromPath(r.URL.Path)
+	if id == "" {
+		return errMissingIdInPath
+	}
+
+	err := model.DeleteNoteIf(ctx, as.pool, owner, id, ifMatchCondition(r))
+	if err != nil {
+		return modelProblem("DeleteNote", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Dispatch requests for the notes collection by method
+func (as *Service) routeMyNotes(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return as.handleMyNotes(w, r)
+	case http.MethodPost:
+		return as.handleCreateMyNote(w, r)
+	}
+	return methodNotAllowed(w, "GET, HEAD, POST")
+}
+
+// Split a path under /1/my/note/ into the note ID and the path segments after it:
+//
+//	/1/my/note/abc123.json               -> "abc123", []
+//	/1/my/note/abc123/shares.json        -> "abc123", ["shares.json"]
+//	/1/my/note/abc123/shares/xyz789.json -> "abc123", ["shares", "xyz789.json"]
+//	/1/my/note/abc123/revisions/2/restore.json -> "abc123", ["revisions", "2", "restore.json"]
+func splitNotePath(urlPath string) (string, []string) {
+	parts := strings.Split(strings.TrimPrefix(urlPath, "/1/my/note/"), "/")
+	return strings.TrimSuffix(parts[0], ".json"), parts[1:]
+}
+
+// Dispatch requests for a single note, or one of its sub-resources, by path and method
+func (as *Service) routeMyNote(w http.ResponseWriter, r *http.Request) error {
+	_, rest := splitNotePath(r.URL.Path)
+	switch {
+	case len(rest) == 0:
+		// The note itself, handled below
+	case len(rest) == 1 && rest[0] == "shares.json":
+		return as.routeNoteShares(w, r)
+	case len(rest) == 2 && rest[0] == "shares":
+		return as.routeNoteShare(w, r)
+	case len(rest) == 1 && rest[0] == "revisions.json":
+		return as.routeNoteRevisions(w, r)
+	case len(rest) == 2 && rest[0] == "revisions":
+		return as.routeNoteRevision(w, r)
+	case len(rest) == 3 && rest[0] == "revisions" && rest[2] == "restore.json":
+		return as.routeRestoreNoteRevision(w, r)
+	default:
+		return errNotFound
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return as.handleMyNoteById(w, r)
+	case http.MethodPut, http.MethodPatch:
+		return as.handleUpdateMyNote(w, r)
+	case http.MethodDelete:
+		return as.handleDeleteMyNote(w, r)
+	}
+	return methodNotAllowed(w, "GET, HEAD, PUT, PATCH, DELETE")
 }
 
 // Set up routes -- this can be used in tests to set up simple HTTP handling
 // rather than running the whole server.
 func (as *Service) Handler() http.Handler {
 	mux := new(http.ServeMux)
-	mux.HandleFunc("/1/my/note/", as.wrapAuth(as.authClient, as.handleMyNoteById))
-	mux.HandleFunc("/1/my/notes.json", as.wrapAuth(as.authClient, as.handleMyNotes))
-	return httplogger.HTTPLogger(mux)
+	mux.HandleFunc("/1/my/note/", as.wrapAuth(as.authClient, readWrite, as.routeMyNote))
+	mux.HandleFunc("/1/my/notes.json", as.wrapAuth(as.authClient, readWrite, as.routeMyNotes))
+	mux.HandleFunc("/1/my/notes/search.json", as.wrapAuth(as.authClient, readWrite, as.handleSearchMyNotes))
+	mux.HandleFunc("/1/my/tags.json", as.wrapAuth(as.authClient, readWrite, as.handleMyTags))
+	mux.HandleFunc("/1/my/tags/tree.json", as.wrapAuth(as.authClient, readWrite, as.handleMyTagTree))
+	mux.HandleFunc("/1/shared/notes.json", as.wrapAuth(as.authClient, readWrite, as.handleSharedNotes))
+	mux.HandleFunc("/1/my/trash.json", as.wrapAuth(as.authClient, readWrite, as.routeMyTrash))
+	mux.HandleFunc("/1/my/trash/", as.wrapAuth(as.authClient, readWrite, as.routeMyTrashNote))
+	mux.HandleFunc("/1/my/api-keys.json", as.wrapAuth(as.authClient, requires(PermApiKeysManage), as.routeMyApiKeys))
+	mux.HandleFunc("/1/my/api-key/", as.wrapAuth(as.authClient, requires(PermApiKeysManage), as.routeMyApiKey))
+	mux.HandleFunc("/1/my/account/totp.json", as.wrapAuth(as.authClient, requires(PermAccountManage), as.routeMyTotp))
+	mux.HandleFunc("/1/my/account/totp/confirm.json", as.wrapAuth(as.authClient, requires(PermAccountManage), as.routeConfirmTotp))
+	mux.HandleFunc("/1/my/account/password.json", as.wrapAuth(as.authClient, requires(PermAccountManage), as.handleChangePassword))
+	mux.HandleFunc("/1/my/account/deactivate.json", as.wrapAuth(as.authClient, requires(PermAccountManage), as.handleDeactivateAccount))
+	mux.HandleFunc("/1/my/account/logins.json", as.wrapAuth(as.authClient, requires(PermAccountManage), as.handleMyLogins))
+	mux.HandleFunc("/1/auth/token", as.handle(as.routeAuthToken))
+	// Anything else is a 404, in the same format as every other error
+	mux.HandleFunc("/", as.handle(func(w http.ResponseWriter, r *http.Request) error {
+		return errNotFound
+	}))
+
+	// Health checks are kept out of the logs, metrics and traces
+	observed := otelhttp.NewHandler(as.withRequestId(as.observeRequests(mux)), "api")
+	healthz, readyz := as.handle(as.handleHealthz), as.handle(as.handleReadyz)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			healthz(w, r)
+		case "/readyz":
+			readyz(w, r)
+		default:
+			observed.ServeHTTP(w, r)
+		}
+	})
 }
 
 func (as *Service) Run(ctx context.Context) error {
 	listen := fmt.Sprintf(":%d", as.config.Port)
 
+	shutdownTracing, err := tracing.Setup(ctx, as.config.Tracing)
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
+
 	// Connect to the database via a "pool" of connections, allowing concurrency
-	pool, err := pgxpool.New(ctx, as.config.DatabaseUrl)
+	pool, err := tracing.NewPool(ctx, as.config.DatabaseUrl)
 	if err != nil {
 		return fmt.Errorf("unable to create connection pool: %w", err)
 	}
 	defer pool.Close()
 	// Add the pool to the the service
 	as.pool = pool
+	as.metrics.registry.MustRegister(metrics.NewPoolCollector(pool))
 
 	// Connect to the Auth service via the AuthClient
 	client, err := auth.NewClient(ctx, as.config.AuthServiceUrl)
 	if err != nil {
 		return err
 	}
-	as.authClient = client
+	as.authClient = client.WithServiceToken(as.config.AuthServiceToken)
+	as.metrics.registry.MustRegister(client)
 
 	// mux is the root Handler
 	mux := as.Handler()
@@ -164,7 +514,12 @@ func (as *Service) Run(ctx context.Context) error {
 		runErr = server.ListenAndServe()
 	}()
 
-	as.config.Log.Printf("api service: listening: %s", listen)
+	as.logger().Info("api service: listening", "addr", listen)
+
+	waitAdmin := func() error { return nil }
+	if as.config.AdminPort != 0 {
+		waitAdmin = metrics.RunAdmin(ctx, as.config.AdminPort, as.metrics.registry, as.logger())
+	}
 
 	// Wait for a signal to shut down...
 	<-ctx.Done()
@@ -172,5 +527,8 @@ func (as *Service) Run(ctx context.Context) error {
 	server.Shutdown(context.TODO())
 
 	wg.Wait()
+	if err := waitAdmin(); err != nil && runErr == nil {
+		runErr = err
+	}
 	return runErr
 }
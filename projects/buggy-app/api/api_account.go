@@ -0,0 +1,160 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/authuserctx"
+)
+
+// Handlers for the authenticated user's own account, which the auth service looks after:
+//
+//	POST /1/my/account/password.json     -- change the password, body {"current_password": "...", "new_password": "..."}
+//	POST /1/my/account/deactivate.json   -- deactivate the account, body {"current_password": "..."}
+//	GET  /1/my/account/logins.json       -- recent logins, newest first, ?limit=20
+//
+// Changing the password or deactivating needs the current password, even with a token, so that
+// someone who has got hold of a token can't lock the user out. Both end the user's sessions,
+// and the auth client forgets its cached results for them, so the old password stops working
+// straight away. Like the TOTP endpoints, these need the account:manage permission.
+
+// Plenty for two passwords
+const maxAccountBodyBytes = 1 << 10
+
+type accountRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type loginResponse struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source,omitempty"`
+	// "ALLOW" or "DENY"
+	State string `json:"state"`
+	// Why the state is DENY, like "INVALID_CREDENTIALS" or "INVALID_OTP"
+	Reason string `json:"reason,omitempty"`
+}
+
+// Decode the body of an account request. The current password is always needed.
+func decodeAccountRequest(w http.ResponseWriter, r *http.Request) (*accountRequest, error) {
+	var input accountRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAccountBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&input); err != nil {
+		return nil, newProblem(http.StatusBadRequest, CodeInvalidBody, fmt.Sprintf("invalid account body: %v", err))
+	}
+	if input.CurrentPassword == "" {
+		return nil, newProblem(http.StatusBadRequest, CodeInvalidBody, "The current password is required.")
+	}
+	return &input, nil
+}
+
+// Turn an error from changing the password or deactivating into a Problem. op names the client
+// method, for the log if the error is unexpected.
+func accountProblem(op string, err error) *Problem {
+	switch {
+	case errors.Is(err, auth.ErrPermissionDenied):
+		return errWrongPassword.withCause(err)
+	case errors.Is(err, auth.ErrInvalidArgument):
+		return errInvalidPassword.withCause(err)
+	case errors.Is(err, auth.ErrTooManyAttempts):
+		return errTooManyPasswords.withCause(err)
+	case errors.Is(err, auth.ErrFailedPrecondition):
+		// The account isn't active, like one an admin has locked
+		return errAccountInactive.withCause(err)
+	}
+	return internalProblem(fmt.Errorf("%s error: %w", op, err))
+}
+
+// HTTP handler for changing the password
+func (as *Service) handleChangePassword(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return methodNotAllowed(w, "POST")
+	}
+	owner, ok := authuserctx.FromAuthenticatedContext(r.Context())
+	if !ok {
+		return errNoAuthContext
+	}
+	input, err := decodeAccountRequest(w, r)
+	if err != nil {
+		return err
+	}
+	if input.NewPassword == "" {
+		return newProblem(http.StatusBadRequest, CodeInvalidBody, "The new password is required.")
+	}
+
+	if err := as.authClient.ChangePassword(r.Context(), owner, input.CurrentPassword, input.NewPassword); err != nil {
+		return accountProblem("change password", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// HTTP handler for deactivating the account. Only an admin can make it active again.
+func (as *Service) handleDeactivateAccount(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return methodNotAllowed(w, "POST")
+	}
+	owner, ok := authuserctx.FromAuthenticatedContext(r.Context())
+	if !ok {
+		return errNoAuthContext
+	}
+	input, err := decodeAccountRequest(w, r)
+	if err != nil {
+		return err
+	}
+	if input.NewPassword != "" {
+		return newProblem(http.StatusBadRequest, CodeInvalidBody, "Only the current password is needed to deactivate.")
+	}
+
+	if err := as.authClient.DeactivateAccount(r.Context(), owner, input.CurrentPassword); err != nil {
+		return accountProblem("deactivate account", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// HTTP handler for listing recent logins
+func (as *Service) handleMyLogins(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	default:
+		return methodNotAllowed(w, "GET, HEAD")
+	}
+	owner, ok := authuserctx.FromAuthenticatedContext(r.Context())
+	if !ok {
+		return errNoAuthContext
+	}
+	var limit int
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > auth.MaxLoginHistoryLimit {
+			return newProblem(http.StatusBadRequest, CodeInvalidQuery, fmt.Sprintf("invalid limit %q: must be between 1 and %d", l, auth.MaxLoginHistoryLimit))
+		}
+	}
+
+	events, err := as.authClient.ListLoginHistory(r.Context(), owner, limit)
+	if err != nil {
+		return internalProblem(fmt.Errorf("list login history error: %w", err))
+	}
+
+	response := struct {
+		Logins []loginResponse `json:"logins"`
+	}{
+		Logins: make([]loginResponse, 0, len(events)),
+	}
+	for _, e := range events {
+		login := loginResponse{Time: e.Time, Source: e.Source, State: e.State}
+		if e.Reason != auth.ReasonNone {
+			login.Reason = e.Reason
+		}
+		response.Logins = append(response.Logins, login)
+	}
+	return writeJSON(w, http.StatusOK, response)
+}
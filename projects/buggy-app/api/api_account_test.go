@@ -0,0 +1,89 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+)
+
+func TestMyAccount(t *testing.T) {
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	as, _, client := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+		Id:    "abc123",
+	})
+	client.
+		On("ChangePassword", nil, fmt.Errorf("failed to change password: %w", auth.ErrPermissionDenied)).
+		On("ChangePassword", nil, fmt.Errorf("failed to change password: %w", auth.ErrInvalidArgument)).
+		On("ChangePassword", nil, fmt.Errorf("failed to change password: %w", auth.ErrTooManyAttempts)).
+		On("ChangePassword", nil, fmt.Errorf("failed to change password: %w", auth.ErrFailedPrecondition)).
+		On("ChangePassword", nil, nil).
+		On("ListLoginHistory", []auth.LoginEvent{
+			{Time: now, Source: "192.0.2.1", State: auth.StateAllow, Reason: auth.ReasonNone},
+			{Time: now, State: auth.StateDeny, Reason: auth.ReasonInvalidCredentials},
+		}, nil).
+		On("DeactivateAccount", nil, fmt.Errorf("failed to deactivate account: %w", auth.ErrPermissionDenied)).
+		On("DeactivateAccount", nil, nil)
+	assertProblem(t, serveBasic(as, "POST", "/1/my/account/password.json", `{"new_password": "banana-split"}`), http.StatusBadRequest, CodeInvalidBody)
+	assertProblem(t, serveBasic(as, "POST", "/1/my/account/password.json", `{"current_password": "apple", "new_password": "banana-split"}`), http.StatusForbidden, CodeWrongPassword)
+	assertProblem(t, serveBasic(as, "POST", "/1/my/account/password.json", `{"current_password": "banana", "new_password": "split"}`), http.StatusBadRequest, CodeInvalidPassword)
+	assertProblem(t, serveBasic(as, "POST", "/1/my/account/password.json", `{"current_password": "apple", "new_password": "banana-split"}`), http.StatusTooManyRequests, CodeTooManyAttempts)
+	assertProblem(t, serveBasic(as, "POST", "/1/my/account/password.json", `{"current_password": "banana", "new_password": "banana-split"}`), http.StatusForbidden, CodeAccountInactive)
+	res := serveBasic(as, "POST", "/1/my/account/password.json", `{"current_password": "banana", "new_password": "banana-split"}`)
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, res.Code, res.Body)
+	}
+	// The client's IP goes with the current password, so the auth service can throttle by it
+	calls := client.Calls("ChangePassword")
+	if last := calls[len(calls)-1]; len(calls) != 5 || last.Args[0] != "abc123" || last.Args[1] != "banana" || last.Args[2] != "banana-split" || last.Source != "192.0.2.1" {
+		t.Fatalf("unexpected ChangePassword calls %+v", calls)
+	}
+
+	assertProblem(t, serveBasic(as, "GET", "/1/my/account/logins.json?limit=0", ""), http.StatusBadRequest, CodeInvalidQuery)
+	res = serveBasic(as, "GET", "/1/my/account/logins.json?limit=2", "")
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, res.Code, res.Body)
+	}
+	assertJSON(res.Body.Bytes(), map[string]any{
+		"logins": []loginResponse{
+			{Time: now, Source: "192.0.2.1", State: auth.StateAllow},
+			{Time: now, State: auth.StateDeny, Reason: auth.ReasonInvalidCredentials},
+		},
+	}, t)
+	if calls := client.Calls("ListLoginHistory"); len(calls) != 1 || calls[0].Args[0] != "abc123" || calls[0].Args[1] != 2 {
+		t.Fatalf("unexpected ListLoginHistory calls %+v", calls)
+	}
+
+	assertProblem(t, serveBasic(as, "POST", "/1/my/account/deactivate.json", `{"current_password": "apple"}`), http.StatusForbidden, CodeWrongPassword)
+	res = serveBasic(as, "POST", "/1/my/account/deactivate.json", `{"current_password": "banana"}`)
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, res.Code, res.Body)
+	}
+}
+
+func TestMyAccountNotWithApiKey(t *testing.T) {
+	as, _, _ := newMockService(t, &auth.VerifyResult{
+		State:  auth.StateAllow,
+		Roles:  []string{"user"},
+		Id:     "abc123",
+		Scopes: []string{auth.ScopeNotesRead, auth.ScopeNotesWrite},
+	})
+
+	req, err := http.NewRequest("POST", "/1/my/account/deactivate.json", strings.NewReader(`{"current_password": "banana"}`))
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("X-Api-Key", "bk_key")
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+	if res.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusForbidden, res.Code, res.Body)
+	}
+}
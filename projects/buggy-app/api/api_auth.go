@@ -2,48 +2,184 @@ package api
 
 import (
 	"context"
-	"log"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
 	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/authuserctx"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/logctx"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // wrapAuth takes a handler function (likely to be the API endpoint) and wraps it with an authentication
-// check using an AuthClient.
+// check using an AuthClient. Clients authenticate with Basic auth (id and password), an access
+// token from /1/auth/token (`Authorization: Bearer <token>`), or an API key (`X-Api-Key: <key>`).
 //
-// If the authentication passes, it adds the authenticated user ID to the context using the authuserctx
-// package, and then calls the inner handler. The ID can be retrieved later using the
-// `FromAuthenticatedContext` function.
-func (as *Service) wrapAuth(client auth.Client, handler http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+// If the authentication passes, it checks the permission the policy says the request needs (see
+// policy.go), adds the authenticated Principal to the context using the authuserctx package, and
+// then calls the inner handler. The user ID can be retrieved later using the
+// `FromAuthenticatedContext` function, and the rest with `PrincipalFromContext`.
+func (as *Service) wrapAuth(client auth.Client, needs policy, handler handlerFunc) http.HandlerFunc {
+	return as.handle(func(w http.ResponseWriter, r *http.Request) error {
 		ctx, cancel := context.WithCancel(r.Context())
 		defer cancel()
+		// The auth service tracks failed passwords by client IP as well as by user
+		ctx = auth.NewSourceContext(ctx, clientIp(r))
 
-		id, passwd, ok := r.BasicAuth()
-		// Malformed basic auth is not OK
-		if !ok {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			return
+		// Don't bother the auth service if this client has already failed too often, whatever
+		// credentials it has now. Only failures use up the allowance (see rejectCredentials).
+		if limit := as.ipLimiter.peek(clientIp(r)); !limit.allowed {
+			return tooManyRequests(w, limit)
 		}
 
-		// Use the auth client to check if this id/password combo is approved
-		result, err := client.Verify(ctx, id, passwd)
-		if err != nil {
-			log.Printf("api: verify error: %v\n", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
+		var id string
+		var result *auth.VerifyResult
+		var err error
+		var basic bool
+		apiKey := r.Header.Get(apiKeyHeader)
+		if apiKey != "" {
+			// Like access tokens, keys are cheap to check
+			result, err = client.VerifyApiKey(ctx, apiKey)
+			if err != nil {
+				return internalProblem(fmt.Errorf("verify api key error: %w", err))
+			}
+			id = result.Id
+		} else if token, ok := bearerToken(r); ok {
+			// Access tokens are cheap to check, so there's no need to look at the user's
+			// allowance first -- and we don't know who the user is until the token is checked
+			result, err = client.VerifyToken(ctx, token)
+			if err != nil {
+				return internalProblem(fmt.Errorf("verify token error: %w", err))
+			}
+			id = result.Id
+		} else {
+			var passwd string
+			id, passwd, ok = r.BasicAuth()
+			// Malformed basic auth is not OK
+			if !ok {
+				return as.unauthorized(w, r)
+			}
+			basic = true
+
+			// Don't bother the auth service if this user has already used up their allowance.
+			// This only looks at the bucket: it's the verified requests below that use it up, so
+			// someone without the password can't exhaust it for the real user.
+			if limit := as.userLimiter.peek(id); !limit.allowed {
+				return tooManyRequests(w, limit)
+			}
+
+			// Use the auth client to check if this id/password combo is approved
+			result, err = client.Verify(ctx, id, passwd)
+			if err != nil {
+				return internalProblem(fmt.Errorf("verify error: %w", err))
+			}
 		}
 
 		// Unless we get an Allow, say no
-		if result.State != auth.StateAllow {
-			log.Printf("api: verify denied: id %v\n", id)
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			return
+		if result.State != auth.StateAllow || id == "" {
+			logctx.FromContext(ctx).Info("api: verify denied", "user", id, "reason", result.Reason)
+			if apiKey != "" && result.Reason == auth.ReasonInvalidToken {
+				return as.rejectCredentials(w, r, errInvalidApiKey)
+			}
+			// Basic auth doesn't take a second factor: each code works once, and Basic auth is
+			// checked on every request, so it would only be good for one request every 30 seconds.
+			// Users with one get a token instead.
+			if basic && result.Reason == auth.ReasonOtpRequired {
+				return errOtpNeedsToken
+			}
+			return as.denied(w, r, result.Reason, result.RetryAfter)
+		}
+
+		principal := authuserctx.Principal{
+			UserId:     id,
+			Roles:      result.Roles,
+			Scopes:     result.Scopes,
+			AuthMethod: result.AuthMethod,
+			SessionId:  result.SessionId,
+		}
+		// API keys are always limited to their scopes, even if they somehow have none
+		if apiKey != "" && principal.Scopes == nil {
+			principal.Scopes = []string{}
 		}
+		perm := needs(r)
+		if ok, byScope := allowed(principal, perm); !ok {
+			logctx.FromContext(ctx).Info("api: permission denied", "user", id, "permission", perm, "roles", principal.Roles, "scopes", principal.Scopes)
+			if byScope {
+				return errInsufficientScope
+			}
+			return errForbidden
+		}
+
+		limit := as.userLimiter.take(id)
+		if !limit.allowed {
+			return tooManyRequests(w, limit)
+		}
+		limit.writeHeaders(w)
+
+		// Add the principal to the context, and the ID to everything logged from here on, and
+		// call the inner handler
+		ctx = authuserctx.NewPrincipalContext(ctx, principal)
+		ctx, _ = logctx.With(ctx, "user", id)
+		setRequestUser(ctx, id)
+		trace.SpanFromContext(ctx).SetAttributes(semconv.EnduserID(id))
+		return handler(w, r.WithContext(ctx))
+	})
+}
+
+// Respond to a request that failed authentication: 401, unless the client has failed too
+// often, in which case 429
+func (as *Service) unauthorized(w http.ResponseWriter, r *http.Request) error {
+	return as.rejectCredentials(w, r, errUnauthorized)
+}
+
+// Respond to a request the auth service denied, for the reason it gave. Wrong credentials and
+// bad tokens are 401s that count against the client's rate limit. The account states are 403s
+// with their own codes: the auth service only gives them once the password or token has been
+// checked, so they tell the client nothing it couldn't find out by logging in. Too many failed
+// attempts is a 429, saying how long to wait.
+func (as *Service) denied(w http.ResponseWriter, r *http.Request, reason string, retryAfter time.Duration) error {
+	switch reason {
+	case auth.ReasonTooManyAttempts:
+		w.Header().Set("Retry-After", ceilSeconds(retryAfter))
+		return errTooManyAttempts
+	case auth.ReasonAccountInactive:
+		return errAccountInactive
+	case auth.ReasonAccountLocked:
+		return errAccountLocked
+	case auth.ReasonAccountPendingVerification:
+		return errAccountPending
+	case auth.ReasonInvalidToken:
+		return as.rejectCredentials(w, r, errInvalidToken)
+	case auth.ReasonOtpRequired:
+		// The password was right, so this doesn't count against the client
+		return errOtpRequired
+	case auth.ReasonInvalidOtp:
+		return as.rejectCredentials(w, r, errInvalidOtp)
+	}
+	return as.rejectCredentials(w, r, errUnauthorized)
+}
+
+// Respond with p, unless the client has failed authentication too often, in which case 429
+func (as *Service) rejectCredentials(w http.ResponseWriter, r *http.Request, p *Problem) error {
+	limit := as.ipLimiter.take(clientIp(r))
+	if !limit.allowed {
+		return tooManyRequests(w, limit)
+	}
+	limit.writeHeaders(w)
+	return p
+}
+
+// The header API keys are sent in
+const apiKeyHeader = "X-Api-Key"
 
-		// Add the ID to the context and call the inner handler
-		ctx = authuserctx.NewAuthenticatedContext(ctx, id)
-		handler(w, r.WithContext(ctx))
+// The token from an `Authorization: Bearer <token>` header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
 	}
+	return token, true
 }
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/authuserctx"
+)
+
+// Handlers for the authenticated user's API keys, which the auth service looks after:
+//
+//	GET    /1/my/api-keys.json      -- list keys, without the keys themselves
+//	POST   /1/my/api-keys.json      -- create a key, body {"name": "backup", "scopes": ["notes:read"]}
+//	DELETE /1/my/api-key/:id.json   -- revoke a key
+//
+// Managing keys needs the api_keys:manage permission, which no key has as a scope, so a leaked
+// key can't be used to make more.
+
+// Plenty for a name and the scopes
+const maxApiKeyBodyBytes = 4 << 10
+
+type apiKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type apiKeyResponse struct {
+	Id      string    `json:"id"`
+	Name    string    `json:"name"`
+	Scopes  []string  `json:"scopes"`
+	Prefix  string    `json:"prefix"`
+	Created time.Time `json:"created"`
+	// Only set when the key is created
+	Key string `json:"key,omitempty"`
+}
+
+func newApiKeyResponse(key auth.ApiKey) apiKeyResponse {
+	return apiKeyResponse{
+		Id:      key.Id,
+		Name:    key.Name,
+		Scopes:  key.Scopes,
+		Prefix:  key.Prefix,
+		Created: key.Created,
+	}
+}
+
+// Dispatch requests for /1/my/api-keys.json by method
+func (as *Service) routeMyApiKeys(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return as.handleMyApiKeys(w, r)
+	case http.MethodPost:
+		return as.handleCreateApiKey(w, r)
+	}
+	return methodNotAllowed(w, "GET, HEAD, POST")
+}
+
+// Dispatch requests for a single key by method
+func (as *Service) routeMyApiKey(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodDelete {
+		return methodNotAllowed(w, "DELETE")
+	}
+	return as.handleRevokeApiKey(w, r)
+}
+
+// HTTP handler for listing the authenticated user's keys
+func (as *Service) handleMyApiKeys(w http.ResponseWriter, r *http.Request) error {
+	owner, ok := authuserctx.FromAuthenticatedContext(r.Context())
+	if !ok {
+		return errNoAuthContext
+	}
+
+	keys, err := as.authClient.ListApiKeys(r.Context(), owner)
+	if err != nil {
+		return internalProblem(fmt.Errorf("list api keys error: %w", err))
+	}
+
+	response := struct {
+		ApiKeys []apiKeyResponse `json:"api_keys"`
+	}{
+		ApiKeys: make([]apiKeyResponse, 0, len(keys)),
+	}
+	for _, key := range keys {
+		response.ApiKeys = append(response.ApiKeys, newApiKeyResponse(key))
+	}
+	return writeJSON(w, http.StatusOK, response)
+}
+
+// HTTP handler for creating a key. The response is the only time the key is shown.
+func (as *Service) handleCreateApiKey(w http.ResponseWriter, r *http.Request) error {
+	owner, ok := authuserctx.FromAuthenticatedContext(r.Context())
+	if !ok {
+		return errNoAuthContext
+	}
+
+	var input apiKeyRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxApiKeyBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&input); err != nil {
+		return newProblem(http.StatusBadRequest, CodeInvalidBody, fmt.Sprintf("invalid api key body: %v", err))
+	}
+
+	key, err := as.authClient.CreateApiKey(r.Context(), owner, input.Name, input.Scopes)
+	if errors.Is(err, auth.ErrInvalidArgument) {
+		detail := fmt.Sprintf(`An API key needs a name of 1 to %d characters, and scopes from: %s.`,
+			auth.MaxApiKeyNameLength, strings.Join(auth.Scopes, ", "))
+		return newProblem(http.StatusBadRequest, CodeInvalidBody, detail).withCause(err)
+	}
+	if err != nil {
+		return internalProblem(fmt.Errorf("create api key error: %w", err))
+	}
+
+	response := newApiKeyResponse(key.ApiKey)
+	response.Key = key.Key
+	// The key must not be kept by caches along the way
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Location", fmt.Sprintf("/1/my/api-key/%s.json", key.Id))
+	return writeJSON(w, http.StatusCreated, response)
+}
+
+// HTTP handler for revoking a key
+func (as *Service) handleRevokeApiKey(w http.ResponseWriter, r *http.Request) error {
+	owner, ok := authuserctx.FromAuthenticatedContext(r.Context())
+	if !ok {
+		return errNoAuthContext
+	}
+
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/1/my/api-key/"), ".json")
+	if id == "" || strings.Contains(id, "/") {
+		return errMissingIdInPath
+	}
+
+	err := as.authClient.RevokeApiKey(r.Context(), owner, id)
+	if errors.Is(err, auth.ErrNotFound) {
+		return errApiKeyNotFound.withCause(err)
+	}
+	if err != nil {
+		return internalProblem(fmt.Errorf("revoke api key error: %w", err))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
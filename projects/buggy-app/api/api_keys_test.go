@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+)
+
+func TestApiKeys(t *testing.T) {
+	key := auth.ApiKey{
+		Id:      "key1",
+		Name:    "backup",
+		Scopes:  []string{auth.ScopeNotesRead},
+		Prefix:  "bk_mock",
+		Created: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	as, _, client := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+		Id:    "abc123",
+	})
+	client.
+		On("CreateApiKey", &auth.NewApiKey{ApiKey: key, Key: "bk_mock_key1"}, nil).
+		On("CreateApiKey", nil, fmt.Errorf("failed to create api key: %w", auth.ErrInvalidArgument)).
+		On("ListApiKeys", []auth.ApiKey{key}, nil).
+		On("RevokeApiKey", nil, nil).
+		On("RevokeApiKey", nil, fmt.Errorf("failed to revoke api key: %w", auth.ErrNotFound))
+
+	res := serveBasic(as, "POST", "/1/my/api-keys.json", `{"name": "backup", "scopes": ["notes:read"]}`)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, res.Code, res.Body)
+	}
+	var created apiKeyResponse
+	if err := json.Unmarshal(res.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Key == "" || created.Name != "backup" || res.Header().Get("Location") != "/1/my/api-key/"+created.Id+".json" {
+		t.Fatalf("unexpected created key %+v, location %q", created, res.Header().Get("Location"))
+	}
+	if calls := client.Calls("CreateApiKey"); len(calls) != 1 || calls[0].Args[0] != "abc123" || calls[0].Args[1] != "backup" {
+		t.Fatalf("expected a key to be created for the authenticated user, got %+v", calls)
+	}
+
+	res = serveBasic(as, "POST", "/1/my/api-keys.json", `{"name": "backup", "scopes": ["notes:delete"]}`)
+	if res.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for an unknown scope, got %d", http.StatusBadRequest, res.Code)
+	}
+
+	// The list doesn't include the key itself
+	res = serveBasic(as, "GET", "/1/my/api-keys.json", "")
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, res.Code)
+	}
+	if strings.Contains(res.Body.String(), created.Key) || !strings.Contains(res.Body.String(), `"name":"backup"`) {
+		t.Fatalf("expected the list to name the key without including it, got %s", res.Body)
+	}
+
+	res = serveBasic(as, "DELETE", "/1/my/api-key/"+created.Id+".json", "")
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, res.Code)
+	}
+	if calls := client.Calls("RevokeApiKey"); len(calls) != 1 || calls[0].Args[0] != "abc123" || calls[0].Args[1] != created.Id {
+		t.Fatalf("expected the authenticated user's key to be revoked, got %+v", calls)
+	}
+	res = serveBasic(as, "DELETE", "/1/my/api-key/"+created.Id+".json", "")
+	if res.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d revoking again, got %d", http.StatusNotFound, res.Code)
+	}
+}
+
+func TestApiKeysNotWithApiKey(t *testing.T) {
+	as, _, _ := newMockService(t, &auth.VerifyResult{
+		State:  auth.StateAllow,
+		Roles:  []string{"user"},
+		Id:     "abc123",
+		Scopes: []string{auth.ScopeNotesRead, auth.ScopeNotesWrite},
+	})
+
+	req, err := http.NewRequest("POST", "/1/my/api-keys.json", strings.NewReader(`{"name": "more", "scopes": ["notes:write"]}`))
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("X-Api-Key", "bk_leaked")
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, res.Code)
+	}
+}
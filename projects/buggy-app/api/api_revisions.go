@@ -0,0 +1,137 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/authuserctx"
+)
+
+// Handlers for the revision history of a note. Anyone who can read a note can read its
+// revisions; restoring needs write access:
+//
+//	GET  /1/my/note/:id/revisions.json          -- list revisions, newest first
+//	GET  /1/my/note/:id/revisions/:n.json       -- get one revision
+//	POST /1/my/note/:id/revisions/:n/restore.json -- make revision n the current content
+
+// Dispatch requests for the revisions of a note by method
+func (as *Service) routeNoteRevisions(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return as.handleNoteRevisions(w, r)
+	}
+	return methodNotAllowed(w, "GET, HEAD")
+}
+
+// Dispatch requests for a single revision by method
+func (as *Service) routeNoteRevision(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return as.handleNoteRevision(w, r)
+	}
+	return methodNotAllowed(w, "GET, HEAD")
+}
+
+// Dispatch requests to restore a revision by method
+func (as *Service) routeRestoreNoteRevision(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodPost:
+		return as.handleRestoreNoteRevision(w, r)
+	}
+	return methodNotAllowed(w, "POST")
+}
+
+// Get the note ID and revision number from a path like /1/my/note/abc123/revisions/2.json
+// or /1/my/note/abc123/revisions/2/restore.json. The revision is 0 if it isn't valid.
+func revisionFromPath(urlPath string) (string, int) {
+	id, rest := splitNotePath(urlPath)
+	if len(rest) < 2 {
+		return id, 0
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(rest[1], ".json"))
+	if err != nil || n < 1 {
+		return id, 0
+	}
+	return id, n
+}
+
+// HTTP handler for listing the revisions of a note
+func (as *Service) handleNoteRevisions(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		return errNoAuthContext
+	}
+
+	id, _ := splitNotePath(r.URL.Path)
+	if id == "" {
+		return errMissingIdInPath
+	}
+
+	revisions, err := model.GetRevisionsForNote(ctx, as.pool, user, id)
+	if err != nil {
+		return modelProblem("GetRevisionsForNote", err)
+	}
+
+	response := struct {
+		Revisions []model.Revision `json:"revisions"`
+	}{
+		Revisions: revisions,
+	}
+	return writeJSON(w, http.StatusOK, response)
+}
+
+// HTTP handler for getting a single revision of a note
+func (as *Service) handleNoteRevision(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		return errNoAuthContext
+	}
+
+	id, n := revisionFromPath(r.URL.Path)
+	if id == "" {
+		return errMissingIdInPath
+	}
+	if n == 0 {
+		return errInvalidRevision
+	}
+
+	revision, err := model.GetRevision(ctx, as.pool, user, id, n)
+	if err != nil {
+		return modelProblem("GetRevision", err)
+	}
+
+	response := struct {
+		Revision model.Revision `json:"revision"`
+	}{
+		Revision: revision,
+	}
+	return writeJSON(w, http.StatusOK, response)
+}
+
+// HTTP handler for restoring an old revision of a note. Responds with the updated note.
+func (as *Service) handleRestoreNoteRevision(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		return errNoAuthContext
+	}
+
+	id, n := revisionFromPath(r.URL.Path)
+	if id == "" {
+		return errMissingIdInPath
+	}
+	if n == 0 {
+		return errInvalidRevision
+	}
+
+	note, err := model.RestoreRevision(ctx, as.pool, user, id, n)
+	if err != nil {
+		return modelProblem("RestoreRevision", err)
+	}
+
+	return writeNote(w, http.StatusOK, note)
+}
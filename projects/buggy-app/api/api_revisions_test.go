@@ -0,0 +1,152 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+	"github.com/pashagolub/pgxmock/v2"
+)
+
+func TestNoteRevisions(t *testing.T) {
+	as, mock, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	id, password := "abc123", "password"
+	noteId, created := "xyz789", time.Now()
+
+	rows := mock.NewRows([]string{"note_id", "revision", "content", "author", "created"}).
+		AddRow(noteId, 2, "Second", id, created).
+		AddRow(noteId, 1, "First", id, created)
+	mock.ExpectQuery("^SELECT (.+) FROM public.note_revision r JOIN public.note (.+) ORDER BY r.revision DESC$").
+		WithArgs(noteId, id).
+		WillReturnRows(rows)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("/1/my/note/%s/revisions.json", noteId), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, res.Code)
+	}
+
+	data := struct {
+		Revisions []model.Revision `json:"revisions"`
+	}{Revisions: []model.Revision{
+		{NoteId: noteId, Revision: 2, Content: "Second", Author: id, Created: created},
+		{NoteId: noteId, Revision: 1, Content: "First", Author: id, Created: created},
+	}}
+	assertJSON(res.Body.Bytes(), data, t)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestNoteRevisionNotFound(t *testing.T) {
+	as, mock, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	id, password := "abc123", "password"
+	noteId, created := "xyz789", time.Now()
+
+	// The note is readable but has no revision 5
+	var missing *int
+	rows := mock.NewRows([]string{"id", "revision", "content", "author", "created"}).
+		AddRow(noteId, missing, "", "", created)
+	mock.ExpectQuery("^SELECT (.+) FROM public.note LEFT JOIN public.note_revision r (.+)$").
+		WithArgs(noteId, id, 5).
+		WillReturnRows(rows)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("/1/my/note/%s/revisions/5.json", noteId), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, res.Code)
+	}
+
+	// A revision that isn't a positive number never reaches the database
+	req, err = http.NewRequest("GET", fmt.Sprintf("/1/my/note/%s/revisions/latest.json", noteId), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+	res = httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, res.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRestoreNoteRevision(t *testing.T) {
+	as, mock, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	id, password := "abc123", "password"
+	noteId, content, created, modified := "xyz789", "First", time.Now(), time.Now()
+
+	revision := 1
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT (.+) FROM public.note LEFT JOIN public.note_revision r (.+) AND note_share.permission = 'write'\\)\\)$").
+		WithArgs(noteId, id, 1).
+		WillReturnRows(mock.NewRows([]string{"id", "revision", "content", "author", "created"}).
+			AddRow(noteId, &revision, content, id, created))
+	mock.ExpectQuery("^UPDATE public.note SET content = (.+) RETURNING (.+)$").
+		WithArgs(content, noteId, id).
+		WillReturnRows(mock.NewRows([]string{"id", "owner", "content", "created", "modified"}).
+			AddRow(noteId, id, content, created, modified))
+	mock.ExpectExec("^DELETE FROM public.note_tag WHERE note_id = (.+)$").
+		WithArgs(noteId).
+		WillReturnResult(pgxmock.NewResult("DELETE", 0))
+	mock.ExpectExec("^INSERT INTO public.note_revision (.+)$").
+		WithArgs(noteId, content, id).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectCommit()
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("/1/my/note/%s/revisions/1/restore.json", noteId), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, res.Code)
+	}
+
+	data := struct {
+		Note model.Note `json:"note"`
+	}{Note: model.Note{Id: noteId, Owner: id, Content: content, Created: created, Modified: modified, Tags: []string{}}}
+	assertJSON(res.Body.Bytes(), data, t)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/authuserctx"
+)
+
+// Handlers for sharing notes with other users. Only the owner of a note can see or change
+// who it is shared with:
+//
+//	GET    /1/my/note/:id/shares.json        -- list shares
+//	PUT    /1/my/note/:id/shares/:user.json  -- grant (or change) access, body {"permission": "read"}
+//	DELETE /1/my/note/:id/shares/:user.json  -- revoke access
+//	GET    /1/shared/notes.json              -- notes other users have shared with me
+
+// Dispatch requests for the shares of a note by method
+func (as *Service) routeNoteShares(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return as.handleNoteShares(w, r)
+	}
+	return methodNotAllowed(w, "GET, HEAD")
+}
+
+// Dispatch requests for a single share by method
+func (as *Service) routeNoteShare(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodPut:
+		return as.handleShareNote(w, r)
+	case http.MethodDelete:
+		return as.handleUnshareNote(w, r)
+	}
+	return methodNotAllowed(w, "PUT, DELETE")
+}
+
+// Get the note ID and user ID from a path like /1/my/note/abc123/shares/xyz789.json
+func shareIdsFromPath(urlPath string) (string, string) {
+	id, rest := splitNotePath(urlPath)
+	if len(rest) != 2 {
+		return id, ""
+	}
+	return id, strings.TrimSuffix(rest[1], ".json")
+}
+
+// HTTP handler for listing who a note is shared with
+func (as *Service) handleNoteShares(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		return errNoAuthContext
+	}
+
+	id, _ := splitNotePath(r.URL.Path)
+	if id == "" {
+		return errMissingIdInPath
+	}
+
+	shares, err := model.GetSharesForNote(ctx, as.pool, owner, id)
+	if err != nil {
+		return modelProblem("GetSharesForNote", err)
+	}
+
+	response := struct {
+		Shares []model.Share `json:"shares"`
+	}{
+		Shares: shares,
+	}
+	return writeJSON(w, http.StatusOK, response)
+}
+
+// HTTP handler for granting another user access to a note
+func (as *Service) handleShareNote(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		return errNoAuthContext
+	}
+
+	id, user := shareIdsFromPath(r.URL.Path)
+	if id == "" || user == "" {
+		return errMissingIdInPath
+	}
+
+	var input struct {
+		Permission string `json:"permission"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxNoteBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&input); err != nil {
+		return newProblem(http.StatusBadRequest, CodeInvalidBody, fmt.Sprintf("invalid share body: %v", err))
+	}
+	permission, err := model.ParsePermission(input.Permission)
+	if err != nil {
+		return modelProblem("ParsePermission", err)
+	}
+
+	share, err := model.ShareNote(ctx, as.pool, owner, id, user, permission)
+	if err != nil {
+		return modelProblem("ShareNote", err)
+	}
+
+	response := struct {
+		Share model.Share `json:"share"`
+	}{
+		Share: share,
+	}
+	return writeJSON(w, http.StatusOK, response)
+}
+
+// HTTP handler for revoking another user's access to a note
+func (as *Service) handleUnshareNote(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		return errNoAuthContext
+	}
+
+	id, user := shareIdsFromPath(r.URL.Path)
+	if id == "" || user == "" {
+		return errMissingIdInPath
+	}
+
+	err := model.UnshareNote(ctx, as.pool, owner, id, user)
+	if err != nil {
+		return modelProblem("UnshareNote", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// HTTP handler for listing notes that other users have shared with the authenticated user.
+// It takes the same pagination and filter parameters as /1/my/notes.json.
+func (as *Service) handleSharedNotes(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	user, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		return errNoAuthContext
+	}
+
+	opts, err := listOptionsFromQuery(r.URL.Query())
+	if err != nil {
+		return newProblem(http.StatusBadRequest, CodeInvalidQuery, err.Error())
+	}
+
+	notes, next, err := model.GetNotesSharedWith(ctx, as.pool, user, opts)
+	if err != nil {
+		return modelProblem("GetNotesSharedWith", err)
+	}
+
+	return writeNotes(w, r, notes, next)
+}
@@ -0,0 +1,232 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+)
+
+func TestMyNoteByIdShared(t *testing.T) {
+	as, mock, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	id, password := "abc123", "password"
+	noteId, owner, content, created, modified := "pqr123", "mno456", "Shared note", time.Now(), time.Now()
+
+	rows := mock.NewRows([]string{"id", "owner", "content", "created", "modified", "permission"}).
+		AddRow(noteId, owner, content, created, modified, model.PermissionRead)
+	mock.ExpectQuery("^SELECT (.+) FROM public.note (.+) WHERE id = \\$1 AND (.+)$").
+		WithArgs(noteId, id).
+		WillReturnRows(rows)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("/1/my/note/%s.json", noteId), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+	// The client has this version of the note from when it was shared for writing, so it's
+	// out of date even though the note hasn't changed
+	req.Header.Add("If-None-Match", noteETag(model.Note{Id: noteId, Modified: modified, Permission: model.PermissionWrite}))
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, res.Code)
+	}
+
+	data := struct {
+		Note model.Note `json:"note"`
+	}{Note: model.Note{Id: noteId, Owner: owner, Content: content, Created: created, Modified: modified, Tags: []string{}, Permission: model.PermissionRead}}
+	assertJSON(res.Body.Bytes(), data, t)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestShareNote(t *testing.T) {
+	as, mock, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	id, password := "abc123", "password"
+	noteId, user, granted := "xyz789", "mno456", time.Now()
+
+	rows := mock.NewRows([]string{"note_id", "user_id", "permission", "granted"}).
+		AddRow(noteId, user, model.PermissionWrite, granted)
+	mock.ExpectQuery("^INSERT INTO public.note_share (.+) SELECT id, \\$3, \\$4 FROM public.note WHERE id = \\$1 AND owner = \\$2 (.+)$").
+		WithArgs(noteId, id, user, model.PermissionWrite).
+		WillReturnRows(rows)
+
+	req, err := http.NewRequest("PUT", fmt.Sprintf("/1/my/note/%s/shares/%s.json", noteId, user), strings.NewReader(`{"permission":"write"}`))
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, res.Code)
+	}
+
+	data := struct {
+		Share model.Share `json:"share"`
+	}{Share: model.Share{NoteId: noteId, UserId: user, Permission: model.PermissionWrite, Granted: granted}}
+	assertJSON(res.Body.Bytes(), data, t)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestShareNoteInvalid(t *testing.T) {
+	as, mock, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	id, password := "abc123", "password"
+
+	for path, body := range map[string]string{
+		"/1/my/note/xyz789/shares/mno456.json": `{"permission":"admin"}`,
+		"/1/my/note/xyz789/shares/abc123.json": `{"permission":"read"}`,
+	} {
+		req, err := http.NewRequest("PUT", path, strings.NewReader(body))
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+		res := httptest.NewRecorder()
+		as.Handler().ServeHTTP(res, req)
+
+		if res.Code != http.StatusBadRequest {
+			t.Fatalf("%s %s: expected status %d, got %d", path, body, http.StatusBadRequest, res.Code)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUnshareNote(t *testing.T) {
+	as, mock, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	id, password := "abc123", "password"
+	noteId, user := "xyz789", "mno456"
+
+	rows := mock.NewRows([]string{"user_id"}).AddRow(user)
+	mock.ExpectQuery("^DELETE FROM public.note_share USING public.note (.+)$").
+		WithArgs(noteId, id, user).
+		WillReturnRows(rows)
+
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("/1/my/note/%s/shares/%s.json", noteId, user), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, res.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestNoteShares(t *testing.T) {
+	as, mock, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	id, password := "abc123", "password"
+	noteId, granted := "xyz789", time.Now()
+
+	mock.ExpectQuery("^SELECT id FROM public.note WHERE id = \\$1 AND owner = \\$2 AND deleted_at IS NULL$").
+		WithArgs(noteId, id).
+		WillReturnRows(mock.NewRows([]string{"id"}).AddRow(noteId))
+	rows := mock.NewRows([]string{"note_id", "user_id", "permission", "granted"}).
+		AddRow(noteId, "mno456", model.PermissionRead, granted)
+	mock.ExpectQuery("^SELECT (.+) FROM public.note_share WHERE note_id = \\$1 (.+)$").
+		WithArgs(noteId).
+		WillReturnRows(rows)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("/1/my/note/%s/shares.json", noteId), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, res.Code)
+	}
+
+	data := struct {
+		Shares []model.Share `json:"shares"`
+	}{Shares: []model.Share{{NoteId: noteId, UserId: "mno456", Permission: model.PermissionRead, Granted: granted}}}
+	assertJSON(res.Body.Bytes(), data, t)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSharedNotes(t *testing.T) {
+	as, mock, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	id, password := "abc123", "password"
+	noteId, owner, content, created, modified := "pqr123", "mno456", "Shared note", time.Now(), time.Now()
+
+	rows := mock.NewRows([]string{"id", "owner", "content", "created", "modified", "permission"}).
+		AddRow(noteId, owner, content, created, modified, model.PermissionWrite)
+	mock.ExpectQuery("^SELECT (.+), permission FROM public.note JOIN public.note_share ON note_id = id WHERE user_id = \\$1 AND deleted_at IS NULL ORDER BY (.+)$").
+		WithArgs(id).
+		WillReturnRows(rows)
+
+	req, err := http.NewRequest("GET", "/1/shared/notes.json", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, res.Code)
+	}
+
+	data := struct {
+		Notes []model.Note `json:"notes"`
+	}{Notes: []model.Note{
+		{Id: noteId, Owner: owner, Content: content, Created: created, Modified: modified, Tags: []string{}, Permission: model.PermissionWrite},
+	}}
+	assertJSON(res.Body.Bytes(), data, t)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/logctx"
+)
+
+// Token bodies are small: this is plenty for an id, password or refresh token
+const maxTokenBodyBytes = 4 << 10
+
+// Dispatch requests for /1/auth/token by method. The endpoint isn't behind wrapAuth: the
+// credentials are in the body.
+func (as *Service) routeAuthToken(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodPost:
+		return as.handleIssueToken(w, r)
+	case http.MethodDelete:
+		return as.handleRevokeToken(w, r)
+	}
+	return methodNotAllowed(w, "POST, DELETE")
+}
+
+type tokenRequest struct {
+	// "password" to log in with id and password, or "refresh_token" to swap a refresh token
+	// for new tokens
+	GrantType    string `json:"grant_type"`
+	Id           string `json:"id,omitempty"`
+	Password     string `json:"password,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	// For the password grant, if the user has a second factor
+	Otp string `json:"otp,omitempty"`
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func decodeTokenRequest(w http.ResponseWriter, r *http.Request) (tokenRequest, error) {
+	var input tokenRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxTokenBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&input); err != nil {
+		return input, newProblem(http.StatusBadRequest, CodeInvalidBody, fmt.Sprintf("invalid token body: %v", err))
+	}
+	return input, nil
+}
+
+// HTTP handler for issuing tokens, either from an id and password or from a refresh token:
+//
+//	POST /1/auth/token {"grant_type": "password", "id": "...", "password": "...", "otp": "..."}
+//	POST /1/auth/token {"grant_type": "refresh_token", "refresh_token": "..."}
+//
+// Failures count against the client's allowance of unauthenticated requests, like failed
+// Basic auth, and once it's used up the auth service isn't asked at all.
+func (as *Service) handleIssueToken(w http.ResponseWriter, r *http.Request) error {
+	if limit := as.ipLimiter.peek(clientIp(r)); !limit.allowed {
+		return tooManyRequests(w, limit)
+	}
+	ctx := auth.NewSourceContext(r.Context(), clientIp(r))
+	input, err := decodeTokenRequest(w, r)
+	if err != nil {
+		return err
+	}
+
+	var result *auth.TokenResult
+	switch input.GrantType {
+	case "password":
+		if input.Id == "" || input.Password == "" {
+			return newProblem(http.StatusBadRequest, CodeInvalidBody, "The password grant needs an id and a password.")
+		}
+		if input.Otp != "" {
+			ctx = auth.NewOtpContext(ctx, input.Otp)
+		}
+		result, err = as.authClient.IssueToken(ctx, input.Id, input.Password)
+	case "refresh_token":
+		if input.RefreshToken == "" {
+			return newProblem(http.StatusBadRequest, CodeInvalidBody, "The refresh_token grant needs a refresh_token.")
+		}
+		result, err = as.authClient.RefreshToken(ctx, input.RefreshToken)
+	default:
+		return newProblem(http.StatusBadRequest, CodeInvalidBody, `grant_type must be "password" or "refresh_token".`)
+	}
+	if err != nil {
+		return internalProblem(fmt.Errorf("issue token error: %w", err))
+	}
+	if result.State != auth.StateAllow {
+		logctx.FromContext(ctx).Info("api: token denied", "grant_type", input.GrantType, "user", input.Id, "reason", result.Reason)
+		return as.denied(w, r, result.Reason, result.RetryAfter)
+	}
+
+	// Tokens must not be kept by caches along the way
+	w.Header().Set("Cache-Control", "no-store")
+	return writeJSON(w, http.StatusOK, tokenResponse{
+		AccessToken:  result.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(result.ExpiresIn / time.Second),
+		RefreshToken: result.RefreshToken,
+	})
+}
+
+// HTTP handler for ending a session: DELETE /1/auth/token {"refresh_token": "..."}
+// It responds 204 whether or not the token was valid.
+func (as *Service) handleRevokeToken(w http.ResponseWriter, r *http.Request) error {
+	input, err := decodeTokenRequest(w, r)
+	if err != nil {
+		return err
+	}
+	if input.RefreshToken == "" {
+		return newProblem(http.StatusBadRequest, CodeInvalidBody, "A refresh_token is needed to revoke.")
+	}
+
+	if err := as.authClient.RevokeToken(r.Context(), input.RefreshToken); err != nil {
+		return internalProblem(fmt.Errorf("revoke token error: %w", err))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+)
+
+func TestIssueToken(t *testing.T) {
+	tokens := &auth.TokenResult{
+		State:        auth.StateAllow,
+		AccessToken:  "access",
+		RefreshToken: "refresh",
+		ExpiresIn:    15 * time.Minute,
+	}
+	as, _, client := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+	client.On("IssueToken", tokens, nil).On("RefreshToken", tokens, nil)
+
+	for _, body := range []string{
+		`{"grant_type": "password", "id": "abc123", "password": "password"}`,
+		`{"grant_type": "refresh_token", "refresh_token": "old"}`,
+	} {
+		req, err := http.NewRequest("POST", "/1/auth/token", strings.NewReader(body))
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.RemoteAddr = "192.0.2.1:1234"
+		res := httptest.NewRecorder()
+		as.Handler().ServeHTTP(res, req)
+
+		if res.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d, got %d", body, http.StatusOK, res.Code)
+		}
+		if cc := res.Header().Get("Cache-Control"); cc != "no-store" {
+			t.Fatalf("%s: expected Cache-Control no-store, got %q", body, cc)
+		}
+		assertJSON(res.Body.Bytes(), tokenResponse{
+			AccessToken:  "access",
+			TokenType:    "Bearer",
+			ExpiresIn:    900,
+			RefreshToken: "refresh",
+		}, t)
+	}
+
+	// The client's IP goes to the auth service, which throttles failures by it
+	issued, refreshed := client.Calls("IssueToken"), client.Calls("RefreshToken")
+	if len(issued) != 1 || issued[0].Args[0] != "abc123" || issued[0].Source != "192.0.2.1" {
+		t.Fatalf("unexpected IssueToken calls %+v", issued)
+	}
+	if len(refreshed) != 1 || refreshed[0].Args[0] != "old" {
+		t.Fatalf("unexpected RefreshToken calls %+v", refreshed)
+	}
+}
+
+func TestIssueTokenDenied(t *testing.T) {
+	config := defaultConfig
+	config.IpRateLimit = RateLimit{Rate: 0.1, Burst: 1}
+	as, _, _ := newMockConfigService(t, config, &auth.VerifyResult{
+		State: auth.StateDeny,
+	})
+
+	codes := []int{}
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("POST", "/1/auth/token", strings.NewReader(`{"grant_type": "password", "id": "abc123", "password": "wrong"}`))
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.RemoteAddr = "192.0.2.1:1234"
+		res := httptest.NewRecorder()
+		as.Handler().ServeHTTP(res, req)
+		codes = append(codes, res.Code)
+	}
+
+	// Failures count against the client's allowance, like failed Basic auth
+	expected := []int{http.StatusUnauthorized, http.StatusTooManyRequests}
+	if fmt.Sprint(codes) != fmt.Sprint(expected) {
+		t.Fatalf("expected statuses %v, got %v", expected, codes)
+	}
+}
+
+func TestIssueTokenInvalid(t *testing.T) {
+	as, _, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	for _, body := range []string{
+		`{"grant_type": "client_credentials"}`,
+		`{"grant_type": "password", "id": "abc123"}`,
+		`{"grant_type": "refresh_token"}`,
+		`not json`,
+	} {
+		req, err := http.NewRequest("POST", "/1/auth/token", strings.NewReader(body))
+		if err != nil {
+			log.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		as.Handler().ServeHTTP(res, req)
+
+		if res.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected status %d, got %d", body, http.StatusBadRequest, res.Code)
+		}
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	as, _, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	req, err := http.NewRequest("DELETE", "/1/auth/token", strings.NewReader(`{"refresh_token": "refresh"}`))
+	if err != nil {
+		log.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, res.Code)
+	}
+}
+
+func TestOtpDenied(t *testing.T) {
+	cases := []struct {
+		reason string
+		code   ErrorCode
+	}{
+		{auth.ReasonOtpRequired, CodeOtpRequired},
+		{auth.ReasonInvalidOtp, CodeInvalidOtp},
+	}
+	for _, c := range cases {
+		as, _, client := newMockService(t, &auth.VerifyResult{
+			State: auth.StateAllow,
+			Roles: []string{"user"},
+		})
+		client.On("IssueToken", &auth.TokenResult{
+			State:  auth.StateDeny,
+			Reason: c.reason,
+		}, nil)
+
+		req, err := http.NewRequest("POST", "/1/auth/token", strings.NewReader(`{"grant_type": "password", "id": "abc123", "password": "password", "otp": "123456"}`))
+		if err != nil {
+			log.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		as.Handler().ServeHTTP(res, req)
+		var p Problem
+		if err := json.Unmarshal(res.Body.Bytes(), &p); err != nil || res.Code != http.StatusUnauthorized || p.Code != c.code {
+			t.Fatalf("%s: expected the token request to be %d with code %s, got %d: %s", c.reason, http.StatusUnauthorized, c.code, res.Code, res.Body)
+		}
+	}
+}
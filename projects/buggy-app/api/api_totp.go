@@ -0,0 +1,144 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/authuserctx"
+)
+
+// Handlers for the authenticated user's second factor, which the auth service looks after:
+//
+//	POST   /1/my/account/totp.json           -- enrol a new secret, returning it and an otpauth:// URI
+//	POST   /1/my/account/totp/confirm.json   -- turn it on, body {"code": "123456"}, returning recovery codes
+//	DELETE /1/my/account/totp.json           -- turn it off, body {"code": "123456"} or a recovery code
+//
+// Once it's on, logging in needs a code as well as the password, in the "otp" field of a password
+// token request. Each code only works once, so Basic auth, which sends the password with every
+// request, is refused with errOtpNeedsToken: the user needs a token. Managing it needs the
+// account:manage permission, which no API key has as a scope.
+
+// Plenty for a code
+const maxTotpBodyBytes = 1 << 10
+
+type totpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+func decodeTotpCode(w http.ResponseWriter, r *http.Request) (string, error) {
+	var input totpCodeRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxTotpBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&input); err != nil {
+		return "", newProblem(http.StatusBadRequest, CodeInvalidBody, fmt.Sprintf("invalid totp body: %v", err))
+	}
+	if input.Code == "" {
+		return "", newProblem(http.StatusBadRequest, CodeInvalidBody, "A code is required.")
+	}
+	return input.Code, nil
+}
+
+// Turn an error from confirming or disabling into a Problem. op names the client method, for the
+// log if the error is unexpected.
+func totpProblem(op string, err error, notEnrolled *Problem) *Problem {
+	switch {
+	case errors.Is(err, auth.ErrInvalidArgument):
+		return errWrongTotpCode.withCause(err)
+	case errors.Is(err, auth.ErrFailedPrecondition):
+		return notEnrolled.withCause(err)
+	case errors.Is(err, auth.ErrTooManyAttempts):
+		return errTooManyTotpCodes.withCause(err)
+	}
+	return internalProblem(fmt.Errorf("%s error: %w", op, err))
+}
+
+// Dispatch requests for /1/my/account/totp.json by method
+func (as *Service) routeMyTotp(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodPost:
+		return as.handleEnrolTotp(w, r)
+	case http.MethodDelete:
+		return as.handleDisableTotp(w, r)
+	}
+	return methodNotAllowed(w, "POST, DELETE")
+}
+
+// Dispatch requests for /1/my/account/totp/confirm.json by method
+func (as *Service) routeConfirmTotp(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return methodNotAllowed(w, "POST")
+	}
+	return as.handleConfirmTotp(w, r)
+}
+
+// HTTP handler for enrolling a new secret. It isn't used until it's confirmed.
+func (as *Service) handleEnrolTotp(w http.ResponseWriter, r *http.Request) error {
+	owner, ok := authuserctx.FromAuthenticatedContext(r.Context())
+	if !ok {
+		return errNoAuthContext
+	}
+
+	enrolment, err := as.authClient.EnrolTotp(r.Context(), owner)
+	if errors.Is(err, auth.ErrFailedPrecondition) {
+		return errTotpEnrolled.withCause(err)
+	}
+	if err != nil {
+		return internalProblem(fmt.Errorf("enrol totp error: %w", err))
+	}
+
+	// The secret must not be kept by caches along the way
+	w.Header().Set("Cache-Control", "no-store")
+	return writeJSON(w, http.StatusOK, struct {
+		Secret     string `json:"secret"`
+		OtpauthUri string `json:"otpauth_uri"`
+	}{
+		Secret:     enrolment.Secret,
+		OtpauthUri: enrolment.URI,
+	})
+}
+
+// HTTP handler for confirming the new secret. The response is the only time the recovery codes
+// are shown.
+func (as *Service) handleConfirmTotp(w http.ResponseWriter, r *http.Request) error {
+	owner, ok := authuserctx.FromAuthenticatedContext(r.Context())
+	if !ok {
+		return errNoAuthContext
+	}
+	code, err := decodeTotpCode(w, r)
+	if err != nil {
+		return err
+	}
+
+	recoveryCodes, err := as.authClient.ConfirmTotp(r.Context(), owner, code)
+	if err != nil {
+		return totpProblem("confirm totp", err, errNoTotpToConfirm)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	return writeJSON(w, http.StatusOK, struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{
+		RecoveryCodes: recoveryCodes,
+	})
+}
+
+// HTTP handler for turning the second factor off
+func (as *Service) handleDisableTotp(w http.ResponseWriter, r *http.Request) error {
+	owner, ok := authuserctx.FromAuthenticatedContext(r.Context())
+	if !ok {
+		return errNoAuthContext
+	}
+	code, err := decodeTotpCode(w, r)
+	if err != nil {
+		return err
+	}
+
+	if err := as.authClient.DisableTotp(r.Context(), owner, code); err != nil {
+		return totpProblem("disable totp", err, errTotpNotEnrolled)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
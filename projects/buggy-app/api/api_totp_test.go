@@ -0,0 +1,167 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+)
+
+func TestTotp(t *testing.T) {
+	as, _, client := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+		Id:    "abc123",
+	})
+	client.
+		On("EnrolTotp", &auth.TotpEnrolment{Secret: "JBSWY3DPEHPK3PXP", URI: "otpauth://totp/buggy-app:abc123?secret=JBSWY3DPEHPK3PXP"}, nil).
+		On("EnrolTotp", nil, fmt.Errorf("failed to enrol totp: %w", auth.ErrFailedPrecondition)).
+		On("ConfirmTotp", nil, fmt.Errorf("failed to confirm totp: %w", auth.ErrInvalidArgument)).
+		On("ConfirmTotp", []string{"recovery-1", "recovery-2"}, nil).
+		On("DisableTotp", nil, nil).
+		On("DisableTotp", nil, fmt.Errorf("failed to disable totp: %w", auth.ErrFailedPrecondition))
+
+	res := serveBasic(as, "POST", "/1/my/account/totp.json", "")
+	if res.Code != http.StatusOK || res.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("expected status %d and no-store, got %d: %s", http.StatusOK, res.Code, res.Body)
+	}
+	var enrolment struct {
+		Secret     string `json:"secret"`
+		OtpauthUri string `json:"otpauth_uri"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &enrolment); err != nil {
+		t.Fatal(err)
+	}
+	if enrolment.Secret == "" || !strings.HasPrefix(enrolment.OtpauthUri, "otpauth://totp/") {
+		t.Fatalf("unexpected enrolment %+v", enrolment)
+	}
+
+	assertProblem(t, serveBasic(as, "POST", "/1/my/account/totp/confirm.json", `{"code": "000000"}`), http.StatusBadRequest, CodeInvalidOtp)
+	assertProblem(t, serveBasic(as, "POST", "/1/my/account/totp/confirm.json", `{}`), http.StatusBadRequest, CodeInvalidBody)
+
+	code := "492039"
+	res = serveBasic(as, "POST", "/1/my/account/totp/confirm.json", fmt.Sprintf(`{"code": %q}`, code))
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, res.Code, res.Body)
+	}
+	var confirmed struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &confirmed); err != nil {
+		t.Fatal(err)
+	}
+	if len(confirmed.RecoveryCodes) == 0 {
+		t.Fatalf("expected recovery codes, got %s", res.Body)
+	}
+	if calls := client.Calls("ConfirmTotp"); len(calls) != 2 || calls[1].Args[0] != "abc123" || calls[1].Args[1] != code {
+		t.Fatalf("expected the code to be confirmed for the authenticated user, got %+v", calls)
+	}
+
+	// A second secret can't be enrolled until the first is turned off
+	assertProblem(t, serveBasic(as, "POST", "/1/my/account/totp.json", ""), http.StatusConflict, CodeTotpEnrolled)
+
+	res = serveBasic(as, "DELETE", "/1/my/account/totp.json", fmt.Sprintf(`{"code": %q}`, confirmed.RecoveryCodes[0]))
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusNoContent, res.Code, res.Body)
+	}
+	assertProblem(t, serveBasic(as, "DELETE", "/1/my/account/totp.json", fmt.Sprintf(`{"code": %q}`, code)), http.StatusConflict, CodeTotpNotEnrolled)
+}
+
+func TestTotpNotWithApiKey(t *testing.T) {
+	as, _, _ := newMockService(t, &auth.VerifyResult{
+		State:  auth.StateAllow,
+		Roles:  []string{"user"},
+		Id:     "abc123",
+		Scopes: []string{auth.ScopeNotesRead, auth.ScopeNotesWrite},
+	})
+
+	req, err := http.NewRequest("POST", "/1/my/account/totp.json", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("X-Api-Key", "bk_key")
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+	if res.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusForbidden, res.Code, res.Body)
+	}
+}
+
+func TestTotpBasicAuth(t *testing.T) {
+	as, mock, client := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+		Id:    "abc123",
+	})
+	client.On("Verify", &auth.VerifyResult{
+		State:  auth.StateDeny,
+		Reason: auth.ReasonOtpRequired,
+	}, nil).On("IssueToken", &auth.TokenResult{
+		State:       auth.StateAllow,
+		AccessToken: "access",
+		ExpiresIn:   15 * time.Minute,
+	}, nil)
+
+	// Each code works once, so with Basic auth a code would be good for one request. Basic auth
+	// doesn't take one, and tells the user to get a token, every time.
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", "/1/my/notes.json", nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Header.Add("Authorization", util.BasicAuthHeaderValue("abc123", "password"))
+		req.Header.Add("X-Otp", "123456")
+		res := httptest.NewRecorder()
+		as.Handler().ServeHTTP(res, req)
+
+		var p Problem
+		if err := json.Unmarshal(res.Body.Bytes(), &p); err != nil || res.Code != http.StatusUnauthorized || p.Code != CodeOtpRequired || !strings.Contains(p.Detail, "/1/auth/token") {
+			t.Fatalf("request %d: expected status %d with code %s, saying to get a token, got %d: %s", i, http.StatusUnauthorized, CodeOtpRequired, res.Code, res.Body)
+		}
+	}
+	for _, call := range client.Calls("Verify") {
+		if call.Otp != "" {
+			t.Fatalf("expected Basic auth not to send a code, got %+v", call)
+		}
+	}
+
+	// With a token from the code, any number of requests work
+	req, err := http.NewRequest("POST", "/1/auth/token", strings.NewReader(`{"grant_type": "password", "id": "abc123", "password": "password", "otp": "123456"}`))
+	if err != nil {
+		log.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, res.Code, res.Body)
+	}
+	if calls := client.Calls("IssueToken"); len(calls) != 1 || calls[0].Otp != "123456" {
+		t.Fatalf("expected the code to be sent for the token, got %+v", calls)
+	}
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery("^SELECT (.+) FROM public.note WHERE owner = \\$1 AND deleted_at IS NULL ORDER BY (.+)$").
+			WithArgs("abc123").
+			WillReturnRows(mock.NewRows([]string{"id", "owner", "content", "created", "modified"}))
+		req, err := http.NewRequest("GET", "/1/my/notes.json", nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Header.Add("Authorization", "Bearer access")
+		res := httptest.NewRecorder()
+		as.Handler().ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("request %d: expected status %d with the token, got %d: %s", i, http.StatusOK, res.Code, res.Body)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/authuserctx"
+)
+
+// Handlers for the trash. DELETE /1/my/note/:id.json moves a note here, and from here it can
+// be restored or deleted for good:
+//
+//	GET    /1/my/trash.json                -- list notes in the trash
+//	POST   /1/my/trash/:id/restore.json    -- take a note out of the trash
+//	DELETE /1/my/trash/:id.json            -- permanently delete a note in the trash
+
+// Dispatch requests for the trash by method
+func (as *Service) routeMyTrash(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return as.handleMyTrash(w, r)
+	}
+	return methodNotAllowed(w, "GET, HEAD")
+}
+
+// Get the note ID and the rest of the path from a trash path:
+//
+//	/1/my/trash/abc123.json -> "abc123", []
+//	/1/my/trash/abc123/restore.json -> "abc123", ["restore.json"]
+func splitTrashPath(urlPath string) (string, []string) {
+	parts := strings.Split(strings.TrimPrefix(urlPath, "/1/my/trash/"), "/")
+	return strings.TrimSuffix(parts[0], ".json"), parts[1:]
+}
+
+// Dispatch requests for a single note in the trash by path and method
+func (as *Service) routeMyTrashNote(w http.ResponseWriter, r *http.Request) error {
+	_, rest := splitTrashPath(r.URL.Path)
+	switch {
+	case len(rest) == 0:
+		if r.Method != http.MethodDelete {
+			return methodNotAllowed(w, "DELETE")
+		}
+		return as.handlePurgeMyNote(w, r)
+	case len(rest) == 1 && rest[0] == "restore.json":
+		if r.Method != http.MethodPost {
+			return methodNotAllowed(w, "POST")
+		}
+		return as.handleRestoreMyNote(w, r)
+	}
+	return errNotFound
+}
+
+// HTTP handler for listing the notes in the authenticated user's trash. Takes the same
+// query parameters as /1/my/notes.json.
+func (as *Service) handleMyTrash(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		return errNoAuthContext
+	}
+
+	opts, err := listOptionsFromQuery(r.URL.Query())
+	if err != nil {
+		return newProblem(http.StatusBadRequest, CodeInvalidQuery, err.Error())
+	}
+
+	notes, next, err := model.GetTrashForOwner(ctx, as.pool, owner, as.config.TrashRetention, opts)
+	if err != nil {
+		return modelProblem("GetTrashForOwner", err)
+	}
+
+	return writeNotes(w, r, notes, next)
+}
+
+// HTTP handler for taking a note out of the trash. Responds with the restored note.
+func (as *Service) handleRestoreMyNote(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		return errNoAuthContext
+	}
+
+	id, _ := splitTrashPath(r.URL.Path)
+	if id == "" {
+		return errMissingIdInPath
+	}
+
+	note, err := model.RestoreNote(ctx, as.pool, owner, id, as.config.TrashRetention)
+	if err != nil {
+		return modelProblem("RestoreNote", err)
+	}
+
+	return writeNote(w, http.StatusOK, note)
+}
+
+// HTTP handler for permanently deleting a note that is in the trash
+func (as *Service) handlePurgeMyNote(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	owner, ok := authuserctx.FromAuthenticatedContext(ctx)
+	if !ok {
+		return errNoAuthContext
+	}
+
+	id, _ := splitTrashPath(r.URL.Path)
+	if id == "" {
+		return errMissingIdInPath
+	}
+
+	err := model.PurgeNote(ctx, as.pool, owner, id)
+	if err != nil {
+		return modelProblem("PurgeNote", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
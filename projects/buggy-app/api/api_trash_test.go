@@ -0,0 +1,121 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+)
+
+func TestMyTrash(t *testing.T) {
+	as, mock, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	id, password := "abc123", "password"
+	noteId, content, created, modified, deleted := "xyz789", "Old note", time.Now(), time.Now(), time.Now()
+
+	rows := mock.NewRows([]string{"id", "owner", "content", "created", "modified", "deleted_at"}).
+		AddRow(noteId, id, content, created, modified, &deleted)
+	mock.ExpectQuery("^SELECT (.+), deleted_at FROM public.note WHERE owner = \\$1 AND deleted_at > now\\(\\) - \\$2::interval ORDER BY (.+)$").
+		WithArgs(id, model.DefaultTrashRetention).
+		WillReturnRows(rows)
+
+	req, err := http.NewRequest("GET", "/1/my/trash.json", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, res.Code)
+	}
+
+	data := struct {
+		Notes []model.Note `json:"notes"`
+	}{Notes: []model.Note{
+		{Id: noteId, Owner: id, Content: content, Created: created, Modified: modified, Tags: []string{}, DeletedAt: &deleted},
+	}}
+	assertJSON(res.Body.Bytes(), data, t)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRestoreMyNote(t *testing.T) {
+	as, mock, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	id, password := "abc123", "password"
+	noteId, content, created, modified := "xyz789", "Old note #back", time.Now(), time.Now()
+
+	rows := mock.NewRows([]string{"id", "owner", "content", "created", "modified"}).
+		AddRow(noteId, id, content, created, modified)
+	mock.ExpectQuery("^UPDATE public.note SET deleted_at = NULL WHERE id = \\$1 AND owner = \\$2 AND deleted_at > now\\(\\) - \\$3::interval RETURNING (.+)$").
+		WithArgs(noteId, id, model.DefaultTrashRetention).
+		WillReturnRows(rows)
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("/1/my/trash/%s/restore.json", noteId), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, res.Code)
+	}
+
+	data := struct {
+		Note model.Note `json:"note"`
+	}{Note: model.Note{Id: noteId, Owner: id, Content: content, Created: created, Modified: modified, Tags: []string{"back"}}}
+	assertJSON(res.Body.Bytes(), data, t)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPurgeMyNote(t *testing.T) {
+	as, mock, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	id, password := "abc123", "password"
+	noteId := "xyz789"
+
+	// Only notes already in the trash can be purged
+	mock.ExpectQuery("^DELETE FROM public.note WHERE id = \\$1 AND owner = \\$2 AND deleted_at IS NOT NULL RETURNING id$").
+		WithArgs(noteId, id).
+		WillReturnRows(mock.NewRows([]string{"id"}))
+
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("/1/my/trash/%s.json", noteId), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, res.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+)
+
+// Notes are cached by clients using entity tags (ETags). A note's ETag is built from its ID and
+// modified timestamp, which changes whenever the note is written, so an ETag always identifies
+// one version of one note. For a note shared with the reader it includes their permission too,
+// which can change without the note being written. A list's ETag is a hash of the ETags of the
+// notes on the page.
+//
+// ETags are used in two ways:
+//
+//   - GET requests with If-None-Match get 304 Not Modified, and no body, if the client
+//     already has the current version.
+//   - Writes with If-Match only happen if the note is still at that version, and otherwise
+//     get 412 Precondition Failed. This stops two clients overwriting each other's changes.
+//
+// See https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/ETag
+
+// The strong ETag for a version of a note, like "JBmytGF3-ccs1a8kcju", or "JBmytGF3-ccs1a8kcju-read"
+// for a note shared with the reader
+func noteETag(note model.Note) string {
+	version := strconv.FormatInt(note.Modified.UnixMicro(), 36)
+	if note.Permission != "" {
+		return fmt.Sprintf(`"%s-%s-%s"`, note.Id, version, note.Permission)
+	}
+	return fmt.Sprintf(`"%s-%s"`, note.Id, version)
+}
+
+// The strong ETag for a page of notes. It changes if a note on the page changes, or the page
+// holds different notes, or there's a different next page.
+func notesETag(notes model.Notes, next string) string {
+	h := sha256.New()
+	for _, note := range notes {
+		fmt.Fprintln(h, noteETag(note))
+	}
+	fmt.Fprintln(h, next)
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// Whether an If-Match or If-None-Match header value matches etag. The header is "*" or a
+// comma-separated list of ETags. If-None-Match uses weak comparison, so a W/ prefix is
+// ignored; If-Match uses strong comparison, so a weak ETag never matches.
+func etagMatches(header, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Set the ETag header, and respond with 304 Not Modified if the request's If-None-Match
+// matches it. Returns true if the response has been written.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	inm := r.Header.Get("If-None-Match")
+	if inm == "" || !etagMatches(inm, etag, true) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// The condition for a write, from the request's If-Match header. Returns nil, meaning the
+// write is unconditional, if there is no If-Match.
+func ifMatchCondition(r *http.Request) model.NoteCondition {
+	im := r.Header.Get("If-Match")
+	if im == "" {
+		return nil
+	}
+	return func(note model.Note) bool {
+		return etagMatches(im, noteETag(note), false)
+	}
+}
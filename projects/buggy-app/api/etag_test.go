@@ -0,0 +1,236 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+	"github.com/pashagolub/pgxmock/v2"
+)
+
+func TestMyNoteByIdNotModified(t *testing.T) {
+	as, mock, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	id, password := "abc123", "password"
+	noteId, content, created, modified := "xyz789", "Note content", time.Now(), time.Now()
+
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery("^SELECT (.+) FROM public.note (.+) WHERE id = \\$1 AND (.+)$").
+			WithArgs(noteId, id).
+			WillReturnRows(mock.NewRows([]string{"id", "owner", "content", "created", "modified", "permission"}).
+				AddRow(noteId, id, content, created, modified, model.Permission("")))
+	}
+
+	// The first response tells us the ETag...
+	req, err := http.NewRequest("GET", fmt.Sprintf("/1/my/note/%s.json", noteId), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	etag := res.Header().Get("ETag")
+	if res.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected status %d with an ETag, got %d and %q", http.StatusOK, res.Code, etag)
+	}
+
+	// ... which gets a 304 with no body when it's sent back
+	req, err = http.NewRequest("GET", fmt.Sprintf("/1/my/note/%s.json", noteId), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+	req.Header.Add("If-None-Match", `"other", `+etag)
+	res = httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusNotModified {
+		t.Fatalf("expected status %d, got %d", http.StatusNotModified, res.Code)
+	}
+	if res.Body.Len() != 0 {
+		t.Fatalf("expected empty body, got %q", res.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMyNotesNotModified(t *testing.T) {
+	as, mock, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	id, password := "abc123", "password"
+	modified := time.Now()
+
+	// The same notes give the same ETag, but a change to one of them gives a new one
+	etags := []string{}
+	for _, m := range []time.Time{modified, modified, modified.Add(time.Second)} {
+		mock.ExpectQuery("^SELECT (.+) FROM public.note WHERE owner = \\$1 (.+)$").
+			WithArgs(id).
+			WillReturnRows(mock.NewRows([]string{"id", "owner", "content", "created", "modified"}).
+				AddRow("xyz789", id, "Note content", modified, m))
+
+		req, err := http.NewRequest("GET", "/1/my/notes.json", nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+		if len(etags) > 0 {
+			req.Header.Add("If-None-Match", etags[0])
+		}
+		res := httptest.NewRecorder()
+		as.Handler().ServeHTTP(res, req)
+
+		etags = append(etags, res.Header().Get("ETag"))
+		expected := http.StatusOK
+		if len(etags) == 2 {
+			expected = http.StatusNotModified
+		}
+		if res.Code != expected {
+			t.Fatalf("request %d: expected status %d, got %d", len(etags), expected, res.Code)
+		}
+	}
+
+	if etags[0] != etags[1] || etags[0] == etags[2] {
+		t.Fatalf("expected ETags to change only when a note changes, got %v", etags)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateMyNoteIfMatch(t *testing.T) {
+	as, mock, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	id, password := "abc123", "password"
+	noteId, created, modified := "xyz789", time.Now(), time.Now()
+
+	// Someone else has changed the note since the client read it
+	stale := noteETag(model.Note{Id: noteId, Modified: modified.Add(-time.Minute)})
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT (.+) FROM public.note WHERE id = \\$1 AND deleted_at IS NULL AND (.+) FOR UPDATE$").
+		WithArgs(noteId, id).
+		WillReturnRows(mock.NewRows([]string{"id", "owner", "content", "created", "modified"}).
+			AddRow(noteId, id, "Newer content", created, modified))
+	mock.ExpectRollback()
+
+	req, err := http.NewRequest("PUT", fmt.Sprintf("/1/my/note/%s.json", noteId), strings.NewReader(`{"content":"Updated content"}`))
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+	req.Header.Add("If-Match", stale)
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected status %d, got %d", http.StatusPreconditionFailed, res.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateSharedNoteIfMatch(t *testing.T) {
+	as, mock, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	id, password := "abc123", "password"
+	noteId, owner, content, created, modified := "pqr123", "mno456", "Updated content", time.Now(), time.Now()
+	// The ETag the user got when they read the note shared with them
+	current := noteETag(model.Note{Id: noteId, Modified: modified, Permission: model.PermissionWrite})
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT (.+) FROM public.note WHERE id = \\$1 AND deleted_at IS NULL AND (.+) FOR UPDATE$").
+		WithArgs(noteId, id).
+		WillReturnRows(mock.NewRows([]string{"id", "owner", "content", "created", "modified"}).
+			AddRow(noteId, owner, "Shared note", created, modified))
+	mock.ExpectQuery("^UPDATE public.note SET content = (.+) RETURNING (.+)$").
+		WithArgs(content, noteId, id).
+		WillReturnRows(mock.NewRows([]string{"id", "owner", "content", "created", "modified"}).
+			AddRow(noteId, owner, content, created, modified))
+	mock.ExpectExec("^DELETE FROM public.note_tag WHERE note_id = (.+)$").
+		WithArgs(noteId).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	mock.ExpectExec("^INSERT INTO public.note_revision (.+)$").
+		WithArgs(noteId, content, id).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectCommit()
+
+	req, err := http.NewRequest("PUT", fmt.Sprintf("/1/my/note/%s.json", noteId), strings.NewReader(`{"content":"Updated content"}`))
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+	req.Header.Add("If-Match", current)
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, res.Code, res.Body)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeleteMyNoteIfMatch(t *testing.T) {
+	as, mock, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	id, password := "abc123", "password"
+	noteId, created, modified := "xyz789", time.Now(), time.Now()
+	current := noteETag(model.Note{Id: noteId, Modified: modified})
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT (.+) FROM public.note WHERE id = \\$1 AND deleted_at IS NULL AND owner = \\$2 FOR UPDATE$").
+		WithArgs(noteId, id).
+		WillReturnRows(mock.NewRows([]string{"id", "owner", "content", "created", "modified"}).
+			AddRow(noteId, id, "Note content", created, modified))
+	mock.ExpectQuery("^UPDATE public.note SET deleted_at = now\\(\\) (.+) RETURNING id$").
+		WithArgs(noteId, id).
+		WillReturnRows(mock.NewRows([]string{"id"}).AddRow(noteId))
+	mock.ExpectCommit()
+
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("/1/my/note/%s.json", noteId), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+	req.Header.Add("If-Match", current)
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, res.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/logctx"
+)
+
+// Health checks, for docker-compose and orchestrators:
+//
+//	GET /healthz  -- 200 if the process is up and serving HTTP
+//	GET /readyz   -- 200 if the database and auth service can be reached, 503 if not
+//
+// Neither needs authentication, and neither is logged or counted in the metrics, because they
+// are called every few seconds.
+
+// How long the readiness checks can take altogether
+const readyTimeout = 2 * time.Second
+
+// HTTP handler for the liveness check
+func (as *Service) handleHealthz(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return methodNotAllowed(w, "GET, HEAD")
+	}
+	return writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// HTTP handler for the readiness check. The response says which dependencies failed:
+//
+//	{"status": "unavailable", "checks": {"database": "ok", "auth": "auth: not serving"}}
+func (as *Service) handleReadyz(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return methodNotAllowed(w, "GET, HEAD")
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	checks := map[string]error{
+		"database": as.checkDatabase(ctx),
+		"auth":     as.checkAuth(ctx),
+	}
+
+	response := struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}{
+		Status: "ok",
+		Checks: map[string]string{},
+	}
+	status := http.StatusOK
+	for name, err := range checks {
+		if err != nil {
+			logctx.FromContext(ctx).Warn("api: not ready", "check", name, "error", err)
+			response.Checks[name] = err.Error()
+			response.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		response.Checks[name] = "ok"
+	}
+	return writeJSON(w, status, response)
+}
+
+func (as *Service) checkDatabase(ctx context.Context) error {
+	if as.pool == nil {
+		return errors.New("not connected")
+	}
+	return as.pool.Ping(ctx)
+}
+
+func (as *Service) checkAuth(ctx context.Context) error {
+	if as.authClient == nil {
+		return errors.New("not connected")
+	}
+	return as.authClient.Check(ctx)
+}
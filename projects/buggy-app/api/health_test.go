@@ -0,0 +1,92 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+	"github.com/pashagolub/pgxmock/v2"
+)
+
+func TestHealthz(t *testing.T) {
+	as := New(defaultConfig)
+
+	req, err := http.NewRequest("GET", "/healthz", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, res.Code)
+	}
+	assertJSON(res.Body.Bytes(), map[string]string{"status": "ok"}, t)
+}
+
+func TestReadyz(t *testing.T) {
+	as := New(defaultConfig)
+	mock, err := pgxmock.NewPool(pgxmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer mock.Close()
+	as.pool = mock
+	as.authClient = auth.NewMockClient(&auth.VerifyResult{})
+
+	mock.ExpectPing()
+
+	req, err := http.NewRequest("GET", "/readyz", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, res.Code)
+	}
+	assertJSON(res.Body.Bytes(), struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}{"ok", map[string]string{"auth": "ok", "database": "ok"}}, t)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestReadyzDatabaseDown(t *testing.T) {
+	as := New(defaultConfig)
+	mock, err := pgxmock.NewPool(pgxmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer mock.Close()
+	as.pool = mock
+	as.authClient = auth.NewMockClient(&auth.VerifyResult{})
+
+	mock.ExpectPing().WillReturnError(fmt.Errorf("connection refused"))
+
+	req, err := http.NewRequest("GET", "/readyz", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, res.Code)
+	}
+	assertJSON(res.Body.Bytes(), struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}{"unavailable", map[string]string{"auth": "ok", "database": "connection refused"}}, t)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
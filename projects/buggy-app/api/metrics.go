@@ -0,0 +1,50 @@
+package api
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus metrics for the API, served on Config.AdminPort at /metrics:
+//
+//	api_http_requests_total{route, method, status}            -- requests handled
+//	api_http_request_duration_seconds{route, method, status}  -- how long they took
+//
+// along with the auth client's cache counters and the database pool statistics (see
+// util/metrics). route is the mux pattern that matched, not the path, so that note IDs don't
+// create a new series per note.
+
+type apiMetrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+}
+
+func newApiMetrics() *apiMetrics {
+	m := &apiMetrics{
+		registry: metrics.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "api",
+			Name:      "http_requests_total",
+			Help:      "HTTP requests handled, by route, method and status.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "api",
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to handle HTTP requests, by route, method and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+	}
+	m.registry.MustRegister(m.requests, m.requestDuration)
+	return m
+}
+
+// Record a handled request
+func (m *apiMetrics) observeRequest(route, method string, status int, duration time.Duration) {
+	labels := prometheus.Labels{"route": route, "method": method, "status": strconv.Itoa(status)}
+	m.requests.With(labels).Inc()
+	m.requestDuration.With(labels).Observe(duration.Seconds())
+}
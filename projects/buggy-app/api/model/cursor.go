@@ -0,0 +1,93 @@
+package model
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Notes are paginated with "keyset" (or "seek") pagination: instead of an OFFSET, which
+// gets slower the further through the list you go, the cursor remembers the sort value and ID
+// of the last note on the page. The next page is everything strictly after that pair.
+//
+// Cursors are opaque to API clients. Under the hood they are base64-encoded JSON, but that
+// is an implementation detail that may change.
+
+// NoteSort is the order in which a list of notes is returned
+type NoteSort string
+
+const (
+	SortCreatedAsc   NoteSort = "created"
+	SortCreatedDesc  NoteSort = "-created"
+	SortModifiedAsc  NoteSort = "modified"
+	SortModifiedDesc NoteSort = "-modified"
+)
+
+// DefaultSort is used when no sort order is supplied: newest notes first
+const DefaultSort = SortCreatedDesc
+
+// ErrInvalidCursor is returned when a cursor can't be decoded, or was generated for a
+// different sort order than the one requested.
+var ErrInvalidCursor = errors.New("model: invalid cursor")
+
+// ErrInvalidSort is returned when the sort order is not one of the known NoteSort values
+var ErrInvalidSort = errors.New("model: invalid sort")
+
+// Parse a sort order from user input. An empty string gives the DefaultSort.
+func ParseNoteSort(s string) (NoteSort, error) {
+	switch sort := NoteSort(s); sort {
+	case "":
+		return DefaultSort, nil
+	case SortCreatedAsc, SortCreatedDesc, SortModifiedAsc, SortModifiedDesc:
+		return sort, nil
+	}
+	return "", ErrInvalidSort
+}
+
+// The column to sort by. This is safe to interpolate into SQL because it can only be one of
+// two fixed values.
+func (s NoteSort) column() string {
+	if s == SortModifiedAsc || s == SortModifiedDesc {
+		return "modified"
+	}
+	return "created"
+}
+
+func (s NoteSort) descending() bool {
+	return s == SortCreatedDesc || s == SortModifiedDesc
+}
+
+// What is stored inside a cursor
+type cursor struct {
+	Sort NoteSort  `json:"s"`
+	Time time.Time `json:"t"`
+	Id   string    `json:"i"`
+}
+
+// Build the cursor that points just past this note in the given sort order
+func encodeCursor(sort NoteSort, note Note) string {
+	c := cursor{Sort: sort, Id: note.Id, Time: note.Created}
+	if sort.column() == "modified" {
+		c.Time = note.Modified
+	}
+	// Marshalling a struct of strings and a time can't fail
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(sort NoteSort, s string) (cursor, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	if c.Sort != sort || c.Id == "" {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
@@ -4,11 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"regexp"
-	"strings"
 	"time"
 
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/logctx"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
 type Note struct {
@@ -18,70 +18,409 @@ type Note struct {
 	Created  time.Time `json:"created"`
 	Modified time.Time `json:"modified"`
 	Tags     []string  `json:"tags"`
+	// How the note was shared with the user reading it. Empty if the user owns it.
+	Permission Permission `json:"permission,omitempty"`
+	// When the note was moved to the trash. Only set on notes read from the trash.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 type Notes []Note
 
+// ErrNoteNotFound is returned when a note does not exist, or is not owned by the
+// user asking for it. The two cases are deliberately indistinguishable to callers.
+var ErrNoteNotFound = errors.New("model: note not found")
+
+// ErrNoteModified is returned by conditional writes when the note exists, but its current
+// state doesn't satisfy the condition -- usually because someone else has changed it.
+var ErrNoteModified = errors.New("model: note has been modified")
+
+// A NoteCondition is checked against the current state of a note before a conditional write
+type NoteCondition func(Note) bool
+
 type dbConn interface {
 	Query(ctx context.Context, sql string, optionsAndArgs ...interface{}) (pgx.Rows, error)
 	QueryRow(context.Context, string, ...interface{}) pgx.Row
+	Exec(context.Context, string, ...interface{}) (pgconn.CommandTag, error)
+	Begin(context.Context) (pgx.Tx, error)
+}
+
+// Run fn inside a transaction, committing if it returns nil and rolling back if not.
+// pgx.Tx is itself a dbConn, so fn can call other model functions with it.
+func inTx(ctx context.Context, conn dbConn, fn func(tx pgx.Tx) error) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("model: could not begin transaction: %w", err)
+	}
+	if err := fn(tx); err != nil {
+		if rbErr := tx.Rollback(ctx); rbErr != nil {
+			logctx.FromContext(ctx).Warn("model: could not roll back transaction", "error", rbErr)
+		}
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("model: could not commit transaction: %w", err)
+	}
+	return nil
+}
+
+// Limits on the number of notes returned in a single page
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+)
+
+// ListOptions control which page of notes is returned, and in what order
+type ListOptions struct {
+	// Maximum number of notes to return. Zero means DefaultPageSize.
+	Limit int
+	// Cursor returned from a previous call, or empty for the first page
+	Cursor string
+	// Order of the notes. Empty means DefaultSort.
+	Sort NoteSort
+	// Only return notes with these tags, combined according to TagMode
+	Tags []string
+	// How to combine Tags. Empty means TagModeAll.
+	TagMode TagMode
 }
 
-func GetNotesForOwner(ctx context.Context, conn dbConn, owner string) (Notes, error) {
+// Which notes a list query covers
+type noteScope struct {
+	// FROM clause, which must include public.note
+	from string
+	// Column that must equal the user ID
+	column string
+	// Whether the FROM clause includes public.note_share, so each note has a permission
+	shared bool
+	// Whether to list notes in the trash rather than live notes
+	trash bool
+	// For the trash, only list notes deleted less than this long ago
+	retention time.Duration
+}
+
+var (
+	ownedScope  = noteScope{from: "public.note", column: "owner"}
+	sharedScope = noteScope{from: "public.note JOIN public.note_share ON note_id = id", column: "user_id", shared: true}
+)
+
+// Get a page of notes owned by owner. The second return value is the cursor for the next
+// page, which is empty if there are no more notes.
+func GetNotesForOwner(ctx context.Context, conn dbConn, owner string, opts ListOptions) (Notes, string, error) {
 	if owner == "" {
-		return nil, errors.New("model: owner not supplied")
+		return nil, "", errors.New("model: owner not supplied")
+	}
+	return listNotes(ctx, conn, ownedScope, owner, opts)
+}
+
+// Get a page of notes that other users have shared with user. Each note's Permission says
+// what the user is allowed to do with it.
+func GetNotesSharedWith(ctx context.Context, conn dbConn, user string, opts ListOptions) (Notes, string, error) {
+	if user == "" {
+		return nil, "", errors.New("model: user not supplied")
+	}
+	return listNotes(ctx, conn, sharedScope, user, opts)
+}
+
+func listNotes(ctx context.Context, conn dbConn, scope noteScope, user string, opts ListOptions) (Notes, string, error) {
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	sort := opts.Sort
+	if sort == "" {
+		sort = DefaultSort
+	}
+
+	// Sorting by ID as well as the timestamp makes the order stable when two notes share
+	// a timestamp, which in turn makes the cursor unambiguous.
+	col, cmp, dir := sort.column(), ">", "ASC"
+	if sort.descending() {
+		cmp, dir = "<", "DESC"
+	}
+
+	// arg adds a query argument and gives back its $n placeholder
+	args := []interface{}{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	cols := "id, owner, content, created, modified"
+	if scope.shared {
+		cols += ", permission"
+	}
+	if scope.trash {
+		cols += ", deleted_at"
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = %s", cols, scope.from, scope.column, arg(user))
+	if scope.trash {
+		query += " AND deleted_at > now() - " + arg(scope.retention) + "::interval"
+	} else {
+		query += " AND deleted_at IS NULL"
 	}
+	if opts.Cursor != "" {
+		c, err := decodeCursor(sort, opts.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		query += fmt.Sprintf(" AND (%s, id) %s (%s, %s)", col, cmp, arg(c.Time), arg(c.Id))
+	}
+	if tags := uniqueTags(opts.Tags); len(tags) > 0 {
+		// A tag filter matches the tag itself and everything below it in the hierarchy,
+		// so ?tag=work matches #work and #work/projectA
+		switch opts.TagMode {
+		case TagModeAll, "":
+			for _, tag := range tags {
+				query += fmt.Sprintf(
+					" AND id IN (SELECT note_id FROM public.note_tag WHERE tag = %s OR tag LIKE %s)",
+					arg(tag), arg(descendantPattern(tag)),
+				)
+			}
+		case TagModeAny:
+			patterns := make([]string, len(tags))
+			for i, tag := range tags {
+				patterns[i] = descendantPattern(tag)
+			}
+			query += fmt.Sprintf(
+				" AND id IN (SELECT note_id FROM public.note_tag WHERE tag = ANY(%s) OR tag LIKE ANY(%s))",
+				arg(tags), arg(patterns),
+			)
+		default:
+			return nil, "", ErrInvalidTagMode
+		}
+	}
+
+	// Ask for one more than we need so that we know whether there's another page
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT %d", col, dir, dir, limit+1)
 
-	queryRows, err := conn.Query(ctx, "SELECT id, owner, content, created, modified FROM public.note")
+	queryRows, err := conn.Query(ctx, query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("model: could not query notes: %w", err)
+		return nil, "", fmt.Errorf("model: could not query notes: %w", err)
 	}
 	defer queryRows.Close()
 
 	notes := []Note{}
 	for queryRows.Next() {
 		note := Note{}
-		err = queryRows.Scan(&note.Id, &note.Owner, &note.Content, &note.Created, &note.Modified)
-		if err != nil {
-			return nil, fmt.Errorf("model: query scan failed: %w", err)
+		dest := []interface{}{&note.Id, &note.Owner, &note.Content, &note.Created, &note.Modified}
+		if scope.shared {
+			dest = append(dest, &note.Permission)
 		}
-		if note.Owner == owner {
-			note.Tags = extractTags(note.Content)
-			notes = append(notes, note)
+		if scope.trash {
+			dest = append(dest, &note.DeletedAt)
 		}
+		err = queryRows.Scan(dest...)
+		if err != nil {
+			return nil, "", fmt.Errorf("model: query scan failed: %w", err)
+		}
+		note.Tags = extractTags(note.Content)
+		notes = append(notes, note)
 	}
 
 	if queryRows.Err() != nil {
-		return nil, fmt.Errorf("model: query read failed: %w", queryRows.Err())
+		return nil, "", fmt.Errorf("model: query read failed: %w", queryRows.Err())
+	}
+
+	next := ""
+	if len(notes) > limit {
+		notes = notes[:limit]
+		next = encodeCursor(sort, notes[limit-1])
 	}
 
-	return notes, nil
+	return notes, next, nil
 }
 
-func GetNoteById(ctx context.Context, conn dbConn, id string) (Note, error) {
+// Get the note with this id, as long as user owns it or it has been shared with them.
+func GetNoteById(ctx context.Context, conn dbConn, user, id string) (Note, error) {
 	var note Note
+	if user == "" {
+		return note, errors.New("model: user not supplied")
+	}
 	if id == "" {
 		return note, errors.New("model: id not supplied")
 	}
 
-	row := conn.QueryRow(ctx, "SELECT id, owner, content, created, modified FROM public.note WHERE id = $1", id)
+	row := conn.QueryRow(ctx,
+		"SELECT id, owner, content, created, modified, coalesce(s.permission, '') FROM public.note "+
+			"LEFT JOIN public.note_share s ON s.note_id = id AND s.user_id = $2 "+
+			"WHERE id = $1 AND deleted_at IS NULL AND "+canAccess("$2", PermissionRead),
+		id, user,
+	)
 
-	err := row.Scan(&note.Id, &note.Owner, &note.Content, &note.Created, &note.Modified)
+	err := row.Scan(&note.Id, &note.Owner, &note.Content, &note.Created, &note.Modified, &note.Permission)
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return note, ErrNoteNotFound
+		}
 		return note, fmt.Errorf("model: query scan failed: %w", err)
 	}
 	note.Tags = extractTags(note.Content)
 	return note, nil
 }
 
-// Extract tags from the note. We're looking for #something. There could be
-// multiple tags, so we FindAll.
-func extractTags(input string) []string {
-	re := regexp.MustCompile(`#([^#]+)`)
-	matches := re.FindAllStringSubmatch(input, -1)
-	tags := make([]string, 0, len(matches))
-	for _, f := range matches {
-		tags = append(tags, strings.TrimSpace(f[1]))
+// Create a new note for owner with the supplied content. The database generates
+// the ID and timestamps, so the returned Note is read back from the INSERT.
+func CreateNote(ctx context.Context, conn dbConn, owner, content string) (Note, error) {
+	var note Note
+	if owner == "" {
+		return note, errors.New("model: owner not supplied")
+	}
+
+	err := inTx(ctx, conn, func(tx pgx.Tx) error {
+		row := tx.QueryRow(ctx,
+			"INSERT INTO public.note (owner, content) VALUES ($1, $2) RETURNING id, owner, content, created, modified",
+			owner, content,
+		)
+
+		err := row.Scan(&note.Id, &note.Owner, &note.Content, &note.Created, &note.Modified)
+		if err != nil {
+			return fmt.Errorf("model: insert scan failed: %w", err)
+		}
+		note.Tags = extractTags(note.Content)
+		if err := setNoteTags(ctx, tx, note.Id, note.Tags); err != nil {
+			return err
+		}
+		return addRevision(ctx, tx, note.Id, owner, note.Content)
+	})
+	return note, err
+}
+
+// Replace the content of the note with this id. The access check is part of the WHERE
+// clause so that a user can never modify a note they do not own, unless it has been shared
+// with them with write permission.
+func UpdateNote(ctx context.Context, conn dbConn, user, id, content string) (Note, error) {
+	return UpdateNoteIf(ctx, conn, user, id, content, nil)
+}
+
+// Like UpdateNote, but only writes the note if cond returns true for its current state, and
+// otherwise returns ErrNoteModified. The note is locked between the check and the write, so
+// nobody else can change it in between. A nil cond always passes.
+func UpdateNoteIf(ctx context.Context, conn dbConn, user, id, content string, cond NoteCondition) (Note, error) {
+	var note Note
+	if user == "" {
+		return note, errors.New("model: user not supplied")
+	}
+	if id == "" {
+		return note, errors.New("model: id not supplied")
+	}
+
+	err := inTx(ctx, conn, func(tx pgx.Tx) error {
+		if cond != nil {
+			if err := checkNote(ctx, tx, id, user, canAccess("$2", PermissionWrite), cond); err != nil {
+				return err
+			}
+		}
+		var err error
+		note, err = updateNote(ctx, tx, user, id, content)
+		return err
+	})
+	return note, err
+}
+
+// Lock the note with this id, and check cond against its current state. access is an SQL
+// condition on the user ID in $2, which decides whether user can see the note at all.
+func checkNote(ctx context.Context, tx pgx.Tx, id, user, access string, cond NoteCondition) error {
+	var note Note
+	err := tx.QueryRow(ctx,
+		"SELECT id, owner, content, created, modified FROM public.note "+
+			"WHERE id = $1 AND deleted_at IS NULL AND "+access+" FOR UPDATE",
+		id, user,
+	).Scan(&note.Id, &note.Owner, &note.Content, &note.Created, &note.Modified)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrNoteNotFound
+		}
+		return fmt.Errorf("model: query scan failed: %w", err)
+	}
+	note.Tags = extractTags(note.Content)
+	// Writes need write access, which anyone but the owner has from a share. The condition sees
+	// the note as the user reads it, as it would for updateNote.
+	if note.Owner != user {
+		note.Permission = PermissionWrite
+	}
+	if !cond(note) {
+		return ErrNoteModified
+	}
+	return nil
+}
+
+// The body of UpdateNote, which must be run inside a transaction. As well as the note,
+// this writes its tags and a new revision.
+func updateNote(ctx context.Context, tx pgx.Tx, user, id, content string) (Note, error) {
+	var note Note
+	row := tx.QueryRow(ctx,
+		"UPDATE public.note SET content = $1 WHERE id = $2 AND deleted_at IS NULL AND "+canAccess("$3", PermissionWrite)+
+			" RETURNING id, owner, content, created, modified",
+		content, id, user,
+	)
+
+	err := row.Scan(&note.Id, &note.Owner, &note.Content, &note.Created, &note.Modified)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return note, ErrNoteNotFound
+		}
+		return note, fmt.Errorf("model: update scan failed: %w", err)
+	}
+	if note.Owner != user {
+		note.Permission = PermissionWrite
+	}
+	note.Tags = extractTags(note.Content)
+	if err := setNoteTags(ctx, tx, note.Id, note.Tags); err != nil {
+		return note, err
+	}
+	return note, addRevision(ctx, tx, note.Id, user, note.Content)
+}
+
+// Move the note with this id to the trash, as long as it is owned by owner. Shares never
+// allow another user to delete a note. Notes in the trash can be restored with RestoreNote
+// until they are purged.
+func DeleteNote(ctx context.Context, conn dbConn, owner, id string) error {
+	if owner == "" {
+		return errors.New("model: owner not supplied")
+	}
+	if id == "" {
+		return errors.New("model: id not supplied")
+	}
+
+	return deleteNote(ctx, conn, owner, id)
+}
+
+// Like DeleteNote, but only moves the note to the trash if cond returns true for its current
+// state, and otherwise returns ErrNoteModified. A nil cond always passes.
+func DeleteNoteIf(ctx context.Context, conn dbConn, owner, id string, cond NoteCondition) error {
+	if cond == nil {
+		return DeleteNote(ctx, conn, owner, id)
+	}
+	if owner == "" {
+		return errors.New("model: owner not supplied")
+	}
+	if id == "" {
+		return errors.New("model: id not supplied")
+	}
+
+	return inTx(ctx, conn, func(tx pgx.Tx) error {
+		if err := checkNote(ctx, tx, id, owner, "owner = $2", cond); err != nil {
+			return err
+		}
+		return deleteNote(ctx, tx, owner, id)
+	})
+}
+
+func deleteNote(ctx context.Context, conn dbConn, owner, id string) error {
+	// RETURNING lets us tell the difference between "deleted" and "nothing to delete".
+	// Tags, shares and revisions are kept, so that restoring the note brings them back.
+	var deleted string
+	err := conn.QueryRow(ctx,
+		"UPDATE public.note SET deleted_at = now() WHERE id = $1 AND owner = $2 AND deleted_at IS NULL RETURNING id",
+		id, owner,
+	).Scan(&deleted)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrNoteNotFound
+		}
+		return fmt.Errorf("model: delete failed: %w", err)
 	}
-	return tags
+	return nil
 }
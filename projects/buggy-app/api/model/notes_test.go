@@ -1,8 +1,10 @@
 package model
 
 import (
+	"errors"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestTags(t *testing.T) {
@@ -26,3 +28,91 @@ func TestTagsTrim(t *testing.T) {
 		t.Fatalf("expected %v, got %v", expected, tags)
 	}
 }
+
+func TestCursorRoundTrip(t *testing.T) {
+	note := Note{Id: "abc123", Created: time.Date(2022, 10, 16, 9, 0, 0, 123456000, time.UTC)}
+
+	c, err := decodeCursor(SortCreatedDesc, encodeCursor(SortCreatedDesc, note))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Id != note.Id || !c.Time.Equal(note.Created) {
+		t.Fatalf("expected cursor for %v at %v, got %v", note.Id, note.Created, c)
+	}
+}
+
+func TestCursorSortMismatch(t *testing.T) {
+	note := Note{Id: "abc123", Created: time.Now()}
+
+	_, err := decodeCursor(SortModifiedAsc, encodeCursor(SortCreatedDesc, note))
+	if !errors.Is(err, ErrInvalidCursor) {
+		t.Fatalf("expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func TestUniqueTags(t *testing.T) {
+	tags := []string{"work", "", "home", "work"}
+	expected := []string{"work", "home"}
+
+	unique := uniqueTags(tags)
+
+	if !reflect.DeepEqual(expected, unique) {
+		t.Fatalf("expected %v, got %v", expected, unique)
+	}
+}
+
+func TestTagsHierarchical(t *testing.T) {
+	text := "Agenda for #work/projectA/meeting and #work/projectB, #self-care."
+	expected := []string{"work/projectA/meeting", "work/projectB", "self-care"}
+
+	tags := extractTags(text)
+
+	if !reflect.DeepEqual(expected, tags) {
+		t.Fatalf("expected %v, got %v", expected, tags)
+	}
+}
+
+func TestTagsEndAtWord(t *testing.T) {
+	text := "#Monday Remember to take time for self-care"
+	expected := []string{"Monday"}
+
+	tags := extractTags(text)
+
+	if !reflect.DeepEqual(expected, tags) {
+		t.Fatalf("expected %v, got %v", expected, tags)
+	}
+}
+
+func TestTagsNotInWords(t *testing.T) {
+	text := "Learning C# from example.com/#intro, it&#39;s #good/"
+	expected := []string{"good"}
+
+	tags := extractTags(text)
+
+	if !reflect.DeepEqual(expected, tags) {
+		t.Fatalf("expected %v, got %v", expected, tags)
+	}
+}
+
+func TestValidTag(t *testing.T) {
+	for tag, valid := range map[string]bool{
+		"work":          true,
+		"work/projectA": true,
+		"self-care":     true,
+		"":              false,
+		"work/":         false,
+		"/work":         false,
+		"work projectA": false,
+	} {
+		if ValidTag(tag) != valid {
+			t.Errorf("ValidTag(%q): expected %v", tag, valid)
+		}
+	}
+}
+
+func TestDescendantPattern(t *testing.T) {
+	expected := `snake\_case/%`
+	if p := descendantPattern("snake_case"); p != expected {
+		t.Fatalf("expected %s, got %s", expected, p)
+	}
+}
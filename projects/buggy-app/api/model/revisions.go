@@ -0,0 +1,137 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Every write to a note's content is recorded in public.note_revision, so previous versions
+// can be viewed and restored. Revisions are numbered from 1 for each note: revision 1 is the
+// content the note was created with, and the highest revision is always the current content.
+//
+// Restoring a revision doesn't rewrite history: it writes the old content as a new revision.
+
+// A version of a note's content
+type Revision struct {
+	NoteId   string `json:"note_id"`
+	Revision int    `json:"revision"`
+	Content  string `json:"content"`
+	// The user that wrote this version. Empty if that user has since been deleted.
+	Author  string    `json:"author"`
+	Created time.Time `json:"created"`
+}
+
+// ErrRevisionNotFound is returned when a note exists and is readable, but doesn't have the
+// requested revision
+var ErrRevisionNotFound = errors.New("model: revision not found")
+
+// Record content as the next revision of a note. This must run in the same transaction as
+// the write to the note: the UPDATE holds a lock on the note row, so two writers can't both
+// pick the same revision number.
+func addRevision(ctx context.Context, conn dbConn, noteId, author, content string) error {
+	_, err := conn.Exec(ctx,
+		"INSERT INTO public.note_revision (note_id, revision, content, author) "+
+			"SELECT $1, coalesce(max(revision), 0) + 1, $2, $3 FROM public.note_revision WHERE note_id = $1",
+		noteId, content, author,
+	)
+	if err != nil {
+		return fmt.Errorf("model: could not insert revision: %w", err)
+	}
+	return nil
+}
+
+// Get every revision of the note with this id, newest first, as long as user can read it.
+func GetRevisionsForNote(ctx context.Context, conn dbConn, user, id string) ([]Revision, error) {
+	if user == "" {
+		return nil, errors.New("model: user not supplied")
+	}
+	if id == "" {
+		return nil, errors.New("model: id not supplied")
+	}
+
+	queryRows, err := conn.Query(ctx,
+		"SELECT r.note_id, r.revision, r.content, coalesce(r.author, ''), r.created "+
+			"FROM public.note_revision r JOIN public.note ON note.id = r.note_id "+
+			"WHERE r.note_id = $1 AND note.deleted_at IS NULL AND "+canAccess("$2", PermissionRead)+" ORDER BY r.revision DESC",
+		id, user,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("model: could not query revisions: %w", err)
+	}
+	defer queryRows.Close()
+
+	revisions := []Revision{}
+	for queryRows.Next() {
+		rev := Revision{}
+		err = queryRows.Scan(&rev.NoteId, &rev.Revision, &rev.Content, &rev.Author, &rev.Created)
+		if err != nil {
+			return nil, fmt.Errorf("model: query scan failed: %w", err)
+		}
+		revisions = append(revisions, rev)
+	}
+
+	if queryRows.Err() != nil {
+		return nil, fmt.Errorf("model: query read failed: %w", queryRows.Err())
+	}
+
+	// Every note has at least one revision, so none means the note isn't there for this user
+	if len(revisions) == 0 {
+		return nil, ErrNoteNotFound
+	}
+	return revisions, nil
+}
+
+// Get a single revision of the note with this id, as long as user can read it.
+func GetRevision(ctx context.Context, conn dbConn, user, id string, revision int) (Revision, error) {
+	return getRevision(ctx, conn, user, id, revision, PermissionRead)
+}
+
+func getRevision(ctx context.Context, conn dbConn, user, id string, revision int, permission Permission) (Revision, error) {
+	var rev Revision
+	if user == "" {
+		return rev, errors.New("model: user not supplied")
+	}
+	if id == "" {
+		return rev, errors.New("model: id not supplied")
+	}
+
+	// The LEFT JOIN means we get a row whenever the note is accessible, so we can tell the
+	// difference between a missing note and a missing revision
+	var found *int
+	err := conn.QueryRow(ctx,
+		"SELECT note.id, r.revision, coalesce(r.content, ''), coalesce(r.author, ''), coalesce(r.created, note.created) "+
+			"FROM public.note LEFT JOIN public.note_revision r ON r.note_id = note.id AND r.revision = $3 "+
+			"WHERE note.id = $1 AND note.deleted_at IS NULL AND "+canAccess("$2", permission),
+		id, user, revision,
+	).Scan(&rev.NoteId, &found, &rev.Content, &rev.Author, &rev.Created)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return rev, ErrNoteNotFound
+		}
+		return rev, fmt.Errorf("model: query scan failed: %w", err)
+	}
+	if found == nil {
+		return rev, ErrRevisionNotFound
+	}
+	rev.Revision = *found
+	return rev, nil
+}
+
+// Make an old revision the current content of the note with this id. This needs write
+// access, and adds a new revision rather than removing the ones after it.
+func RestoreRevision(ctx context.Context, conn dbConn, user, id string, revision int) (Note, error) {
+	var note Note
+	err := inTx(ctx, conn, func(tx pgx.Tx) error {
+		rev, err := getRevision(ctx, tx, user, id, revision, PermissionWrite)
+		if err != nil {
+			return err
+		}
+		note, err = updateNote(ctx, tx, user, id, rev.Content)
+		return err
+	})
+	return note, err
+}
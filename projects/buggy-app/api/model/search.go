@@ -0,0 +1,110 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+)
+
+// A note that matched a search, with how well it matched and a highlighted extract
+type NoteSearchResult struct {
+	Note
+	// Relevance of the note to the query, as computed by ts_rank. Higher is better.
+	Rank float32 `json:"rank"`
+	// Extract of the content, HTML-escaped, with matching words wrapped in <mark></mark>
+	Snippet string `json:"snippet"`
+}
+
+// ts_headline doesn't escape the content around the matches, so it marks them with Unicode
+// noncharacters, and highlight swaps them for <mark></mark> once the rest has been escaped.
+// Text shouldn't contain noncharacters, but nothing stops a note from having them, so they're
+// taken out of the content before ts_headline sees it.
+const (
+	snippetStart = "\uFDD0"
+	snippetStop  = "\uFDD1"
+)
+
+// Options passed to ts_headline to build snippets
+const headlineOptions = `StartSel="` + snippetStart + `", StopSel="` + snippetStop + `", MaxFragments=2, MaxWords=20, MinWords=5`
+
+// Turn a headline from ts_headline into a snippet that's safe to use as HTML: everything is
+// escaped apart from the <mark></mark> around matches. Markers that don't pair up are dropped,
+// so the snippet can't leave a <mark> open or close one it didn't open.
+func highlight(headline string) string {
+	var b strings.Builder
+	marked := false
+	for {
+		i := strings.IndexAny(headline, snippetStart+snippetStop)
+		if i < 0 {
+			b.WriteString(html.EscapeString(headline))
+			break
+		}
+		b.WriteString(html.EscapeString(headline[:i]))
+		marker := headline[i : i+len(snippetStart)]
+		switch {
+		case marker == snippetStart && !marked:
+			b.WriteString("<mark>")
+			marked = true
+		case marker == snippetStop && marked:
+			b.WriteString("</mark>")
+			marked = false
+		}
+		headline = headline[i+len(marker):]
+	}
+	if marked {
+		b.WriteString("</mark>")
+	}
+	return b.String()
+}
+
+// Search the notes owned by owner for query, best matches first.
+//
+// The query is parsed with websearch_to_tsquery, so it supports the syntax people expect
+// from search engines: "quoted phrases", OR, and -excluded words. It never fails to parse.
+func SearchNotesForOwner(ctx context.Context, conn dbConn, owner, query string, limit int) ([]NoteSearchResult, error) {
+	if owner == "" {
+		return nil, errors.New("model: owner not supplied")
+	}
+	if query == "" {
+		return nil, errors.New("model: query not supplied")
+	}
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	queryRows, err := conn.Query(ctx,
+		"SELECT id, owner, content, created, modified, ts_rank(search, q) AS rank, "+
+			"ts_headline('english', translate(content, $5, ''), q, $3) "+
+			"FROM public.note, websearch_to_tsquery('english', $2) q "+
+			"WHERE owner = $1 AND deleted_at IS NULL AND search @@ q "+
+			"ORDER BY rank DESC, id LIMIT $4",
+		owner, query, headlineOptions, limit, snippetStart+snippetStop,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("model: could not search notes: %w", err)
+	}
+	defer queryRows.Close()
+
+	results := []NoteSearchResult{}
+	for queryRows.Next() {
+		r := NoteSearchResult{}
+		err = queryRows.Scan(&r.Id, &r.Owner, &r.Content, &r.Created, &r.Modified, &r.Rank, &r.Snippet)
+		if err != nil {
+			return nil, fmt.Errorf("model: query scan failed: %w", err)
+		}
+		r.Snippet = highlight(r.Snippet)
+		r.Tags = extractTags(r.Content)
+		results = append(results, r)
+	}
+
+	if queryRows.Err() != nil {
+		return nil, fmt.Errorf("model: query read failed: %w", queryRows.Err())
+	}
+
+	return results, nil
+}
@@ -0,0 +1,20 @@
+package model
+
+import "testing"
+
+func TestHighlight(t *testing.T) {
+	cases := []struct {
+		headline, snippet string
+	}{
+		{"Buy \uFDD0bananas\uFDD1 <b>now</b>", "Buy <mark>bananas</mark> &lt;b&gt;now&lt;/b&gt;"},
+		// Markers in the note itself are taken out before ts_headline, but if any get through
+		// they can't unbalance the markup
+		{"\uFDD1Buy \uFDD0\uFDD0bananas\uFDD1\uFDD1", "Buy <mark>bananas</mark>"},
+		{"Buy \uFDD0bananas", "Buy <mark>bananas</mark>"},
+	}
+	for _, c := range cases {
+		if snippet := highlight(c.headline); snippet != c.snippet {
+			t.Fatalf("%q: expected %q, got %q", c.headline, c.snippet, snippet)
+		}
+	}
+}
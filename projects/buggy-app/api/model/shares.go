@@ -0,0 +1,182 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Notes have a single owner, who can share them with other users. A share gives one user
+// read or write access to one note. Only the owner can manage shares or delete the note.
+
+// Permission is the access a share grants
+type Permission string
+
+const (
+	// Read the note
+	PermissionRead Permission = "read"
+	// Read and change the content of the note
+	PermissionWrite Permission = "write"
+)
+
+var (
+	// ErrInvalidPermission is returned when the permission is not one of the known values
+	ErrInvalidPermission = errors.New("model: invalid permission")
+	// ErrShareNotFound is returned when revoking a share that doesn't exist
+	ErrShareNotFound = errors.New("model: share not found")
+	// ErrUserNotFound is returned when sharing with a user that doesn't exist
+	ErrUserNotFound = errors.New("model: user not found")
+	// ErrShareWithOwner is returned when an owner tries to share a note with themselves
+	ErrShareWithOwner = errors.New("model: cannot share a note with its owner")
+)
+
+// Parse a permission from user input
+func ParsePermission(s string) (Permission, error) {
+	switch p := Permission(s); p {
+	case PermissionRead, PermissionWrite:
+		return p, nil
+	}
+	return "", ErrInvalidPermission
+}
+
+// SQL condition that is true when the user in placeholder userArg has at least permission
+// on the note in the current row of public.note. Write access implies read access.
+func canAccess(userArg string, permission Permission) string {
+	shareCond := ""
+	if permission == PermissionWrite {
+		shareCond = " AND note_share.permission = 'write'"
+	}
+	return fmt.Sprintf(
+		"(owner = %[1]s OR EXISTS (SELECT 1 FROM public.note_share WHERE note_share.note_id = note.id AND note_share.user_id = %[1]s%[2]s))",
+		userArg, shareCond,
+	)
+}
+
+// A user that a note is shared with
+type Share struct {
+	NoteId     string     `json:"note_id"`
+	UserId     string     `json:"user_id"`
+	Permission Permission `json:"permission"`
+	Granted    time.Time  `json:"granted"`
+}
+
+// Share the note with this id with user, granting permission. If the note is already shared
+// with user, the permission is replaced.
+func ShareNote(ctx context.Context, conn dbConn, owner, id, user string, permission Permission) (Share, error) {
+	var share Share
+	if owner == "" {
+		return share, errors.New("model: owner not supplied")
+	}
+	if id == "" {
+		return share, errors.New("model: id not supplied")
+	}
+	if user == "" {
+		return share, errors.New("model: user not supplied")
+	}
+	if user == owner {
+		return share, ErrShareWithOwner
+	}
+	if _, err := ParsePermission(string(permission)); err != nil {
+		return share, err
+	}
+
+	// Selecting from public.note means nothing is inserted unless owner owns the note
+	row := conn.QueryRow(ctx,
+		"INSERT INTO public.note_share (note_id, user_id, permission) "+
+			"SELECT id, $3, $4 FROM public.note WHERE id = $1 AND owner = $2 AND deleted_at IS NULL "+
+			"ON CONFLICT (note_id, user_id) DO UPDATE SET permission = EXCLUDED.permission "+
+			"RETURNING note_id, user_id, permission, granted",
+		id, owner, user, permission,
+	)
+
+	err := row.Scan(&share.NoteId, &share.UserId, &share.Permission, &share.Granted)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return share, ErrNoteNotFound
+		}
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+			// foreign_key_violation: the user doesn't exist
+			return share, ErrUserNotFound
+		}
+		return share, fmt.Errorf("model: share scan failed: %w", err)
+	}
+	return share, nil
+}
+
+// Revoke user's access to the note with this id
+func UnshareNote(ctx context.Context, conn dbConn, owner, id, user string) error {
+	if owner == "" {
+		return errors.New("model: owner not supplied")
+	}
+	if id == "" {
+		return errors.New("model: id not supplied")
+	}
+
+	var revoked string
+	err := conn.QueryRow(ctx,
+		"DELETE FROM public.note_share USING public.note "+
+			"WHERE note_share.note_id = note.id AND note.id = $1 AND note.owner = $2 AND note_share.user_id = $3 "+
+			"RETURNING note_share.user_id",
+		id, owner, user,
+	).Scan(&revoked)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrShareNotFound
+		}
+		return fmt.Errorf("model: unshare failed: %w", err)
+	}
+	return nil
+}
+
+// Get everyone the note with this id is shared with. Returns ErrNoteNotFound unless owner
+// owns the note.
+func GetSharesForNote(ctx context.Context, conn dbConn, owner, id string) ([]Share, error) {
+	if owner == "" {
+		return nil, errors.New("model: owner not supplied")
+	}
+	if id == "" {
+		return nil, errors.New("model: id not supplied")
+	}
+
+	var found string
+	err := conn.QueryRow(ctx,
+		"SELECT id FROM public.note WHERE id = $1 AND owner = $2 AND deleted_at IS NULL",
+		id, owner,
+	).Scan(&found)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNoteNotFound
+		}
+		return nil, fmt.Errorf("model: query scan failed: %w", err)
+	}
+
+	queryRows, err := conn.Query(ctx,
+		"SELECT note_id, user_id, permission, granted FROM public.note_share WHERE note_id = $1 ORDER BY granted, user_id",
+		id,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("model: could not query shares: %w", err)
+	}
+	defer queryRows.Close()
+
+	shares := []Share{}
+	for queryRows.Next() {
+		share := Share{}
+		err = queryRows.Scan(&share.NoteId, &share.UserId, &share.Permission, &share.Granted)
+		if err != nil {
+			return nil, fmt.Errorf("model: query scan failed: %w", err)
+		}
+		shares = append(shares, share)
+	}
+
+	if queryRows.Err() != nil {
+		return nil, fmt.Errorf("model: query read failed: %w", queryRows.Err())
+	}
+
+	return shares, nil
+}
@@ -0,0 +1,243 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Tags are extracted from note content (see extractTags) and stored in public.note_tag
+// whenever a note is written, so that they can be counted and used to filter notes.
+//
+// The grammar for a tag is:
+//
+//	tag     = "#" segment { "/" segment }
+//	segment = 1*( letter | digit | "_" | "-" )
+//
+// The # must be at the start of the content or follow a character other than a letter, digit,
+// "_", "&" or "/", so "C#", "&#39;" and "example.com/#anchor" are not tags. The "/"-separated segments form
+// a hierarchy: #work/projectA/meeting is a child of #work/projectA, which is a child of #work.
+
+// Separates the levels of a hierarchical tag
+const TagSeparator = "/"
+
+const tagSegment = `[\p{L}\p{N}_-]+`
+
+var (
+	// Finds tags in content. The tag itself (without the #) is the first submatch.
+	tagPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_&/])#(` + tagSegment + `(?:/` + tagSegment + `)*)`)
+	// Matches a whole string that is a valid tag, without the #
+	validTagPattern = regexp.MustCompile(`^` + tagSegment + `(?:/` + tagSegment + `)*$`)
+)
+
+// Extract tags from the note. We're looking for #something, or #some/thing for
+// hierarchical tags. There could be multiple tags, so we FindAll.
+func extractTags(input string) []string {
+	matches := tagPattern.FindAllStringSubmatch(input, -1)
+	tags := make([]string, 0, len(matches))
+	for _, f := range matches {
+		tags = append(tags, f[1])
+	}
+	return tags
+}
+
+// Check that s is a valid tag according to the grammar, without the leading #
+func ValidTag(s string) bool {
+	return validTagPattern.MatchString(s)
+}
+
+// Escape a string so it matches literally in a LIKE pattern. Tags can contain "_", which
+// LIKE would otherwise treat as a wildcard.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// The LIKE pattern that matches every descendant of tag
+func descendantPattern(tag string) string {
+	return escapeLike(tag+TagSeparator) + "%"
+}
+
+// TagMode controls how multiple tags are combined when filtering notes
+type TagMode string
+
+const (
+	// Notes must have every one of the tags
+	TagModeAll TagMode = "all"
+	// Notes must have at least one of the tags
+	TagModeAny TagMode = "any"
+)
+
+// ErrInvalidTagMode is returned when the tag mode is not one of the known TagMode values
+var ErrInvalidTagMode = errors.New("model: invalid tag mode")
+
+// Parse a tag mode from user input. An empty string gives TagModeAll.
+func ParseTagMode(s string) (TagMode, error) {
+	switch mode := TagMode(s); mode {
+	case "":
+		return TagModeAll, nil
+	case TagModeAll, TagModeAny:
+		return mode, nil
+	}
+	return "", ErrInvalidTagMode
+}
+
+// A tag, and how many of the owner's notes have it
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// Get every tag used on notes owned by owner, with the number of notes for each tag.
+func GetTagsForOwner(ctx context.Context, conn dbConn, owner string) ([]TagCount, error) {
+	if owner == "" {
+		return nil, errors.New("model: owner not supplied")
+	}
+
+	queryRows, err := conn.Query(ctx,
+		"SELECT t.tag, count(*) FROM public.note_tag t JOIN public.note n ON n.id = t.note_id "+
+			"WHERE n.owner = $1 AND n.deleted_at IS NULL GROUP BY t.tag ORDER BY t.tag",
+		owner,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("model: could not query tags: %w", err)
+	}
+	defer queryRows.Close()
+
+	tags := []TagCount{}
+	for queryRows.Next() {
+		tc := TagCount{}
+		err = queryRows.Scan(&tc.Tag, &tc.Count)
+		if err != nil {
+			return nil, fmt.Errorf("model: query scan failed: %w", err)
+		}
+		tags = append(tags, tc)
+	}
+
+	if queryRows.Err() != nil {
+		return nil, fmt.Errorf("model: query read failed: %w", queryRows.Err())
+	}
+
+	return tags, nil
+}
+
+// A node in the hierarchy of tags
+type TagNode struct {
+	// The last segment of the tag, e.g. "meeting" for work/projectA/meeting
+	Name string `json:"name"`
+	// The full tag
+	Tag string `json:"tag"`
+	// Number of notes with exactly this tag
+	Count int `json:"count"`
+	// Number of notes with this tag or any of its descendants. A note is only counted once,
+	// even if it has several matching tags.
+	Total    int        `json:"total"`
+	Children []*TagNode `json:"children"`
+}
+
+// Get the tags used on notes owned by owner as a tree, following the "/" hierarchy. The
+// returned slice holds the top-level tags. Every level is sorted by name.
+//
+// Intermediate levels are included even if no note uses them directly: a note tagged only
+// with #work/projectA still creates a "work" node, with a Count of 0.
+func GetTagTreeForOwner(ctx context.Context, conn dbConn, owner string) ([]*TagNode, error) {
+	if owner == "" {
+		return nil, errors.New("model: owner not supplied")
+	}
+
+	// Each stored tag is expanded into itself and all of its ancestors (the prefixes made of
+	// its first i segments), so that totals can be counted per prefix in a single pass.
+	queryRows, err := conn.Query(ctx,
+		"SELECT p.prefix, count(DISTINCT t.note_id) FILTER (WHERE t.tag = p.prefix), count(DISTINCT t.note_id) "+
+			"FROM public.note_tag t JOIN public.note n ON n.id = t.note_id, "+
+			"LATERAL (SELECT array_to_string((string_to_array(t.tag, '/'))[1:i], '/') AS prefix "+
+			"FROM generate_series(1, array_length(string_to_array(t.tag, '/'), 1)) i) p "+
+			"WHERE n.owner = $1 AND n.deleted_at IS NULL GROUP BY p.prefix",
+		owner,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("model: could not query tags: %w", err)
+	}
+	defer queryRows.Close()
+
+	nodes := map[string]*TagNode{}
+	for queryRows.Next() {
+		node := &TagNode{Children: []*TagNode{}}
+		err = queryRows.Scan(&node.Tag, &node.Count, &node.Total)
+		if err != nil {
+			return nil, fmt.Errorf("model: query scan failed: %w", err)
+		}
+		nodes[node.Tag] = node
+	}
+
+	if queryRows.Err() != nil {
+		return nil, fmt.Errorf("model: query read failed: %w", queryRows.Err())
+	}
+
+	return buildTagTree(nodes), nil
+}
+
+// Link nodes, keyed by their full tag, to their parents and return the roots
+func buildTagTree(nodes map[string]*TagNode) []*TagNode {
+	roots := []*TagNode{}
+	for tag, node := range nodes {
+		parent, name := "", tag
+		if i := strings.LastIndex(tag, TagSeparator); i >= 0 {
+			parent, name = tag[:i], tag[i+1:]
+		}
+		node.Name = name
+		if p, ok := nodes[parent]; ok {
+			p.Children = append(p.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+
+	var sortNodes func([]*TagNode)
+	sortNodes = func(ns []*TagNode) {
+		sort.Slice(ns, func(i, j int) bool { return ns[i].Name < ns[j].Name })
+		for _, n := range ns {
+			sortNodes(n.Children)
+		}
+	}
+	sortNodes(roots)
+	return roots
+}
+
+// Replace the stored tags for a note. This should run in the same transaction as the
+// write to the note itself so the two can't disagree.
+func setNoteTags(ctx context.Context, conn dbConn, noteId string, tags []string) error {
+	_, err := conn.Exec(ctx, "DELETE FROM public.note_tag WHERE note_id = $1", noteId)
+	if err != nil {
+		return fmt.Errorf("model: could not clear tags: %w", err)
+	}
+
+	tags = uniqueTags(tags)
+	if len(tags) == 0 {
+		return nil
+	}
+	_, err = conn.Exec(ctx,
+		"INSERT INTO public.note_tag (note_id, tag) SELECT $1, unnest($2::text[])",
+		noteId, tags,
+	)
+	if err != nil {
+		return fmt.Errorf("model: could not insert tags: %w", err)
+	}
+	return nil
+}
+
+// Remove empty and duplicate tags, keeping the order of first appearance
+func uniqueTags(tags []string) []string {
+	seen := make(map[string]bool, len(tags))
+	unique := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		unique = append(unique, tag)
+	}
+	return unique
+}
@@ -0,0 +1,103 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Deleting a note moves it to the trash by setting public.note.deleted_at, rather than removing
+// the row. Notes in the trash are left out of every other query in this package, as if they had
+// been deleted, but their owner can list them and restore them until the retention period is up.
+// After that they are removed for good by PurgeTrash, which is run by cmd/purge.
+
+// DefaultTrashRetention is how long notes stay in the trash if nothing else is configured
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// Get a page of notes owned by owner that are in the trash and were deleted less than
+// retention ago. The second return value is the cursor for the next page.
+func GetTrashForOwner(ctx context.Context, conn dbConn, owner string, retention time.Duration, opts ListOptions) (Notes, string, error) {
+	if owner == "" {
+		return nil, "", errors.New("model: owner not supplied")
+	}
+	scope := noteScope{from: "public.note", column: "owner", trash: true, retention: trashRetention(retention)}
+	return listNotes(ctx, conn, scope, owner, opts)
+}
+
+// Take the note with this id out of the trash, as long as it is owned by owner and was
+// deleted less than retention ago. Its tags, shares and revisions come back with it.
+func RestoreNote(ctx context.Context, conn dbConn, owner, id string, retention time.Duration) (Note, error) {
+	var note Note
+	if owner == "" {
+		return note, errors.New("model: owner not supplied")
+	}
+	if id == "" {
+		return note, errors.New("model: id not supplied")
+	}
+
+	row := conn.QueryRow(ctx,
+		"UPDATE public.note SET deleted_at = NULL WHERE id = $1 AND owner = $2 AND deleted_at > now() - $3::interval "+
+			"RETURNING id, owner, content, created, modified",
+		id, owner, trashRetention(retention),
+	)
+
+	err := row.Scan(&note.Id, &note.Owner, &note.Content, &note.Created, &note.Modified)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return note, ErrNoteNotFound
+		}
+		return note, fmt.Errorf("model: restore scan failed: %w", err)
+	}
+	note.Tags = extractTags(note.Content)
+	return note, nil
+}
+
+// Permanently delete the note with this id, as long as it is owned by owner and is already
+// in the trash. Tags, shares and revisions are removed by ON DELETE CASCADE.
+func PurgeNote(ctx context.Context, conn dbConn, owner, id string) error {
+	if owner == "" {
+		return errors.New("model: owner not supplied")
+	}
+	if id == "" {
+		return errors.New("model: id not supplied")
+	}
+
+	var purged string
+	err := conn.QueryRow(ctx,
+		"DELETE FROM public.note WHERE id = $1 AND owner = $2 AND deleted_at IS NOT NULL RETURNING id",
+		id, owner,
+	).Scan(&purged)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrNoteNotFound
+		}
+		return fmt.Errorf("model: purge failed: %w", err)
+	}
+	return nil
+}
+
+// Permanently delete every note that was moved to the trash more than retention ago, for
+// all users. Returns the number of notes deleted.
+func PurgeTrash(ctx context.Context, conn dbConn, retention time.Duration) (int64, error) {
+	tag, err := conn.Exec(ctx,
+		"DELETE FROM public.note WHERE deleted_at <= now() - $1::interval",
+		trashRetention(retention),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("model: could not purge trash: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// Notes deleted at or before now() - retention have expired. Zero retention means the default.
+// The cutoff is worked out by the database, which also set deleted_at, so the app's clock and
+// time zone don't come into it.
+func trashRetention(retention time.Duration) time.Duration {
+	if retention <= 0 {
+		return DefaultTrashRetention
+	}
+	return retention
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/authuserctx"
+)
+
+// Routes declare the permission a request needs with a policy, and wrapAuth checks it against the
+// Principal once the user is authenticated:
+//
+//	mux.HandleFunc("/1/my/notes.json", as.wrapAuth(as.authClient, readWrite, as.routeMyNotes))
+//
+// A principal has a permission if one of their roles grants it and, when their credentials are
+// limited to scopes, as API keys are, one of the scopes is the permission too. Ownership of notes
+// is still checked by the handlers: permissions only say what kind of thing a user may do.
+
+// Permission is something a request can need. The notes permissions share their names with
+// API key scopes.
+type Permission string
+
+const (
+	PermNotesRead     Permission = Permission(auth.ScopeNotesRead)
+	PermNotesWrite    Permission = Permission(auth.ScopeNotesWrite)
+	PermApiKeysManage Permission = "api_keys:manage"
+	PermAccountManage Permission = "account:manage"
+)
+
+// Roles, as stored with the user
+const (
+	RoleUser   = auth.RoleUser
+	RoleReader = auth.RoleReader
+)
+
+// What each role allows. Roles that aren't listed allow nothing.
+var rolePermissions = map[string][]Permission{
+	RoleUser:   {PermNotesRead, PermNotesWrite, PermApiKeysManage, PermAccountManage},
+	RoleReader: {PermNotesRead, PermAccountManage},
+}
+
+// A policy says which permission a request needs
+type policy func(r *http.Request) Permission
+
+// A policy for routes that always need the same permission
+func requires(p Permission) policy {
+	return func(*http.Request) Permission { return p }
+}
+
+// The policy for the notes routes: reading needs notes:read, and anything that might change
+// something needs notes:write
+func readWrite(r *http.Request) Permission {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return PermNotesRead
+	}
+	return PermNotesWrite
+}
+
+// Whether the principal has the permission. The second result says whether it was the scopes,
+// rather than the roles, that didn't allow it.
+func allowed(p authuserctx.Principal, perm Permission) (ok bool, byScope bool) {
+	granted := false
+	for _, role := range p.Roles {
+		if slices.Contains(rolePermissions[role], perm) {
+			granted = true
+			break
+		}
+	}
+	if !granted {
+		return false, false
+	}
+	if p.Scopes != nil && !slices.Contains(p.Scopes, string(perm)) {
+		return false, true
+	}
+	return true, false
+}
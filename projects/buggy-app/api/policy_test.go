@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/authuserctx"
+)
+
+func TestPolicyAllowed(t *testing.T) {
+	cases := []struct {
+		principal authuserctx.Principal
+		perm      Permission
+		ok        bool
+		byScope   bool
+	}{
+		{authuserctx.Principal{Roles: []string{RoleUser}}, PermNotesWrite, true, false},
+		{authuserctx.Principal{Roles: []string{RoleUser}}, PermApiKeysManage, true, false},
+		{authuserctx.Principal{Roles: []string{RoleReader}}, PermNotesRead, true, false},
+		{authuserctx.Principal{Roles: []string{RoleReader}}, PermNotesWrite, false, false},
+		{authuserctx.Principal{Roles: []string{RoleReader}}, PermAccountManage, true, false},
+		{authuserctx.Principal{Roles: []string{RoleReader, RoleUser}}, PermNotesWrite, true, false},
+		// No roles, or unknown ones, allow nothing
+		{authuserctx.Principal{}, PermNotesRead, false, false},
+		{authuserctx.Principal{Roles: []string{"superuser"}}, PermNotesRead, false, false},
+		// Scopes limit what the roles allow, but can't add to it
+		{authuserctx.Principal{Roles: []string{RoleUser}, Scopes: []string{"notes:read"}}, PermNotesRead, true, false},
+		{authuserctx.Principal{Roles: []string{RoleUser}, Scopes: []string{"notes:read"}}, PermNotesWrite, false, true},
+		{authuserctx.Principal{Roles: []string{RoleUser}, Scopes: []string{}}, PermNotesRead, false, true},
+		{authuserctx.Principal{Roles: []string{RoleReader}, Scopes: []string{"notes:write"}}, PermNotesWrite, false, false},
+	}
+	for i, c := range cases {
+		ok, byScope := allowed(c.principal, c.perm)
+		if ok != c.ok || byScope != c.byScope {
+			t.Fatalf("case %d: expected allowed %v (by scope %v), got %v (%v)", i, c.ok, c.byScope, ok, byScope)
+		}
+	}
+}
+
+func TestReaderRole(t *testing.T) {
+	as, _, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{RoleReader},
+	})
+
+	// Readers can't write, so the database isn't touched
+	req, err := http.NewRequest("POST", "/1/my/notes.json", strings.NewReader(`{"content": "Hello"}`))
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue("abc123", "password"))
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, res.Code)
+	}
+	var problem Problem
+	if err := json.Unmarshal(res.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem.Code != CodeForbidden {
+		t.Fatalf("expected code %q, got %q", CodeForbidden, problem.Code)
+	}
+}
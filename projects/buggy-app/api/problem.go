@@ -0,0 +1,234 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/password"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/logctx"
+)
+
+// Errors are sent to clients as "problem details" (RFC 7807), with the content type
+// application/problem+json:
+//
+//	{
+//	  "type": "about:blank",
+//	  "title": "Not Found",
+//	  "status": 404,
+//	  "detail": "The note does not exist, or you do not have access to it.",
+//	  "instance": "/1/my/note/abc123.json",
+//	  "code": "note_not_found",
+//	  "request_id": "4bf92f3577b34da6a3ce929d0e0e4736"
+//	}
+//
+// Clients should use code, rather than title or detail, to decide what to do: codes are part of
+// the API and won't change. The detail is written for people and is always safe to show them --
+// the underlying error, which might include SQL or other internals, is logged but never sent.
+//
+// Handlers return errors rather than writing them, so that returning is the only way to respond
+// with an error and a handler can't carry on afterwards. See handlerFunc.
+
+// ErrorCode is a stable, machine-readable identifier for a kind of error
+type ErrorCode string
+
+const (
+	CodeInvalidPath       ErrorCode = "invalid_path"
+	CodeInvalidQuery      ErrorCode = "invalid_query"
+	CodeInvalidBody       ErrorCode = "invalid_body"
+	CodeInvalidCursor     ErrorCode = "invalid_cursor"
+	CodeInvalidPermission ErrorCode = "invalid_permission"
+	CodeInvalidRevision   ErrorCode = "invalid_revision"
+	CodeShareWithOwner    ErrorCode = "share_with_owner"
+	CodeUserNotFound      ErrorCode = "user_not_found"
+	CodeUnauthorized      ErrorCode = "unauthorized"
+	CodeInvalidToken      ErrorCode = "invalid_token"
+	CodeInvalidApiKey     ErrorCode = "invalid_api_key"
+	CodeInsufficientScope ErrorCode = "insufficient_scope"
+	CodeForbidden         ErrorCode = "forbidden"
+	CodeAccountInactive   ErrorCode = "account_inactive"
+	CodeAccountLocked     ErrorCode = "account_locked"
+	CodeAccountUnverified ErrorCode = "account_pending_verification"
+	CodeOtpRequired       ErrorCode = "otp_required"
+	CodeInvalidOtp        ErrorCode = "invalid_otp"
+	CodeTotpEnrolled      ErrorCode = "totp_enrolled"
+	CodeTotpNotEnrolled   ErrorCode = "totp_not_enrolled"
+	CodeWrongPassword     ErrorCode = "wrong_password"
+	CodeInvalidPassword   ErrorCode = "invalid_password"
+	CodeNotFound          ErrorCode = "not_found"
+	CodeNoteNotFound      ErrorCode = "note_not_found"
+	CodeShareNotFound     ErrorCode = "share_not_found"
+	CodeRevisionNotFound  ErrorCode = "revision_not_found"
+	CodeApiKeyNotFound    ErrorCode = "api_key_not_found"
+	CodeMethodNotAllowed  ErrorCode = "method_not_allowed"
+	CodeNoteModified      ErrorCode = "note_modified"
+	CodeRateLimited       ErrorCode = "rate_limited"
+	CodeTooManyAttempts   ErrorCode = "too_many_attempts"
+	CodeInternal          ErrorCode = "internal_error"
+)
+
+// Problem is an error that can be sent to the client as an RFC 7807 problem details object
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	// A human-readable explanation, safe to show to the client
+	Detail string `json:"detail,omitempty"`
+	// The path of the request that caused the problem. Filled in when the problem is written.
+	Instance string    `json:"instance,omitempty"`
+	Code     ErrorCode `json:"code"`
+	// Filled in when the problem is written, so that the client can quote it in bug reports
+	RequestId string `json:"request_id,omitempty"`
+
+	// The underlying error, if any, which is logged but never sent to the client
+	cause error
+}
+
+// Create a Problem with the given status, code and client-safe detail
+func newProblem(status int, code ErrorCode, detail string) *Problem {
+	return &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// Create a 500 Internal Server Error. The cause is logged, and the client only gets a
+// generic message.
+func internalProblem(cause error) *Problem {
+	return newProblem(http.StatusInternalServerError, CodeInternal, "Something went wrong. Please try again later.").withCause(cause)
+}
+
+// A copy of the problem with an underlying error, to be logged when it's written
+func (p *Problem) withCause(cause error) *Problem {
+	c := *p
+	c.cause = cause
+	return &c
+}
+
+func (p *Problem) Error() string {
+	if p.cause != nil {
+		return fmt.Sprintf("%s: %s: %v", p.Code, p.Detail, p.cause)
+	}
+	return fmt.Sprintf("%s: %s", p.Code, p.Detail)
+}
+
+func (p *Problem) Unwrap() error {
+	return p.cause
+}
+
+// Turn an error from the model package into a Problem. op names the model function that
+// failed, for the log if the error is unexpected.
+func modelProblem(op string, err error) *Problem {
+	var p *Problem
+	switch {
+	case errors.Is(err, model.ErrNoteNotFound):
+		p = newProblem(http.StatusNotFound, CodeNoteNotFound, "The note does not exist, or you do not have access to it.")
+	case errors.Is(err, model.ErrShareNotFound):
+		p = newProblem(http.StatusNotFound, CodeShareNotFound, "The note is not shared with that user.")
+	case errors.Is(err, model.ErrRevisionNotFound):
+		p = newProblem(http.StatusNotFound, CodeRevisionNotFound, "The note does not have that revision.")
+	case errors.Is(err, model.ErrUserNotFound):
+		p = newProblem(http.StatusBadRequest, CodeUserNotFound, "The user does not exist.")
+	case errors.Is(err, model.ErrShareWithOwner):
+		p = newProblem(http.StatusBadRequest, CodeShareWithOwner, "A note can't be shared with its owner.")
+	case errors.Is(err, model.ErrInvalidPermission):
+		p = newProblem(http.StatusBadRequest, CodeInvalidPermission, `Permission must be "read" or "write".`)
+	case errors.Is(err, model.ErrInvalidCursor):
+		p = newProblem(http.StatusBadRequest, CodeInvalidCursor, "The cursor is invalid, or was issued for a different sort order.")
+	case errors.Is(err, model.ErrNoteModified):
+		p = newProblem(http.StatusPreconditionFailed, CodeNoteModified, "The note has been changed since you read it. Fetch it again and retry.")
+	default:
+		return internalProblem(fmt.Errorf("%s failed: %w", op, err))
+	}
+	return p.withCause(err)
+}
+
+// Problems for responses that don't depend on the error
+var (
+	errUnauthorized      = newProblem(http.StatusUnauthorized, CodeUnauthorized, "Valid credentials are required.")
+	errInvalidToken      = newProblem(http.StatusUnauthorized, CodeInvalidToken, "The token is invalid or has expired. Refresh it, or log in again.")
+	errInvalidApiKey     = newProblem(http.StatusUnauthorized, CodeInvalidApiKey, "The API key is invalid or has been revoked.")
+	errInsufficientScope = newProblem(http.StatusForbidden, CodeInsufficientScope, "The API key does not have the scope this request needs.")
+	errForbidden         = newProblem(http.StatusForbidden, CodeForbidden, "Your account is not allowed to do this.")
+	errApiKeyNotFound    = newProblem(http.StatusNotFound, CodeApiKeyNotFound, "You have no API key with that ID.")
+	errTooManyAttempts   = newProblem(http.StatusTooManyRequests, CodeTooManyAttempts, "Too many failed attempts to log in. Wait for the number of seconds in the Retry-After header before trying again.")
+	errAccountInactive   = newProblem(http.StatusForbidden, CodeAccountInactive, "This account is not active.")
+	errAccountLocked     = newProblem(http.StatusForbidden, CodeAccountLocked, "This account is locked.")
+	errAccountPending    = newProblem(http.StatusForbidden, CodeAccountUnverified, "This account has not been verified yet.")
+	errOtpNeedsToken     = newProblem(http.StatusUnauthorized, CodeOtpRequired, "This account uses two-factor authentication, which Basic auth can't be used with. Get an access token from /1/auth/token with the password and an otp, and send it as a Bearer token.")
+	errOtpRequired       = newProblem(http.StatusUnauthorized, CodeOtpRequired, "This account uses two-factor authentication. Send a code from your authenticator app, or a recovery code, with the password.")
+	errInvalidOtp        = newProblem(http.StatusUnauthorized, CodeInvalidOtp, "The two-factor code is wrong, or has already been used.")
+	errWrongTotpCode     = newProblem(http.StatusBadRequest, CodeInvalidOtp, "The code is wrong, or has already been used.")
+	errTooManyTotpCodes  = newProblem(http.StatusTooManyRequests, CodeTooManyAttempts, "Too many wrong codes. Wait a minute before trying again.")
+	errTotpEnrolled      = newProblem(http.StatusConflict, CodeTotpEnrolled, "Two-factor authentication is already on. Turn it off before enrolling a new secret.")
+	errTotpNotEnrolled   = newProblem(http.StatusConflict, CodeTotpNotEnrolled, "Two-factor authentication is not on.")
+	errNoTotpToConfirm   = newProblem(http.StatusConflict, CodeTotpNotEnrolled, "There is no new secret to confirm. Enrol one first.")
+	errWrongPassword     = newProblem(http.StatusForbidden, CodeWrongPassword, "The current password is wrong.")
+	errInvalidPassword   = newProblem(http.StatusBadRequest, CodeInvalidPassword, fmt.Sprintf("The new password must be %d to %d bytes long.", password.MinLength, password.MaxLength))
+	errTooManyPasswords  = newProblem(http.StatusTooManyRequests, CodeTooManyAttempts, "Too many wrong passwords. Wait a minute before trying again.")
+	errNotFound          = newProblem(http.StatusNotFound, CodeNotFound, "There is nothing at this path.")
+	errNoAuthContext     = errUnauthorized.withCause(errors.New("route handler reached with invalid auth context"))
+	errMissingIdInPath   = newProblem(http.StatusBadRequest, CodeInvalidPath, "The path must include an ID.")
+	errInvalidRevision   = newProblem(http.StatusBadRequest, CodeInvalidRevision, "The revision must be a positive number.")
+	errMethodNotAllowed  = newProblem(http.StatusMethodNotAllowed, CodeMethodNotAllowed, "The method is not supported at this path.")
+)
+
+// A 405 Method Not Allowed, setting the Allow header to the methods that are supported
+func methodNotAllowed(w http.ResponseWriter, allow string) error {
+	w.Header().Set("Allow", allow)
+	return errMethodNotAllowed
+}
+
+// A handlerFunc is an HTTP handler that returns an error instead of writing it. Wrap it with
+// Service.handle to turn it into an http.HandlerFunc.
+type handlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+// Turn a handlerFunc into an http.HandlerFunc that writes any error it returns
+func (as *Service) handle(h handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := h(w, r); err != nil {
+			as.writeError(w, r, err)
+		}
+	}
+}
+
+// Write err to the client as application/problem+json. Errors that aren't a *Problem are
+// treated as internal errors.
+func (as *Service) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var p *Problem
+	if !errors.As(err, &p) {
+		p = internalProblem(err)
+	}
+
+	// Copy the problem, because some are shared between requests
+	out := *p
+	out.Instance = r.URL.Path
+	out.RequestId = requestIdFromContext(r.Context())
+	logger := logctx.FromContext(r.Context())
+	if out.cause != nil {
+		level := slog.LevelInfo
+		if out.Status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		logger.Log(r.Context(), level, "api: problem", "status", out.Status, "code", out.Code, "error", out.cause)
+	}
+
+	res, err := util.MarshalWithIndent(out, "")
+	if err != nil {
+		// A Problem is only strings and an int, so this really shouldn't happen
+		logger.Error("api: problem marshal failed", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(out.Status)
+	w.Write(res)
+}
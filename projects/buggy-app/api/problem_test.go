@@ -0,0 +1,123 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+)
+
+func TestProblemResponse(t *testing.T) {
+	as, mock, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	id, password := "abc123", "password"
+	noteId := "xyz789"
+
+	mock.ExpectQuery("^SELECT (.+) FROM public.note (.+) WHERE id = \\$1 AND (.+)$").
+		WithArgs(noteId, id).
+		WillReturnRows(mock.NewRows([]string{"id", "owner", "content", "created", "modified", "permission"}))
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("/1/my/note/%s.json", noteId), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+	req.Header.Add("X-Request-ID", "req-123")
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, res.Code)
+	}
+	if ct := res.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Fatalf("expected problem content type, got %q", ct)
+	}
+	if rid := res.Header().Get("X-Request-ID"); rid != "req-123" {
+		t.Fatalf("expected request ID to be echoed, got %q", rid)
+	}
+
+	data := Problem{
+		Type:      "about:blank",
+		Title:     "Not Found",
+		Status:    http.StatusNotFound,
+		Detail:    "The note does not exist, or you do not have access to it.",
+		Instance:  "/1/my/note/xyz789.json",
+		Code:      CodeNoteNotFound,
+		RequestId: "req-123",
+	}
+	assertJSON(res.Body.Bytes(), data, t)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestProblemStopsHandler(t *testing.T) {
+	as, mock, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	// Without an authenticated user in the context, the handler must not touch the database.
+	// Unexpected queries fail ExpectationsWereMet.
+	req, err := http.NewRequest("GET", "/1/my/note/xyz789.json", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+	as.handle(as.handleMyNoteById).ServeHTTP(res, req)
+
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status %d, got %d", http.StatusUnauthorized, res.Code)
+	}
+
+	var problem Problem
+	if err := json.Unmarshal(res.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("expected a problem body: %v", err)
+	}
+	if problem.Code != CodeUnauthorized {
+		t.Fatalf("expected code %q, got %q", CodeUnauthorized, problem.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestProblemMethodNotAllowed(t *testing.T) {
+	as, _, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	req, err := http.NewRequest("PATCH", "/1/my/notes.json", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue("abc123", "password"))
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status %d, got %d", http.StatusMethodNotAllowed, res.Code)
+	}
+	if allow := res.Header().Get("Allow"); allow != "GET, HEAD, POST" {
+		t.Fatalf("expected Allow header, got %q", allow)
+	}
+
+	var problem Problem
+	if err := json.Unmarshal(res.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("expected a problem body: %v", err)
+	}
+	if problem.Code != CodeMethodNotAllowed || problem.RequestId == "" {
+		t.Fatalf("expected code %q with a request ID, got %+v", CodeMethodNotAllowed, problem)
+	}
+}
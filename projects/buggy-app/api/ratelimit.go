@@ -0,0 +1,185 @@
+package api
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Requests are rate limited with token buckets. Each client has a bucket that holds up to Burst
+// tokens and refills at Rate tokens per second. A request takes a token, and is refused with
+// 429 Too Many Requests if the bucket is empty.
+//
+// Authenticated requests are limited per user ID. Requests that fail authentication are limited
+// per client IP, which slows down anyone guessing passwords without letting them use up the
+// allowance of the user they're guessing for. Once a client IP has used up its allowance, its
+// requests are refused before any credentials are checked, so it can't keep the auth service
+// busy hashing passwords, whichever user ids it tries.
+//
+// Responses carry the state of the bucket in headers, following the IETF draft
+// "RateLimit header fields for HTTP":
+//
+//	RateLimit-Limit: 20       -- size of the bucket
+//	RateLimit-Remaining: 19   -- tokens left
+//	RateLimit-Reset: 1        -- seconds until the bucket is full again
+//
+// and refused requests also have Retry-After, the seconds until a token is available.
+
+// RateLimit configures a token bucket
+type RateLimit struct {
+	// Requests per second allowed on average. Zero means there is no limit.
+	Rate float64
+	// Requests that can be made at once, after a quiet period. At least 1.
+	Burst int
+}
+
+// Buckets are dropped once they have been full for this long, to stop the map growing forever
+const rateLimitSweepInterval = time.Minute
+
+type rateLimiter struct {
+	limit RateLimit
+	// The clock, which tests can replace
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// The outcome of checking a bucket
+type rateLimitResult struct {
+	allowed   bool
+	limit     int
+	remaining int
+	// Time until the bucket is full
+	reset time.Duration
+	// Time until a token is available. Zero if one is available now.
+	retryAfter time.Duration
+}
+
+// Create a rate limiter, or return nil if limit has no Rate. A nil *rateLimiter allows
+// everything.
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &rateLimiter{
+		limit:   limit,
+		now:     time.Now,
+		buckets: map[string]*bucket{},
+	}
+}
+
+// Take a token from the bucket for key, if there is one
+func (rl *rateLimiter) take(key string) rateLimitResult {
+	return rl.check(key, true)
+}
+
+// Check whether the bucket for key has a token, without taking it
+func (rl *rateLimiter) peek(key string) rateLimitResult {
+	return rl.check(key, false)
+}
+
+func (rl *rateLimiter) check(key string, consume bool) rateLimitResult {
+	if rl == nil {
+		return rateLimitResult{allowed: true}
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	rl.sweep(now)
+
+	burst := float64(rl.limit.Burst)
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, updated: now}
+	}
+	// Refill for the time since the bucket was last touched
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*rl.limit.Rate)
+	b.updated = now
+
+	res := rateLimitResult{limit: rl.limit.Burst}
+	if b.tokens >= 1 {
+		res.allowed = true
+		if consume {
+			b.tokens--
+		}
+	} else {
+		res.retryAfter = rl.refillTime(1 - b.tokens)
+	}
+	res.remaining = int(b.tokens)
+	res.reset = rl.refillTime(burst - b.tokens)
+
+	if consume || ok {
+		rl.buckets[key] = b
+	}
+	return res
+}
+
+// How long it takes to refill this many tokens
+func (rl *rateLimiter) refillTime(tokens float64) time.Duration {
+	return time.Duration(tokens / rl.limit.Rate * float64(time.Second))
+}
+
+// Drop buckets that would be full by now, which are the same as having no bucket. Must be
+// called with rl.mu held.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	rl.lastSweep = now
+	burst := float64(rl.limit.Burst)
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*rl.limit.Rate >= burst {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// Round a duration up to whole seconds, for headers
+func ceilSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+// Write the rate limit headers. Unlimited results have none.
+func (res rateLimitResult) writeHeaders(w http.ResponseWriter) {
+	if res.limit == 0 {
+		return
+	}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(res.limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.remaining))
+	w.Header().Set("RateLimit-Reset", ceilSeconds(res.reset))
+	if !res.allowed {
+		w.Header().Set("Retry-After", ceilSeconds(res.retryAfter))
+	}
+}
+
+// A 429 Too Many Requests, with the headers that say when to try again
+func tooManyRequests(w http.ResponseWriter, res rateLimitResult) error {
+	res.writeHeaders(w)
+	return newProblem(http.StatusTooManyRequests, CodeRateLimited,
+		"Too many requests. Wait for the number of seconds in the Retry-After header before trying again.")
+}
+
+// The IP address the request came from. X-Forwarded-For is deliberately ignored: it can be set
+// by anyone, and the API isn't deployed behind a proxy that we could trust to set it.
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+)
+
+func TestRateLimitUser(t *testing.T) {
+	config := defaultConfig
+	config.UserRateLimit = RateLimit{Rate: 1, Burst: 1}
+	as, mock, _ := newMockConfigService(t, config, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+	now := time.Now()
+	as.userLimiter.now = func() time.Time { return now }
+
+	id, password := "abc123", "password"
+	request := func() *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/1/my/tags.json", nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+		res := httptest.NewRecorder()
+		as.Handler().ServeHTTP(res, req)
+		return res
+	}
+
+	mock.ExpectQuery("^SELECT t.tag, count\\(\\*\\) (.+)$").
+		WithArgs(id).
+		WillReturnRows(mock.NewRows([]string{"tag", "count"}))
+	res := request()
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, res.Code)
+	}
+	if l, r := res.Header().Get("RateLimit-Limit"), res.Header().Get("RateLimit-Remaining"); l != "1" || r != "0" {
+		t.Fatalf("expected limit 1 with 0 remaining, got %q and %q", l, r)
+	}
+
+	// The bucket is empty, so the next request is refused without touching the database
+	res = request()
+	if res.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %d", http.StatusTooManyRequests, res.Code)
+	}
+	if ra := res.Header().Get("Retry-After"); ra != "1" {
+		t.Fatalf("expected Retry-After of 1 second, got %q", ra)
+	}
+
+	// A second later there's a token again
+	now = now.Add(time.Second)
+	mock.ExpectQuery("^SELECT t.tag, count\\(\\*\\) (.+)$").
+		WithArgs(id).
+		WillReturnRows(mock.NewRows([]string{"tag", "count"}))
+	res = request()
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, res.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRateLimitUnauthenticated(t *testing.T) {
+	config := defaultConfig
+	config.UserRateLimit = RateLimit{Rate: 1, Burst: 5}
+	config.IpRateLimit = RateLimit{Rate: 0.1, Burst: 2}
+	as, _, client := newMockConfigService(t, config, &auth.VerifyResult{
+		State: auth.StateDeny,
+	})
+
+	// A different user each time, which makes no difference to the client's allowance
+	ids := []string{"abc123", "def456", "ghi789"}
+	codes := []int{}
+	for i, id := range ids {
+		req, err := http.NewRequest("GET", "/1/my/notes.json", nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, "wrong"))
+		res := httptest.NewRecorder()
+		as.Handler().ServeHTTP(res, req)
+		codes = append(codes, res.Code)
+
+		if i == 2 {
+			if ra := res.Header().Get("Retry-After"); ra != "10" {
+				t.Fatalf("expected Retry-After of 10 seconds, got %q", ra)
+			}
+		}
+	}
+
+	expected := []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests}
+	if fmt.Sprint(codes) != fmt.Sprint(expected) {
+		t.Fatalf("expected statuses %v, got %v", expected, codes)
+	}
+
+	// Failed attempts don't count against the user they were for
+	if limit := as.userLimiter.peek("abc123"); limit.remaining != 5 {
+		t.Fatalf("expected the user's bucket to be untouched, got %d remaining", limit.remaining)
+	}
+
+	// The refused request never got as far as the auth service
+	if logins, _ := client.ListLoginHistory(context.Background(), "ghi789", 0); len(logins) != 0 {
+		t.Fatalf("expected no verify once the allowance was used up, got %d", len(logins))
+	}
+}
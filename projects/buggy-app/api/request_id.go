@@ -0,0 +1,69 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/logctx"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Every request gets an ID, which is sent back in the X-Request-ID header and included in
+// error responses, so that a problem a user reports can be found in the logs. If the request
+// already has an X-Request-ID (from a load balancer, say) that is used instead.
+
+const requestIdHeader = "X-Request-ID"
+
+// Longest incoming request ID we'll accept. Anything longer is replaced.
+const maxRequestIdLength = 128
+
+type requestIdKey struct{}
+
+// Get the request ID from the context, or "" if there isn't one
+func requestIdFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// Make a new random request ID, like 4bf92f3577b34da6a3ce929d0e0e4736
+func newRequestId() string {
+	b := make([]byte, 16)
+	// crypto/rand doesn't fail on the platforms we run on
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Whether an incoming request ID is safe to log and echo back: short, and printable ASCII
+func validRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLength {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// Middleware that gives every request an ID, in the context and the response headers. The
+// request's logger, in the context, includes the ID in everything it logs, along with the trace
+// ID if the request is being traced.
+func (as *Service) withRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIdHeader)
+		if !validRequestId(id) {
+			id = newRequestId()
+		}
+		w.Header().Set(requestIdHeader, id)
+		ctx := context.WithValue(r.Context(), requestIdKey{}, id)
+		logger := as.logger().With("request_id", id)
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			logger = logger.With("trace_id", sc.TraceID().String())
+		}
+		ctx = logctx.NewContext(ctx, logger)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/logctx"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Every request is logged, and counted in the metrics, once it has been handled, as a structured log line like:
+//
+//	level=INFO msg=request request_id=4bf92f3577b34da6a3ce929d0e0e4736 method=GET
+//	  route=/1/my/notes.json path=/1/my/notes.json status=200 bytes=512 duration=3.1ms user=abc123
+//
+// Handlers, and the model functions they call, should log with logctx.FromContext(ctx), so
+// their lines carry the same request_id (and user, once authenticated) and can be matched up.
+
+// The logger requests are logged with, before any request-scoped fields are added
+func (as *Service) logger() *slog.Logger {
+	if as.config.Log != nil {
+		return as.config.Log
+	}
+	return slog.Default()
+}
+
+// Details about a request that are only known deeper in the handler chain, filled in as it
+// runs so that they can be logged at the end
+type requestInfo struct {
+	user string
+}
+
+type requestInfoKey struct{}
+
+// Record the authenticated user for the request log
+func setRequestUser(ctx context.Context, user string) {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		info.user = user
+	}
+}
+
+// statusRecorder wraps an http.ResponseWriter to remember the status and size of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, to flush or hijack it
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// Middleware that logs and records metrics for every request after it has been handled. It
+// must be inside withRequestId, so that the log line has the request ID.
+func (as *Service) observeRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		duration := time.Since(start)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		as.metrics.observeRequest(r.Pattern, r.Method, rec.status, duration)
+		if r.Pattern != "" {
+			// Name the span after the route, rather than the path, so that spans can be grouped
+			span := trace.SpanFromContext(r.Context())
+			span.SetName(r.Method + " " + r.Pattern)
+			span.SetAttributes(semconv.HTTPRoute(r.Pattern))
+		}
+
+		attrs := []any{
+			slog.String("method", r.Method),
+			// The mux sets the pattern that matched on the request it was given
+			slog.String("route", r.Pattern),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Int("bytes", rec.bytes),
+			slog.Duration("duration", duration),
+		}
+		if info.user != "" {
+			attrs = append(attrs, slog.String("user", info.user))
+		}
+		logctx.FromContext(r.Context()).Info("request", attrs...)
+	})
+}
@@ -0,0 +1,219 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestRequestLog(t *testing.T) {
+	var buf bytes.Buffer
+	config := defaultConfig
+	config.Log = slog.New(slog.NewJSONHandler(&buf, nil))
+	as, mock, _ := newMockConfigService(t, config, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	id, password := "abc123", "password"
+	mock.ExpectQuery("^SELECT t.tag, count\\(\\*\\) (.+)$").
+		WithArgs(id).
+		WillReturnRows(mock.NewRows([]string{"tag", "count"}))
+
+	req, err := http.NewRequest("GET", "/1/my/tags.json", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+	req.Header.Add("X-Request-ID", "req-1")
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, res.Code)
+	}
+	if rid := res.Header().Get("X-Request-ID"); rid != "req-1" {
+		t.Fatalf("expected the request ID to be echoed, got %q", rid)
+	}
+
+	var line struct {
+		Msg       string `json:"msg"`
+		RequestId string `json:"request_id"`
+		Method    string `json:"method"`
+		Route     string `json:"route"`
+		Status    int    `json:"status"`
+		User      string `json:"user"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("expected one JSON log line, got %q: %v", buf.String(), err)
+	}
+	expected := struct {
+		Msg       string `json:"msg"`
+		RequestId string `json:"request_id"`
+		Method    string `json:"method"`
+		Route     string `json:"route"`
+		Status    int    `json:"status"`
+		User      string `json:"user"`
+	}{"request", "req-1", "GET", "/1/my/tags.json", http.StatusOK, id}
+	if line != expected {
+		t.Fatalf("expected log line %+v, got %+v", expected, line)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRequestLogProblem(t *testing.T) {
+	var buf bytes.Buffer
+	config := defaultConfig
+	config.Log = slog.New(slog.NewJSONHandler(&buf, nil))
+	as := New(config)
+
+	req, err := http.NewRequest("GET", "/nothing/here", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	var line struct {
+		RequestId string `json:"request_id"`
+		Status    int    `json:"status"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("expected one JSON log line, got %q: %v", buf.String(), err)
+	}
+	if line.Status != http.StatusNotFound {
+		t.Fatalf("expected status %d to be logged, got %d", http.StatusNotFound, line.Status)
+	}
+	if line.RequestId == "" || line.RequestId != res.Header().Get("X-Request-ID") {
+		t.Fatalf("expected the generated request ID %q to be logged, got %q", res.Header().Get("X-Request-ID"), line.RequestId)
+	}
+}
+
+func TestRequestLogUnwrap(t *testing.T) {
+	as := New(defaultConfig)
+	handler := as.observeRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("expected to be able to flush through the request log, got %v", err)
+		}
+	}))
+
+	req, err := http.NewRequest("GET", "/stream", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if !res.Flushed {
+		t.Fatal("expected the response to be flushed")
+	}
+}
+
+func TestRequestMetrics(t *testing.T) {
+	as, _, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateDeny,
+	})
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", "/1/my/note/abc123.json", nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Header.Add("Authorization", util.BasicAuthHeaderValue("abc123", "wrong"))
+		res := httptest.NewRecorder()
+		as.Handler().ServeHTTP(res, req)
+	}
+
+	// Requests are counted by the route they matched, not their path
+	counter := as.metrics.requests.WithLabelValues("/1/my/note/", "GET", "401")
+	if n := testutil.ToFloat64(counter); n != 2 {
+		t.Fatalf("expected 2 requests counted, got %v", n)
+	}
+
+	res := httptest.NewRecorder()
+	metrics.Handler(as.metrics.registry).ServeHTTP(res, httptest.NewRequest("GET", "/metrics", nil))
+	body := res.Body.String()
+	for _, series := range []string{
+		`api_http_requests_total{method="GET",route="/1/my/note/",status="401"} 2`,
+		`api_http_request_duration_seconds_count{method="GET",route="/1/my/note/",status="401"} 2`,
+	} {
+		if !strings.Contains(body, series) {
+			t.Fatalf("expected /metrics to include %s, got:\n%s", series, body)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTracerProvider(previous)
+
+	as, mock, _ := newMockService(t, &auth.VerifyResult{
+		State: auth.StateAllow,
+		Roles: []string{"user"},
+	})
+
+	id, password := "abc123", "password"
+	mock.ExpectQuery("^SELECT t.tag, count\\(\\*\\) (.+)$").
+		WithArgs(id).
+		WillReturnRows(mock.NewRows([]string{"tag", "count"}))
+
+	req, err := http.NewRequest("GET", "/1/my/tags.json", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Add("Authorization", util.BasicAuthHeaderValue(id, password))
+	// The request is part of a trace started by the caller
+	traceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req.Header.Add("traceparent", "00-"+traceId+"-00f067aa0ba902b7-01")
+	res := httptest.NewRecorder()
+	as.Handler().ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, res.Code)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "GET /1/my/tags.json" {
+		t.Fatalf("expected the span to be named after the route, got %q", span.Name())
+	}
+	if span.SpanContext().TraceID().String() != traceId {
+		t.Fatalf("expected the span to continue trace %s, got %s", traceId, span.SpanContext().TraceID())
+	}
+	var user string
+	for _, attr := range span.Attributes() {
+		if attr.Key == "enduser.id" {
+			user = attr.Value.AsString()
+		}
+	}
+	if user != id {
+		t.Fatalf("expected the span to have enduser.id %q, got %q", id, user)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,239 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	pb "github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/service"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// API keys let scripts authenticate as a user without embedding their password. A user can have
+// several, each with a name and a set of scopes saying what it can be used for, and revoke them
+// one at a time.
+//
+// Keys are random, with a recognisable prefix: bk_<43 characters>. Like refresh tokens, only
+// their sha256 hash is stored, in public.api_key, along with their first few characters so the
+// owner can tell them apart. The key is only ever returned by CreateApiKey.
+//
+// The RPCs trust the caller to say which user it's acting for: the api only passes on the user
+// it has authenticated. So that nobody else can, they need the service token the api is
+// configured with (see requireService).
+
+// Scopes an API key can have
+const (
+	ScopeNotesRead  = "notes:read"
+	ScopeNotesWrite = "notes:write"
+)
+
+// Scopes lists every scope, in the order they're stored
+var Scopes = []string{ScopeNotesRead, ScopeNotesWrite}
+
+const (
+	apiKeyPrefix = "bk_"
+	// Characters of the key that are stored in the clear, including apiKeyPrefix
+	apiKeyShownLength = len(apiKeyPrefix) + 8
+	// The longest name a key can have, as in public.api_key
+	MaxApiKeyNameLength = 100
+)
+
+// Generate an API key, returning it and the hash to store
+func newApiKey() (key, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("generating api key: %w", err)
+	}
+	key = apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return key, hashApiKey(key), nil
+}
+
+// API keys are long and random, so, as for refresh tokens, a fast hash is enough
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Check a key's name, returning it without surrounding space
+func normaliseApiKeyName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > MaxApiKeyNameLength {
+		return "", fmt.Errorf("name must be 1 to %d characters", MaxApiKeyNameLength)
+	}
+	return name, nil
+}
+
+// Check the scopes asked for, returning them without duplicates, in the order of Scopes
+func normaliseScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("at least one scope is required: %s", strings.Join(Scopes, ", "))
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(Scopes, scope) {
+			return nil, fmt.Errorf("unknown scope %q, expected one of: %s", scope, strings.Join(Scopes, ", "))
+		}
+	}
+	var normalised []string
+	for _, scope := range Scopes {
+		if slices.Contains(scopes, scope) {
+			normalised = append(normalised, scope)
+		}
+	}
+	return normalised, nil
+}
+
+// CreateApiKey makes a new key for a user
+func (as *grpcAuthService) CreateApiKey(ctx context.Context, in *pb.CreateApiKeyRequest) (*pb.CreateApiKeyResponse, error) {
+	if in.UserId == "" {
+		return nil, status.Error(codes.InvalidArgument, "create api key: user_id required")
+	}
+	if err := as.requireService(ctx, "create api key"); err != nil {
+		return nil, err
+	}
+	name, err := normaliseApiKeyName(in.Name)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "create api key: %v", err)
+	}
+	scopes, err := normaliseScopes(in.Scopes)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "create api key: %v", err)
+	}
+
+	key, hash, err := newApiKey()
+	if err != nil {
+		return nil, err
+	}
+	apiKey := &pb.ApiKey{
+		Name:   name,
+		Scopes: scopes,
+		Prefix: key[:apiKeyShownLength],
+	}
+	var created time.Time
+	err = as.pool.QueryRow(ctx,
+		`INSERT INTO public.api_key (user_id, name, prefix, key_hash, scopes) VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created`,
+		in.UserId, name, apiKey.Prefix, hash, scopes,
+	).Scan(&apiKey.Id, &created)
+	if err != nil {
+		log.Printf("create api key: id %v, insert error: %v\n", in.UserId, err)
+		return nil, fmt.Errorf("create api key: %w", err)
+	}
+	apiKey.Created = created.Unix()
+
+	log.Printf("create api key: id %v, key %v, scopes %v\n", in.UserId, apiKey.Id, scopes)
+	return &pb.CreateApiKeyResponse{ApiKey: apiKey, Key: key}, nil
+}
+
+// ListApiKeys lists a user's keys that haven't been revoked, oldest first
+func (as *grpcAuthService) ListApiKeys(ctx context.Context, in *pb.ListApiKeysRequest) (*pb.ListApiKeysResponse, error) {
+	if in.UserId == "" {
+		return nil, status.Error(codes.InvalidArgument, "list api keys: user_id required")
+	}
+	if err := as.requireService(ctx, "list api keys"); err != nil {
+		return nil, err
+	}
+	rows, err := as.pool.Query(ctx,
+		`SELECT id, name, scopes, prefix, created FROM public.api_key
+		WHERE user_id = $1 AND revoked_at IS NULL ORDER BY created, id`,
+		in.UserId,
+	)
+	if err != nil {
+		log.Printf("list api keys: query error: %v\n", err)
+		return nil, fmt.Errorf("list api keys: %w", err)
+	}
+	defer rows.Close()
+
+	res := &pb.ListApiKeysResponse{ApiKeys: []*pb.ApiKey{}}
+	for rows.Next() {
+		apiKey := &pb.ApiKey{}
+		var created time.Time
+		if err := rows.Scan(&apiKey.Id, &apiKey.Name, &apiKey.Scopes, &apiKey.Prefix, &created); err != nil {
+			return nil, fmt.Errorf("list api keys: %w", err)
+		}
+		apiKey.Created = created.Unix()
+		res.ApiKeys = append(res.ApiKeys, apiKey)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list api keys: %w", err)
+	}
+	return res, nil
+}
+
+// RevokeApiKey revokes one of a user's keys. Keys that don't exist, belong to someone else or are
+// already revoked are all NotFound.
+func (as *grpcAuthService) RevokeApiKey(ctx context.Context, in *pb.RevokeApiKeyRequest) (*pb.RevokeApiKeyResponse, error) {
+	if in.UserId == "" || in.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "revoke api key: user_id and id required")
+	}
+	if err := as.requireService(ctx, "revoke api key"); err != nil {
+		return nil, err
+	}
+	tag, err := as.pool.Exec(ctx,
+		"UPDATE public.api_key SET revoked_at = $1 WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL",
+		as.tokens.now(), in.Id, in.UserId,
+	)
+	if err != nil {
+		log.Printf("revoke api key: update error: %v\n", err)
+		return nil, fmt.Errorf("revoke api key: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, status.Error(codes.NotFound, "revoke api key: no such key")
+	}
+	log.Printf("revoke api key: id %v, key %v\n", in.UserId, in.Id)
+	return &pb.RevokeApiKeyResponse{}, nil
+}
+
+// VerifyApiKey checks an API key, and returns its user and scopes
+func (as *grpcAuthService) VerifyApiKey(ctx context.Context, in *pb.VerifyApiKeyRequest) (*pb.VerifyResponse, error) {
+	res, err := as.verifyApiKey(ctx, in)
+	as.countToken("VerifyApiKey", res.GetState(), err)
+	return res, err
+}
+
+func (as *grpcAuthService) verifyApiKey(ctx context.Context, in *pb.VerifyApiKeyRequest) (*pb.VerifyResponse, error) {
+	// Anything without the prefix can't be a key, so there's no need to look it up
+	if !strings.HasPrefix(in.Key, apiKeyPrefix) {
+		log.Printf("verify api key: deny (format)\n")
+		return &pb.VerifyResponse{State: pb.State_DENY, Reason: pb.Reason_INVALID_TOKEN}, nil
+	}
+
+	var userId, accountStatus string
+	var scopes, roles []string
+	err := as.pool.QueryRow(ctx,
+		`SELECT k.user_id, k.scopes, u.status, u.roles FROM public.api_key k
+		JOIN public.user u ON u.id = k.user_id
+		WHERE k.key_hash = $1 AND k.revoked_at IS NULL`,
+		hashApiKey(in.Key),
+	).Scan(&userId, &scopes, &accountStatus, &roles)
+	if err == pgx.ErrNoRows {
+		log.Printf("verify api key: deny (key)\n")
+		return &pb.VerifyResponse{State: pb.State_DENY, Reason: pb.Reason_INVALID_TOKEN}, nil
+	}
+	if err != nil {
+		log.Printf("verify api key: query error: %v\n", err)
+		return nil, fmt.Errorf("verify api key: %w", err)
+	}
+	// As with access tokens, a key stops working as soon as its account isn't active
+	if reason := statusReason(accountStatus); reason != pb.Reason_NONE {
+		log.Printf("verify api key: id %v, deny (status %v)\n", userId, accountStatus)
+		return &pb.VerifyResponse{State: pb.State_DENY, Reason: reason}, nil
+	}
+
+	return &pb.VerifyResponse{
+		State:      pb.State_ALLOW,
+		Id:         userId,
+		Scopes:     scopes,
+		Roles:      roles,
+		AuthMethod: pb.AuthMethod_API_KEY,
+	}, nil
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/service"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCreateApiKey(t *testing.T) {
+	as, mock, now := newMockDbService(t)
+
+	// Scopes are stored without duplicates, in a fixed order
+	mock.ExpectQuery("^INSERT INTO public.api_key (.+)$").
+		WithArgs("abc123", "backup", pgxmock.AnyArg(), pgxmock.AnyArg(), []string{ScopeNotesRead, ScopeNotesWrite}).
+		WillReturnRows(mock.NewRows([]string{"id", "created"}).AddRow("key1", *now))
+
+	res, err := as.CreateApiKey(serviceCtx, &pb.CreateApiKeyRequest{
+		UserId: "abc123",
+		Name:   " backup ",
+		Scopes: []string{ScopeNotesWrite, ScopeNotesRead, ScopeNotesWrite},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(res.Key, apiKeyPrefix) || len(res.Key) != len(apiKeyPrefix)+43 {
+		t.Fatalf("expected a key like bk_<43 characters>, got %q", res.Key)
+	}
+	if res.ApiKey.Id != "key1" || res.ApiKey.Prefix != res.Key[:apiKeyShownLength] || res.ApiKey.Created != now.Unix() {
+		t.Fatalf("unexpected api key %v", res.ApiKey)
+	}
+	hash := hashApiKey(res.Key)
+
+	// The key verifies, with its scopes
+	mock.ExpectQuery("^SELECT k.user_id, k.scopes, u.status, u.roles (.+)$").
+		WithArgs(hash).
+		WillReturnRows(mock.NewRows([]string{"user_id", "scopes", "status", "roles"}).
+			AddRow("abc123", []string{ScopeNotesRead, ScopeNotesWrite}, "active", []string{"user"}))
+	verified, err := as.VerifyApiKey(context.Background(), &pb.VerifyApiKeyRequest{Key: res.Key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.State != pb.State_ALLOW || verified.Id != "abc123" || len(verified.Scopes) != 2 {
+		t.Fatalf("expected ALLOW for abc123 with two scopes, got %v", verified)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCreateApiKeyInvalid(t *testing.T) {
+	as, _, _ := newMockDbService(t)
+
+	for _, in := range []*pb.CreateApiKeyRequest{
+		{Name: "backup", Scopes: []string{ScopeNotesRead}},
+		{UserId: "abc123", Name: "  ", Scopes: []string{ScopeNotesRead}},
+		{UserId: "abc123", Name: strings.Repeat("a", MaxApiKeyNameLength+1), Scopes: []string{ScopeNotesRead}},
+		{UserId: "abc123", Name: "backup"},
+		{UserId: "abc123", Name: "backup", Scopes: []string{"notes:delete"}},
+	} {
+		_, err := as.CreateApiKey(serviceCtx, in)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("%v: expected InvalidArgument, got %v", in, err)
+		}
+	}
+}
+
+func TestListApiKeys(t *testing.T) {
+	as, mock, now := newMockDbService(t)
+
+	mock.ExpectQuery("^SELECT id, name, scopes, prefix, created FROM public.api_key (.+)$").
+		WithArgs("abc123").
+		WillReturnRows(mock.NewRows([]string{"id", "name", "scopes", "prefix", "created"}).
+			AddRow("key1", "backup", []string{ScopeNotesRead}, "bk_abcdefgh", *now).
+			AddRow("key2", "sync", []string{ScopeNotesRead, ScopeNotesWrite}, "bk_ijklmnop", now.Add(time.Hour)))
+
+	res, err := as.ListApiKeys(serviceCtx, &pb.ListApiKeysRequest{UserId: "abc123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.ApiKeys) != 2 || res.ApiKeys[0].Name != "backup" || res.ApiKeys[1].Prefix != "bk_ijklmnop" {
+		t.Fatalf("unexpected api keys %v", res.ApiKeys)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRevokeApiKey(t *testing.T) {
+	as, mock, now := newMockDbService(t)
+
+	mock.ExpectExec("^UPDATE public.api_key SET revoked_at = \\$1 (.+)$").
+		WithArgs(*now, "key1", "abc123").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	if _, err := as.RevokeApiKey(serviceCtx, &pb.RevokeApiKeyRequest{UserId: "abc123", Id: "key1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone else's key, or one that's already revoked, isn't found
+	mock.ExpectExec("^UPDATE public.api_key SET revoked_at = \\$1 (.+)$").
+		WithArgs(*now, "key1", "xyz789").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+	_, err := as.RevokeApiKey(serviceCtx, &pb.RevokeApiKeyRequest{UserId: "xyz789", Id: "key1"})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestVerifyApiKeyDeny(t *testing.T) {
+	as, mock, _ := newMockDbService(t)
+
+	// Not a key at all: no need to look it up
+	res, err := as.VerifyApiKey(context.Background(), &pb.VerifyApiKeyRequest{Key: "banana"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.State != pb.State_DENY || res.Reason != pb.Reason_INVALID_TOKEN {
+		t.Fatalf("expected DENY with INVALID_TOKEN, got %v", res)
+	}
+
+	// Unknown or revoked
+	mock.ExpectQuery("^SELECT k.user_id, k.scopes, u.status, u.roles (.+)$").
+		WithArgs(hashApiKey("bk_revoked")).
+		WillReturnError(pgx.ErrNoRows)
+	res, err = as.VerifyApiKey(context.Background(), &pb.VerifyApiKeyRequest{Key: "bk_revoked"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.State != pb.State_DENY || res.Reason != pb.Reason_INVALID_TOKEN {
+		t.Fatalf("expected DENY with INVALID_TOKEN, got %v", res)
+	}
+
+	// The account has been locked since the key was made
+	mock.ExpectQuery("^SELECT k.user_id, k.scopes, u.status, u.roles (.+)$").
+		WithArgs(hashApiKey("bk_locked")).
+		WillReturnRows(mock.NewRows([]string{"user_id", "scopes", "status", "roles"}).
+			AddRow("abc123", []string{ScopeNotesRead}, "locked", []string{"user"}))
+	res, err = as.VerifyApiKey(context.Background(), &pb.VerifyApiKeyRequest{Key: "bk_locked"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.State != pb.State_DENY || res.Reason != pb.Reason_ACCOUNT_LOCKED || len(res.Scopes) != 0 {
+		t.Fatalf("expected DENY with ACCOUNT_LOCKED and no scopes, got %v", res)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
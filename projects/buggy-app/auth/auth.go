@@ -2,33 +2,76 @@ package auth
 
 import (
 	"context"
+	"crypto/rand"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"sync"
+	"time"
 
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/password"
 	pb "github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/service"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/metrics"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/tracing"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 type Config struct {
 	Port        int
 	DatabaseUrl string
 	Log         *log.Logger
+	// Port for the admin server, which serves Prometheus metrics at /metrics. Zero means no
+	// admin server.
+	AdminPort int
+	// Where to send trace spans. The zero value doesn't trace.
+	Tracing tracing.Config
+	// Key for signing access tokens. If empty a random key is used, so tokens stop working when
+	// the service restarts.
+	TokenSecret string
+	// How long access and refresh tokens last. Zero means 15 minutes and 30 days.
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// Backoff and lockout after failed password attempts
+	Lockout Lockout
+	// Token that admin RPCs, like Unlock, must be sent with. If empty, admin RPCs are refused.
+	AdminToken string
+	// Token that RPCs acting for a user the caller has authenticated, like CreateApiKey, must be
+	// sent with: the api's -auth-service-token. If empty, only admins can call them.
+	ServiceToken string
+	// How passwords are hashed. Hashes made under another policy still verify, and are replaced
+	// when the user next logs in. The zero value means password.DefaultPolicy.
+	Password password.Policy
+	// The name authenticator apps show for TOTP secrets. Empty means DefaultTotpIssuer.
+	TotpIssuer string
+	// How long logins are kept in the login history. Zero means DefaultLoginHistoryRetention.
+	LoginHistoryRetention time.Duration
 }
 
 type Service struct {
 	config      Config
 	grpcService *grpcAuthService
+	registry    *prometheus.Registry
 }
 
 func New(config Config) *Service {
+	registry := metrics.NewRegistry()
+	grpcService := newGrpcService(config)
+	registry.MustRegister(grpcService.verifies, grpcService.tokenRequests)
 	return &Service{
 		config:      config,
-		grpcService: newGrpcService(),
+		grpcService: grpcService,
+		registry:    registry,
 	}
 }
 
@@ -44,8 +87,14 @@ func New(config Config) *Service {
 //		log.Fatal(err)
 //	}
 func (as *Service) Run(ctx context.Context) error {
+	shutdownTracing, err := tracing.Setup(ctx, as.config.Tracing)
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
+
 	// Connect to the database via a "pool" of connections, allowing concurrency
-	pool, err := pgxpool.New(ctx, as.config.DatabaseUrl)
+	pool, err := tracing.NewPool(ctx, as.config.DatabaseUrl)
 	if err != nil {
 		return fmt.Errorf("unable to create connection pool: %w", err)
 	}
@@ -53,6 +102,10 @@ func (as *Service) Run(ctx context.Context) error {
 	// Add the pool to the "inner" auth service which implements the gRPC interface
 	// and responds to RPCs
 	as.grpcService.pool = pool
+	as.registry.MustRegister(metrics.NewPoolCollector(pool))
+
+	// Hash the dummy password now, so the first unknown user isn't slower to deny than the rest
+	as.grpcService.dummyHash()
 
 	// Create a TCP listener for the gRPC server to use
 	listen := fmt.Sprintf(":%d", as.config.Port)
@@ -62,9 +115,29 @@ func (as *Service) Run(ctx context.Context) error {
 	}
 
 	// Set up and register the server
-	grpcServer := grpc.NewServer()
+	// The stats handler continues traces started by clients, from the gRPC metadata
+	grpcServer := grpc.NewServer(grpc.StatsHandler(otelgrpc.NewServerHandler()))
 	pb.RegisterAuthServer(grpcServer, as.grpcService)
 
+	// The standard gRPC health service reports whether we can serve, which depends on the
+	// database being reachable
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	go watchHealth(ctx, pool, healthServer)
+
+	// Write logins in the background, until the server has stopped
+	retention := as.config.LoginHistoryRetention
+	if retention == 0 {
+		retention = DefaultLoginHistoryRetention
+	}
+	loginsCtx, stopLogins := context.WithCancel(context.Background())
+	var loginsWg sync.WaitGroup
+	loginsWg.Add(1)
+	go func() {
+		defer loginsWg.Done()
+		as.grpcService.writeLogins(loginsCtx, retention)
+	}()
+
 	// Serve on the supplied listener
 	// This call blocks, so we put it in a goroutine
 	var runErr error
@@ -76,14 +149,28 @@ func (as *Service) Run(ctx context.Context) error {
 	}()
 
 	as.config.Log.Printf("auth service: listening: %s", listen)
+	if as.config.TokenSecret == "" {
+		as.config.Log.Printf("auth service: no token secret configured, using a random one: tokens won't survive a restart")
+	}
+
+	waitAdmin := func() error { return nil }
+	if as.config.AdminPort != 0 {
+		waitAdmin = metrics.RunAdmin(ctx, as.config.AdminPort, as.registry, slog.Default())
+	}
 
 	// Wait for the context cancel (e.g. from interrupt signal) before
 	// gracefully shutting down any ongoing RPCs
 	<-ctx.Done()
+	healthServer.Shutdown()
 	grpcServer.GracefulStop()
 
-	// Ensure the Serve goroutine is finished
+	// Ensure the Serve goroutine is finished, and the last logins written
 	wg.Wait()
+	stopLogins()
+	loginsWg.Wait()
+	if err := waitAdmin(); err != nil && runErr == nil {
+		runErr = err
+	}
 	return runErr
 }
 
@@ -92,59 +179,314 @@ type grpcAuthService struct {
 	pb.UnimplementedAuthServer
 
 	// Pool is a reference to the database that we can use for queries
-	pool *pgxpool.Pool
+	pool dbClient
+
+	// Signs and checks access tokens
+	tokens *tokenIssuer
+	// Tracks failed password attempts
+	throttle *throttle
+	// See Config.AdminToken
+	adminToken string
+	// See Config.ServiceToken
+	serviceToken string
+	// How new password hashes are made
+	passwords password.Policy
+	// See newDummyHash
+	dummyHash func() string
+	// See Config.TotpIssuer
+	totpIssuer string
+	// Logins waiting to be written, see history.go
+	logins chan loginEvent
+
+	// Verify results, by state: auth_verify_total{state="ALLOW"}. Errors are counted with
+	// state="ERROR".
+	verifies *prometheus.CounterVec
+	// Token RPCs, by RPC and result state: auth_token_total{rpc="IssueToken",state="ALLOW"}
+	tokenRequests *prometheus.CounterVec
+}
+
+// The parts of pgxpool.Pool that the service uses, so that tests can mock the database
+type dbClient interface {
+	QueryRow(context.Context, string, ...interface{}) pgx.Row
+	Query(context.Context, string, ...interface{}) (pgx.Rows, error)
+	Exec(context.Context, string, ...interface{}) (pgconn.CommandTag, error)
+}
+
+func newGrpcService(config Config) *grpcAuthService {
+	passwords := config.Password
+	if passwords.Algorithm == "" {
+		passwords = password.DefaultPolicy
+	}
+	totpIssuer := config.TotpIssuer
+	if totpIssuer == "" {
+		totpIssuer = DefaultTotpIssuer
+	}
+	return &grpcAuthService{
+		tokens:       newTokenIssuer(config.TokenSecret, config.AccessTokenTTL, config.RefreshTokenTTL),
+		throttle:     newThrottle(config.Lockout),
+		adminToken:   config.AdminToken,
+		serviceToken: config.ServiceToken,
+		passwords:    passwords,
+		dummyHash:    newDummyHash(passwords),
+		totpIssuer:   totpIssuer,
+		logins:       make(chan loginEvent, loginQueueSize),
+		verifies: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "auth",
+			Name:      "verify_total",
+			Help:      "Verify RPCs handled, by result state.",
+		}, []string{"state"}),
+		tokenRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "auth",
+			Name:      "token_total",
+			Help:      "Token RPCs handled, by RPC and result state.",
+		}, []string{"rpc", "state"}),
+	}
 }
 
-func newGrpcService() *grpcAuthService {
-	return &grpcAuthService{}
+// How often the database is checked for the health service
+const healthInterval = 5 * time.Second
+
+// Keep the health status up to date with whether the database can be reached, until ctx is done.
+// The status is set for the Auth service, and for "" which means the server as a whole.
+func watchHealth(ctx context.Context, pool *pgxpool.Pool, hs *health.Server) {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		status := healthpb.HealthCheckResponse_SERVING
+		pingCtx, cancel := context.WithTimeout(ctx, healthInterval)
+		if err := pool.Ping(pingCtx); err != nil {
+			if ctx.Err() != nil {
+				cancel()
+				return
+			}
+			log.Printf("auth service: health: database ping failed: %v", err)
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		cancel()
+		hs.SetServingStatus("", status)
+		hs.SetServingStatus(pb.Auth_ServiceDesc.ServiceName, status)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
 
+var tracer = otel.Tracer("github.com/CodeYourFuture/immersive-go-course/buggy-app/auth")
+
 type userRow struct {
 	id       string
 	password string
 	status   string
+	roles    []string
+}
+
+// Account statuses, as stored in public.user.status. Only active users can authenticate.
+const (
+	StatusActive              = "active"
+	StatusInactive            = "inactive"
+	StatusLocked              = "locked"
+	StatusPendingVerification = "pending_verification"
+)
+
+// Statuses lists every account status
+var Statuses = []string{StatusActive, StatusInactive, StatusLocked, StatusPendingVerification}
+
+// Why a user with the given status can't authenticate, or NONE if they can
+func statusReason(status string) pb.Reason {
+	switch status {
+	case StatusActive:
+		return pb.Reason_NONE
+	case StatusLocked:
+		return pb.Reason_ACCOUNT_LOCKED
+	case StatusPendingVerification:
+		return pb.Reason_ACCOUNT_PENDING_VERIFICATION
+	case StatusInactive:
+		return pb.Reason_ACCOUNT_INACTIVE
+	}
+	// The database doesn't allow other values, but if one gets in, it's not active
+	log.Printf("verify: unknown account status %q\n", status)
+	return pb.Reason_ACCOUNT_INACTIVE
 }
 
 // Verify checks a Input for authentication validity
 func (as *grpcAuthService) Verify(ctx context.Context, in *pb.VerifyRequest) (*pb.VerifyResponse, error) {
+	res, err := as.verify(ctx, in)
+	if err != nil {
+		as.verifies.WithLabelValues("ERROR").Inc()
+	} else {
+		as.verifies.WithLabelValues(res.State.String()).Inc()
+	}
+	return res, err
+}
+
+func (as *grpcAuthService) verify(ctx context.Context, in *pb.VerifyRequest) (*pb.VerifyResponse, error) {
 	log.Printf("verify: id %v, start\n", in.Id)
 
+	// Refuse straight away if this user or source has to wait, without looking at the password
+	if wait := as.throttle.wait(in.Id, in.Source); wait > 0 {
+		log.Printf("verify: id %v, source %v, deny (throttled for %v)\n", in.Id, in.Source, wait)
+		return &pb.VerifyResponse{
+			State:      pb.State_DENY,
+			Reason:     pb.Reason_TOO_MANY_ATTEMPTS,
+			RetryAfter: retryAfterSeconds(wait),
+		}, nil
+	}
+
 	// Look for this user in the database
 	var row userRow
 	err := as.pool.QueryRow(ctx,
-		"SELECT id, password, status FROM public.user WHERE id = $1",
+		"SELECT id, password, status, roles FROM public.user WHERE id = $1",
 		in.Id,
-	).Scan(&row.id, &row.password, &row.status)
+	).Scan(&row.id, &row.password, &row.status, &row.roles)
 	// Error can be no rows or a real error...
 	if err != nil {
 		// No rows is not an error that needs logging
 		if err != pgx.ErrNoRows {
 			log.Printf("verify: query error: %v\n", err)
+		} else {
+			// Compare against a hash anyway, so that an unknown user takes as long to deny as a
+			// wrong password, and the timing doesn't reveal which ids exist
+			comparePassword(ctx, as.dummyHash(), in.Password)
+			as.throttle.fail(in.Id, in.Source)
 		}
 		log.Printf("verify: id %v, deny (query)\n", in.Id)
 		// ... either way, deny!
 		return &pb.VerifyResponse{
-			State: pb.State_DENY,
+			State:  pb.State_DENY,
+			Reason: pb.Reason_INVALID_CREDENTIALS,
 		}, nil
 	}
 
-	// bcrypt require us to compare the input to the hash directly
-	// https://auth0.com/blog/hashing-in-action-understanding-bcrypt/
-	err = bcrypt.CompareHashAndPassword([]byte(row.password), []byte(in.Password))
+	res, err := as.verifyUser(ctx, in, row)
+	if err != nil {
+		return nil, err
+	}
+	// Every outcome for a real user goes in their login history, so they can see attempts on
+	// their account as well as their own logins
+	as.recordLogin(row.id, in.Source, res)
+	return res, nil
+}
+
+// Check the password, and any second factor, of a user who exists
+func (as *grpcAuthService) verifyUser(ctx context.Context, in *pb.VerifyRequest, row userRow) (*pb.VerifyResponse, error) {
+	err := comparePassword(ctx, row.password, in.Password)
 	if err != nil {
 		// Mismatched hash and password is OK, but other errors need logging
-		if err != bcrypt.ErrMismatchedHashAndPassword {
+		if err != password.ErrMismatch {
 			log.Printf("verify: compare error: %v\n", err)
 		}
+		as.throttle.fail(in.Id, in.Source)
 		log.Printf("verify: id %v, deny (password)\n", in.Id)
 		return &pb.VerifyResponse{
-			State: pb.State_DENY,
+			State:  pb.State_DENY,
+			Reason: pb.Reason_INVALID_CREDENTIALS,
+		}, nil
+	}
+
+	// With the password right, a user with a second factor needs that too. A wrong code counts
+	// as a failed attempt, so the codes can't be guessed any faster than passwords.
+	secret, err := as.totpSecret(ctx, row.id)
+	if err != nil {
+		log.Printf("verify: %v\n", err)
+		return nil, fmt.Errorf("verify: %w", err)
+	}
+	if secret != "" {
+		if in.Otp == "" {
+			log.Printf("verify: id %v, deny (otp required)\n", in.Id)
+			return &pb.VerifyResponse{
+				State:  pb.State_DENY,
+				Reason: pb.Reason_OTP_REQUIRED,
+			}, nil
+		}
+		ok, err := as.checkOtp(ctx, row.id, secret, in.Otp)
+		if err != nil {
+			log.Printf("verify: %v\n", err)
+			return nil, fmt.Errorf("verify: %w", err)
+		}
+		if !ok {
+			as.throttle.fail(in.Id, in.Source)
+			log.Printf("verify: id %v, deny (otp)\n", in.Id)
+			return &pb.VerifyResponse{
+				State:  pb.State_DENY,
+				Reason: pb.Reason_INVALID_OTP,
+			}, nil
+		}
+	}
+
+	// Every factor was right, so earlier failures for this user no longer count
+	as.throttle.resetUser(in.Id)
+	// Now that we have the password, bring its hash up to the current policy
+	if as.passwords.NeedsRehash(row.password) {
+		as.rehash(ctx, row, in.Password)
+	}
+
+	// The status is only checked once the password matches, so that the reason doesn't tell
+	// anyone without the password about the account
+	if reason := statusReason(row.status); reason != pb.Reason_NONE {
+		log.Printf("verify: id %v, deny (status %v)\n", in.Id, row.status)
+		return &pb.VerifyResponse{
+			State:  pb.State_DENY,
+			Reason: reason,
 		}, nil
 	}
 
 	log.Printf("verify: id %v, allow\n", in.Id)
-	// No errors from the query or the password comparison
+	// No errors from the query or the password comparison, and the account is active
 	return &pb.VerifyResponse{
-		State: pb.State_ALLOW,
+		State:      pb.State_ALLOW,
+		Id:         row.id,
+		Roles:      row.roles,
+		AuthMethod: pb.AuthMethod_PASSWORD,
 	}, nil
 }
+
+// Password hashes are deliberately slow to compare, so the comparison gets its own span
+func comparePassword(ctx context.Context, hash, passwd string) error {
+	_, span := tracer.Start(ctx, "password.Compare",
+		trace.WithAttributes(attribute.String("password.algorithm", password.Algorithm(hash))))
+	defer span.End()
+	return password.Compare(hash, passwd)
+}
+
+// Replace a user's hash, made under an older or weaker policy, with one made under the current
+// policy. A failure only means the old hash is kept until next time, so it's logged rather than
+// failing the verify.
+func (as *grpcAuthService) rehash(ctx context.Context, row userRow, passwd string) {
+	ctx, span := tracer.Start(ctx, "password.Rehash")
+	defer span.End()
+
+	hash, err := as.passwords.Hash(passwd)
+	if err != nil {
+		log.Printf("verify: id %v, rehash error: %v\n", row.id, err)
+		return
+	}
+	// Only replace the hash that was checked, in case the password has been changed since
+	_, err = as.pool.Exec(ctx,
+		"UPDATE public.user SET password = $1 WHERE id = $2 AND password = $3",
+		hash, row.id, row.password,
+	)
+	if err != nil {
+		log.Printf("verify: id %v, rehash update error: %v\n", row.id, err)
+		return
+	}
+	log.Printf("verify: id %v, rehashed from %v to %v\n", row.id, password.Algorithm(row.password), as.passwords.Algorithm)
+}
+
+// A hash of a random password, under the current policy, for comparing against when the user
+// doesn't exist. It takes as long to compare as the hashes of users who have logged in recently.
+func newDummyHash(policy password.Policy) func() string {
+	return sync.OnceValue(func() string {
+		random := make([]byte, 16)
+		if _, err := rand.Read(random); err != nil {
+			panic(fmt.Sprintf("auth: generating dummy password: %v", err))
+		}
+		hash, err := policy.Hash(string(random))
+		if err != nil {
+			panic(fmt.Sprintf("auth: hashing dummy password: %v", err))
+		}
+		return hash
+	})
+}
@@ -11,6 +11,7 @@ import (
 	pb "github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/service"
 	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
 	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 )
@@ -86,8 +87,8 @@ func TestSimpleVerifyDeny(t *testing.T) {
 		wg.Wait()
 		t.Fatalf("fail to dial: %v", err)
 	}
-	if result.State != pb.State_DENY {
-		t.Fatalf("failed to verify, expected DENY, got %v", result.State)
+	if result.State != pb.State_DENY || result.Reason != pb.Reason_INVALID_CREDENTIALS {
+		t.Fatalf("failed to verify, expected DENY with INVALID_CREDENTIALS, got %v %v", result.State, result.Reason)
 	}
 
 	cancel()
@@ -173,6 +174,11 @@ func TestSimpleVerifyAllow(t *testing.T) {
 		wg.Wait()
 		t.Fatalf("failed to verify, expected ALLOW, got %v", result.State)
 	}
+	if n := testutil.ToFloat64(as.grpcService.verifies.WithLabelValues("ALLOW")); n != 1 {
+		cancel()
+		wg.Wait()
+		t.Fatalf("expected 1 ALLOW in the verify metric, got %v", n)
+	}
 
 	// TODO: this cleanup needs to happen regardless and be linked to the context
 	_, err = dbConn.Exec(
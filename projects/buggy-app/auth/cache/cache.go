@@ -3,32 +3,70 @@ package cache
 import (
 	"crypto/md5"
 	"sync"
+	"time"
 )
 
 // This package provides a very simple cache. It's designed to hide the values of the keys because
 // they will be used for storing authentication information, so keys are hashed before being used.
 //
-// 	c := Cache[int]()
+// 	c := New[int](time.Minute)
 // 	k := c.Key("secret number")
 // 	c.Put(k, 42)
 // 	...
 // 	if v, ok := c.Get(k); ok {
 //		...
 // 	}
+//
+// Entries expire after the TTL given to New, so that whatever they were worked out from is
+// looked at again every so often, even if nothing deletes them. Expired entries are swept out
+// once every TTL, so the cache doesn't grow without end.
+//
+// Entries can be put in a group, so that they can be deleted together: all of a user's verify
+// results, say, when their password changes. A value worked out before the group was deleted
+// mustn't be put back after it, so read the group's generation first, and pass it to PutIn:
+//
+// 	g := c.Key("user id")
+// 	gen := c.Generation(g)
+// 	v := work out the value...
+// 	c.PutIn(g, gen, k, v)
+// 	...
+// 	c.DeleteGroup(g)
 
 type Key [16]byte
 
 type Entry[Value any] struct {
-	value *Value
+	value   *Value
+	expires time.Time
 }
 
 type Cache[Value any] struct {
 	entries *sync.Map
+	// How long entries are kept. Zero means forever.
+	ttl time.Duration
+	// The clock, which tests can replace
+	now func() time.Time
+
+	mu sync.Mutex
+	// The keys put in each group
+	groups map[Key]map[Key]struct{}
+	// How many times DeleteGroup has been called, which is what Generation hands out
+	deletes uint64
+	// The value of deletes when each group was last deleted, since the last sweep
+	deleted map[Key]uint64
+	// Generations from before the last sweep are too old for PutIn, because deleted has
+	// forgotten what happened before it
+	oldest uint64
+	// When to next sweep out expired entries
+	nextSweep time.Time
 }
 
-func New[Value any]() *Cache[Value] {
+func New[Value any](ttl time.Duration) *Cache[Value] {
 	return &Cache[Value]{
 		entries: &sync.Map{},
+		ttl:     ttl,
+		now:     time.Now,
+		groups:  map[Key]map[Key]struct{}{},
+		deleted: map[Key]uint64{},
 	}
 }
 
@@ -39,6 +77,10 @@ func (c *Cache[V]) Key(k string) Key {
 func (c *Cache[Value]) Get(k Key) (*Value, bool) {
 	if value, ok := c.entries.Load(k); ok {
 		if entry, ok := value.(Entry[Value]); ok {
+			if !entry.expires.IsZero() && !c.now().Before(entry.expires) {
+				c.entries.CompareAndDelete(k, value)
+				return nil, false
+			}
 			return entry.value, true
 		}
 	}
@@ -46,7 +88,83 @@ func (c *Cache[Value]) Get(k Key) (*Value, bool) {
 }
 
 func (c *Cache[Value]) Put(k Key, v *Value) {
-	c.entries.Store(k, Entry[Value]{
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.put(k, v)
+}
+
+// Store an entry and, once every TTL, sweep out the expired ones. Must hold c.mu.
+func (c *Cache[Value]) put(k Key, v *Value) {
+	entry := Entry[Value]{
 		value: v,
+	}
+	if c.ttl > 0 {
+		now := c.now()
+		entry.expires = now.Add(c.ttl)
+		if !now.Before(c.nextSweep) {
+			c.sweep(now)
+			c.nextSweep = now.Add(c.ttl)
+		}
+	}
+	c.entries.Store(k, entry)
+}
+
+// Remove expired entries, the keys of entries that have gone from their groups, empty groups,
+// and the record of which groups were deleted. Without this, every key ever put would be kept
+// for the life of the cache. Must hold c.mu.
+func (c *Cache[Value]) sweep(now time.Time) {
+	c.entries.Range(func(k, value any) bool {
+		if entry, ok := value.(Entry[Value]); ok && !entry.expires.IsZero() && !now.Before(entry.expires) {
+			c.entries.CompareAndDelete(k, value)
+		}
+		return true
 	})
+	for group, keys := range c.groups {
+		for k := range keys {
+			if _, ok := c.entries.Load(k); !ok {
+				delete(keys, k)
+			}
+		}
+		if len(keys) == 0 {
+			delete(c.groups, group)
+		}
+	}
+	c.deleted = map[Key]uint64{}
+	c.oldest = c.deletes
+}
+
+// Generation to pass to PutIn, which changes each time a group is deleted
+func (c *Cache[Value]) Generation(group Key) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deletes
+}
+
+// PutIn puts an entry in a group, unless the group has been deleted since the generation was
+// read. It returns whether the entry was put.
+func (c *Cache[Value]) PutIn(group Key, generation uint64, k Key, v *Value) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation < c.oldest || c.deleted[group] > generation {
+		return false
+	}
+	// Put first, because a sweep would drop a key whose entry isn't there yet from its group
+	c.put(k, v)
+	if c.groups[group] == nil {
+		c.groups[group] = map[Key]struct{}{}
+	}
+	c.groups[group][k] = struct{}{}
+	return true
+}
+
+// DeleteGroup deletes every entry put in the group
+func (c *Cache[Value]) DeleteGroup(group Key) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k := range c.groups[group] {
+		c.entries.Delete(k)
+	}
+	delete(c.groups, group)
+	c.deletes++
+	c.deleted[group] = c.deletes
 }
@@ -1,22 +1,25 @@
 package cache
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 type TestValue string
 
 func TestNew(t *testing.T) {
-	New[TestValue]()
+	New[TestValue](0)
 }
 
 func TestPut(t *testing.T) {
-	c := New[TestValue]()
+	c := New[TestValue](0)
 	k := c.Key("foo")
 	v := TestValue("entry")
 	c.Put(k, &v)
 }
 
 func TestGet(t *testing.T) {
-	c := New[TestValue]()
+	c := New[TestValue](0)
 	k := c.Key("foo")
 	v := TestValue("entry")
 	c.Put(k, &v)
@@ -28,3 +31,110 @@ func TestGet(t *testing.T) {
 		t.Fatalf("cache: expected %s, got %s", v, *gV)
 	}
 }
+
+func TestDeleteGroup(t *testing.T) {
+	c := New[TestValue](0)
+	g := c.Key("user")
+	k1, k2, other := c.Key("foo"), c.Key("bar"), c.Key("baz")
+	v := TestValue("entry")
+	gen := c.Generation(g)
+	c.PutIn(g, gen, k1, &v)
+	c.PutIn(g, gen, k2, &v)
+	c.Put(other, &v)
+
+	c.DeleteGroup(g)
+	if _, ok := c.Get(k1); ok {
+		t.Fatalf("cache: expected %v to be deleted with its group", k1)
+	}
+	if _, ok := c.Get(k2); ok {
+		t.Fatalf("cache: expected %v to be deleted with its group", k2)
+	}
+	if _, ok := c.Get(other); !ok {
+		t.Fatalf("cache: expected an entry outside the group to be kept")
+	}
+
+	// A value from before the delete isn't put back
+	if c.PutIn(g, gen, k1, &v) {
+		t.Fatalf("cache: expected a put with an old generation to be refused")
+	}
+	if !c.PutIn(g, c.Generation(g), k1, &v) {
+		t.Fatalf("cache: expected a put with the current generation to work")
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := New[TestValue](time.Minute)
+	c.now = func() time.Time { return now }
+	k := c.Key("foo")
+	v := TestValue("entry")
+	c.Put(k, &v)
+
+	now = now.Add(59 * time.Second)
+	if _, ok := c.Get(k); !ok {
+		t.Fatalf("cache: expected the entry before its ttl")
+	}
+	now = now.Add(time.Second)
+	if _, ok := c.Get(k); ok {
+		t.Fatalf("cache: expected the entry to expire after its ttl")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := New[TestValue](time.Minute)
+	c.now = func() time.Time { return now }
+	v := TestValue("entry")
+	for _, user := range []string{"alice", "bob", "carol"} {
+		g := c.Key(user)
+		c.PutIn(g, c.Generation(g), c.Key(user+":password"), &v)
+	}
+	c.Put(c.Key("other"), &v)
+	gen := c.Generation(c.Key("alice"))
+	c.DeleteGroup(c.Key("bob"))
+
+	now = now.Add(time.Minute)
+	c.mu.Lock()
+	c.sweep(now)
+	c.mu.Unlock()
+
+	c.entries.Range(func(k, _ any) bool {
+		t.Fatalf("cache: expected entry %v to be swept", k)
+		return false
+	})
+	if len(c.groups) != 0 {
+		t.Fatalf("cache: expected no groups after the sweep, got %d", len(c.groups))
+	}
+	if len(c.deleted) != 0 {
+		t.Fatalf("cache: expected no deleted groups after the sweep, got %d", len(c.deleted))
+	}
+
+	// A value from before the sweep might be from before a delete it has forgotten
+	if c.PutIn(c.Key("alice"), gen, c.Key("alice:password"), &v) {
+		t.Fatalf("cache: expected a put with a generation from before the sweep to be refused")
+	}
+}
+
+func TestPutSweeps(t *testing.T) {
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := New[TestValue](time.Minute)
+	c.now = func() time.Time { return now }
+	v := TestValue("entry")
+	old := c.Key("old")
+	c.Put(old, &v)
+
+	now = now.Add(time.Minute)
+	c.Put(c.Key("new"), &v)
+	if _, ok := c.entries.Load(old); ok {
+		t.Fatalf("cache: expected the expired entry to be swept by the next put")
+	}
+
+	// A put that sweeps still leaves its own entry in its group
+	now = now.Add(time.Minute)
+	g, k := c.Key("user"), c.Key("user:password")
+	c.PutIn(g, c.Generation(g), k, &v)
+	c.DeleteGroup(g)
+	if _, ok := c.Get(k); ok {
+		t.Fatalf("cache: expected %v to be deleted with its group", k)
+	}
+}
@@ -1,22 +1,166 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/cache"
 	pb "github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/service"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 type Client interface {
 	Close() error
 	Verify(ctx context.Context, id, passwd string) (*VerifyResult, error)
+	// Check returns an error unless the auth service is reachable and serving
+	Check(ctx context.Context) error
+
+	// IssueToken starts a session for the user if the id and password are allowed
+	IssueToken(ctx context.Context, id, passwd string) (*TokenResult, error)
+	// RefreshToken swaps a refresh token for new tokens. The old one can't be used again.
+	RefreshToken(ctx context.Context, refreshToken string) (*TokenResult, error)
+	// RevokeToken ends the session of a refresh token, and its access tokens stop verifying
+	RevokeToken(ctx context.Context, refreshToken string) error
+	// VerifyToken checks an access token. The result's Id is the user it was issued to.
+	VerifyToken(ctx context.Context, accessToken string) (*VerifyResult, error)
+
+	// CreateApiKey makes a key for the user, limited to the scopes. Errors wrap ErrInvalidArgument
+	// if the name or scopes aren't allowed.
+	CreateApiKey(ctx context.Context, userId, name string, scopes []string) (*NewApiKey, error)
+	// ListApiKeys lists the user's keys that haven't been revoked
+	ListApiKeys(ctx context.Context, userId string) ([]ApiKey, error)
+	// RevokeApiKey revokes one of the user's keys. Errors wrap ErrNotFound if the user has no
+	// such key.
+	RevokeApiKey(ctx context.Context, userId, id string) error
+	// VerifyApiKey checks an API key. The result has the user and the key's scopes.
+	VerifyApiKey(ctx context.Context, key string) (*VerifyResult, error)
+
+	// EnrolTotp makes a new TOTP secret for the user, which isn't used until it's confirmed.
+	// Errors wrap ErrFailedPrecondition if the user already has a confirmed one.
+	EnrolTotp(ctx context.Context, userId string) (*TotpEnrolment, error)
+	// ConfirmTotp turns on the user's new secret, given a current code from it, and returns their
+	// recovery codes. Errors wrap ErrInvalidArgument if the code is wrong, ErrFailedPrecondition
+	// if there's nothing to confirm, and ErrTooManyAttempts if the user has to wait.
+	ConfirmTotp(ctx context.Context, userId, code string) ([]string, error)
+	// DisableTotp removes the user's second factor, given a current code or a recovery code.
+	// Errors are as for ConfirmTotp.
+	DisableTotp(ctx context.Context, userId, code string) error
+
+	// ChangePassword replaces the user's password, given their current one, and ends their
+	// sessions. Errors wrap ErrPermissionDenied if the current password is wrong,
+	// ErrInvalidArgument if the new one isn't allowed, and ErrTooManyAttempts if the user has
+	// to wait.
+	ChangePassword(ctx context.Context, userId, currentPasswd, newPasswd string) error
+	// DeactivateAccount makes the user inactive, given their current password, and ends their
+	// sessions. Errors are as for ChangePassword.
+	DeactivateAccount(ctx context.Context, userId, currentPasswd string) error
+	// ListLoginHistory lists the user's most recent logins, newest first. Zero means the
+	// service's default limit.
+	ListLoginHistory(ctx context.Context, userId string, limit int) ([]LoginEvent, error)
 }
 
 type VerifyResult struct {
 	State string
+	// The verified user, when State is StateAllow
+	Id string
+	// Why the State is StateDeny: one of the Reason values
+	Reason string
+	// How long to wait before trying again, when Reason is ReasonTooManyAttempts
+	RetryAfter time.Duration
+	// What the user may do, when they authenticated with an API key. Nil for passwords and
+	// access tokens, which aren't limited.
+	Scopes []string
+	// The user's roles, when State is StateAllow
+	Roles []string
+	// How the user authenticated, when State is StateAllow: one of the AuthMethod values
+	AuthMethod string
+	// The session of the access token, when AuthMethod is AuthMethodAccessToken
+	SessionId string
+}
+
+// ApiKey describes one of a user's API keys, without the key itself
+type ApiKey struct {
+	Id     string
+	Name   string
+	Scopes []string
+	// The first few characters of the key, to tell keys apart
+	Prefix  string
+	Created time.Time
+}
+
+// LoginEvent is a check of a user's password by the auth service, and what came of it
+type LoginEvent struct {
+	Time time.Time
+	// The client IP, if it was known
+	Source string
+	State  string
+	// Why the State is StateDeny: one of the Reason values
+	Reason string
+}
+
+// TotpEnrolment is a new TOTP secret, for the user to add to their authenticator app
+type TotpEnrolment struct {
+	// The secret, base32 encoded, for typing in
+	Secret string
+	// An otpauth:// URI with the secret, for showing as a QR code
+	URI string
+}
+
+// User describes an account, without its password
+type User struct {
+	Id string
+	// One of the Status values
+	Status string
+	// From the Role values
+	Roles    []string
+	Created  time.Time
+	Modified time.Time
+}
+
+// NewApiKey is a key that has just been created. The Key can't be retrieved again.
+type NewApiKey struct {
+	ApiKey
+	Key string
+}
+
+var (
+	// ErrInvalidArgument is wrapped by errors for requests the auth service refused as invalid
+	ErrInvalidArgument = errors.New("auth: invalid argument")
+	// ErrNotFound is wrapped by errors for things the auth service couldn't find
+	ErrNotFound = errors.New("auth: not found")
+	// ErrFailedPrecondition is wrapped by errors for requests that don't make sense in the current
+	// state, like confirming a TOTP secret that hasn't been enrolled
+	ErrFailedPrecondition = errors.New("auth: failed precondition")
+	// ErrTooManyAttempts is wrapped by errors for requests refused because the user has failed
+	// too often recently
+	ErrTooManyAttempts = errors.New("auth: too many attempts")
+	// ErrPermissionDenied is wrapped by errors for requests the caller isn't allowed to make, like
+	// admin RPCs without the admin token
+	ErrPermissionDenied = errors.New("auth: permission denied")
+)
+
+// TokenResult is the outcome of issuing or refreshing tokens. The tokens are only set when
+// State is StateAllow.
+type TokenResult struct {
+	State string
+	// Why the State is StateDeny: one of the Reason values
+	Reason       string
+	AccessToken  string
+	RefreshToken string
+	// How long until the access token expires
+	ExpiresIn time.Duration
+	// How long to wait before trying again, when Reason is ReasonTooManyAttempts
+	RetryAfter time.Duration
 }
 
 var (
@@ -24,12 +168,73 @@ var (
 	StateAllow = pb.State_name[int32(pb.State_ALLOW)]
 )
 
+// Reasons for a deny. The account reasons are only given to callers that had the right password
+// or a valid token.
+var (
+	ReasonNone                       = pb.Reason_name[int32(pb.Reason_NONE)]
+	ReasonInvalidCredentials         = pb.Reason_name[int32(pb.Reason_INVALID_CREDENTIALS)]
+	ReasonInvalidToken               = pb.Reason_name[int32(pb.Reason_INVALID_TOKEN)]
+	ReasonAccountInactive            = pb.Reason_name[int32(pb.Reason_ACCOUNT_INACTIVE)]
+	ReasonAccountLocked              = pb.Reason_name[int32(pb.Reason_ACCOUNT_LOCKED)]
+	ReasonAccountPendingVerification = pb.Reason_name[int32(pb.Reason_ACCOUNT_PENDING_VERIFICATION)]
+	ReasonTooManyAttempts            = pb.Reason_name[int32(pb.Reason_TOO_MANY_ATTEMPTS)]
+	ReasonOtpRequired                = pb.Reason_name[int32(pb.Reason_OTP_REQUIRED)]
+	ReasonInvalidOtp                 = pb.Reason_name[int32(pb.Reason_INVALID_OTP)]
+)
+
+// How a verified user authenticated
+var (
+	AuthMethodPassword    = pb.AuthMethod_name[int32(pb.AuthMethod_PASSWORD)]
+	AuthMethodAccessToken = pb.AuthMethod_name[int32(pb.AuthMethod_ACCESS_TOKEN)]
+	AuthMethodApiKey      = pb.AuthMethod_name[int32(pb.AuthMethod_API_KEY)]
+)
+
+type sourceCtxKey struct{}
+
+// NewSourceContext returns a context that makes Verify, IssueToken, ChangePassword and
+// DeactivateAccount tell the auth service where the attempt came from, like the client's IP
+// address. The auth service limits failed attempts by source as well as by user.
+func NewSourceContext(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, sourceCtxKey{}, source)
+}
+
+func sourceFromContext(ctx context.Context) string {
+	source, _ := ctx.Value(sourceCtxKey{}).(string)
+	return source
+}
+
+type otpCtxKey struct{}
+
+// NewOtpContext returns a context that makes Verify and IssueToken send a second factor: a code
+// from the user's authenticator app, or one of their recovery codes. Users who have enrolled a
+// TOTP secret are denied with ReasonOtpRequired without one.
+func NewOtpContext(ctx context.Context, otp string) context.Context {
+	return context.WithValue(ctx, otpCtxKey{}, otp)
+}
+
+func otpFromContext(ctx context.Context) string {
+	otp, _ := ctx.Value(otpCtxKey{}).(string)
+	return otp
+}
+
+// How long Verify results are cached. A client only forgets the results of changes made through
+// it, so this is how long a change made elsewhere -- an admin locking a user or resetting their
+// password, or another API instance changing it -- can take to apply to Basic auth.
+const verifyCacheTTL = 30 * time.Second
+
 // GrpcClient is meant to be used by other services to talk with the Auth service.
 type GrpcClient struct {
 	conn   *grpc.ClientConn
 	cancel context.CancelFunc
 	aC     pb.AuthClient
+	hC     healthpb.HealthClient
 	cache  *cache.Cache[VerifyResult]
+	// Sent with the RPCs that act for a user, see WithServiceToken
+	serviceToken string
+
+	// Verify results found, or not, in the cache
+	cacheHits   prometheus.Counter
+	cacheMisses prometheus.Counter
 }
 
 // Create a new Client for the auth service.
@@ -38,6 +243,13 @@ func NewClient(ctx context.Context, target string) (*GrpcClient, error) {
 	return newClientWithOpts(ctx, target, defaultOpts()...)
 }
 
+// WithServiceToken sets the token sent with RPCs that act for a user the caller has
+// authenticated, like CreateApiKey: the auth service's -service-token.
+func (c *GrpcClient) WithServiceToken(token string) *GrpcClient {
+	c.serviceToken = token
+	return c
+}
+
 // Call Close() to release resources associated with this Client.
 func (c *GrpcClient) Close() error {
 	// We cancel the context in case the connection is still being formed...
@@ -47,36 +259,438 @@ func (c *GrpcClient) Close() error {
 }
 
 func (c *GrpcClient) Verify(ctx context.Context, id, passwd string) (*VerifyResult, error) {
+	// Each one-time code can only be used once, so a verify with one is never answered from, or
+	// stored in, the cache
+	otp := otpFromContext(ctx)
+
 	// Check the cache to see if we have this id/passwd combo already there
 	// If we do, return it so we don't contact the auth service twice
 	cacheKey := c.cache.Key(fmt.Sprintf("%s:%s", id, passwd))
-	if v, ok := c.cache.Get(cacheKey); ok {
-		return v, nil
+	// Results are kept in a group for the user, so they can be forgotten when the password or
+	// status changes. The generation is read first, so a result from before a change isn't
+	// put back after it.
+	group := c.cache.Key(id)
+	generation := c.cache.Generation(group)
+	if otp == "" {
+		if v, ok := c.cache.Get(cacheKey); ok {
+			c.cacheHits.Inc()
+			return v, nil
+		}
+		c.cacheMisses.Inc()
 	}
 
 	// Call the auth service to check the id/password we've been given
 	res, err := c.aC.Verify(ctx, &pb.VerifyRequest{
 		Id:       id,
 		Password: passwd,
+		Source:   sourceFromContext(ctx),
+		Otp:      otp,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to verify: %w", err)
 	}
 
 	// Looking good: turn this gRPC result into our output type
+	vR := verifyResult(res)
+
+	// Remember this verify result for next time, unless it only applies until the wait is over
+	if otp == "" && vR.Reason != ReasonTooManyAttempts {
+		c.cache.PutIn(group, generation, cacheKey, vR)
+	}
+	return vR, nil
+}
+
+func (c *GrpcClient) IssueToken(ctx context.Context, id, passwd string) (*TokenResult, error) {
+	res, err := c.aC.IssueToken(ctx, &pb.IssueTokenRequest{
+		Id:       id,
+		Password: passwd,
+		Source:   sourceFromContext(ctx),
+		Otp:      otpFromContext(ctx),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue token: %w", err)
+	}
+	return tokenResult(res), nil
+}
+
+func (c *GrpcClient) RefreshToken(ctx context.Context, refreshToken string) (*TokenResult, error) {
+	res, err := c.aC.RefreshToken(ctx, &pb.RefreshTokenRequest{
+		RefreshToken: refreshToken,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh token: %w", err)
+	}
+	return tokenResult(res), nil
+}
+
+func (c *GrpcClient) RevokeToken(ctx context.Context, refreshToken string) error {
+	_, err := c.aC.RevokeToken(ctx, &pb.RevokeTokenRequest{
+		RefreshToken: refreshToken,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+	return nil
+}
+
+// VerifyToken results aren't cached: access tokens are cheap to check, and a cached result would
+// outlive the session being revoked
+func (c *GrpcClient) VerifyToken(ctx context.Context, accessToken string) (*VerifyResult, error) {
+	res, err := c.aC.VerifyToken(ctx, &pb.VerifyTokenRequest{
+		AccessToken: accessToken,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify token: %w", err)
+	}
+	return verifyResult(res), nil
+}
+
+// Send the admin token with an RPC, for the RPCs that need it
+func adminContext(ctx context.Context, adminToken string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+adminToken)
+}
+
+// Send the service token, if there is one, with an RPC
+func (c *GrpcClient) serviceContext(ctx context.Context) context.Context {
+	if c.serviceToken == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+c.serviceToken)
+}
+
+// Unlock forgets the failed attempts of a user, a source, or both, ending any backoff or lockout.
+// adminToken must match the auth service's admin token. It isn't part of Client, as services
+// don't unlock users.
+func (c *GrpcClient) Unlock(ctx context.Context, adminToken, id, source string) error {
+	_, err := c.aC.Unlock(adminContext(ctx, adminToken), &pb.UnlockRequest{
+		Id:     id,
+		Source: source,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to unlock: %w", err)
+	}
+	return nil
+}
+
+// The user methods manage accounts. Like Unlock they need the admin token, and aren't part of
+// Client. Errors wrap ErrInvalidArgument if a password, status or role isn't allowed, and
+// ErrNotFound if there's no such user.
+
+// CreateUser makes a user. An empty status means StatusActive, and no roles means RoleUser.
+func (c *GrpcClient) CreateUser(ctx context.Context, adminToken, passwd, accountStatus string, roles []string) (*User, error) {
+	res, err := c.aC.CreateUser(adminContext(ctx, adminToken), &pb.CreateUserRequest{
+		Password: passwd,
+		Status:   accountStatus,
+		Roles:    roles,
+	})
+	if err != nil {
+		return nil, rpcError("failed to create user", err)
+	}
+	return user(res), nil
+}
+
+func (c *GrpcClient) GetUser(ctx context.Context, adminToken, id string) (*User, error) {
+	res, err := c.aC.GetUser(adminContext(ctx, adminToken), &pb.GetUserRequest{
+		Id: id,
+	})
+	if err != nil {
+		return nil, rpcError("failed to get user", err)
+	}
+	return user(res), nil
+}
+
+func (c *GrpcClient) UpdateUserStatus(ctx context.Context, adminToken, id, accountStatus string) (*User, error) {
+	res, err := c.aC.UpdateUserStatus(adminContext(ctx, adminToken), &pb.UpdateUserStatusRequest{
+		Id:     id,
+		Status: accountStatus,
+	})
+	if err != nil {
+		return nil, rpcError("failed to update user status", err)
+	}
+	c.forget(id)
+	return user(res), nil
+}
+
+// SetPassword replaces a user's password without needing the current one, and ends their
+// sessions
+func (c *GrpcClient) SetPassword(ctx context.Context, adminToken, id, passwd string) error {
+	_, err := c.aC.ChangePassword(adminContext(ctx, adminToken), &pb.ChangePasswordRequest{
+		Id:          id,
+		NewPassword: passwd,
+	})
+	if err != nil {
+		return rpcError("failed to set password", err)
+	}
+	c.forget(id)
+	return nil
+}
+
+func (c *GrpcClient) DeleteUser(ctx context.Context, adminToken, id string) error {
+	_, err := c.aC.DeleteUser(adminContext(ctx, adminToken), &pb.DeleteUserRequest{
+		Id: id,
+	})
+	if err != nil {
+		return rpcError("failed to delete user", err)
+	}
+	c.forget(id)
+	return nil
+}
+
+// ListUsers lists up to limit users with ids after the given one, in id order. Zero means the
+// service's default limit. next is the after for the next page, or empty if this is the last.
+func (c *GrpcClient) ListUsers(ctx context.Context, adminToken string, limit int, after string) (users []User, next string, err error) {
+	res, err := c.aC.ListUsers(adminContext(ctx, adminToken), &pb.ListUsersRequest{
+		Limit: int32(limit),
+		After: after,
+	})
+	if err != nil {
+		return nil, "", rpcError("failed to list users", err)
+	}
+	users = make([]User, 0, len(res.Users))
+	for _, u := range res.Users {
+		users = append(users, *user(u))
+	}
+	return users, res.NextAfter, nil
+}
+
+func (c *GrpcClient) CreateApiKey(ctx context.Context, userId, name string, scopes []string) (*NewApiKey, error) {
+	res, err := c.aC.CreateApiKey(c.serviceContext(ctx), &pb.CreateApiKeyRequest{
+		UserId: userId,
+		Name:   name,
+		Scopes: scopes,
+	})
+	if err != nil {
+		return nil, rpcError("failed to create api key", err)
+	}
+	return &NewApiKey{ApiKey: apiKey(res.ApiKey), Key: res.Key}, nil
+}
+
+func (c *GrpcClient) ListApiKeys(ctx context.Context, userId string) ([]ApiKey, error) {
+	res, err := c.aC.ListApiKeys(c.serviceContext(ctx), &pb.ListApiKeysRequest{
+		UserId: userId,
+	})
+	if err != nil {
+		return nil, rpcError("failed to list api keys", err)
+	}
+	keys := make([]ApiKey, 0, len(res.ApiKeys))
+	for _, k := range res.ApiKeys {
+		keys = append(keys, apiKey(k))
+	}
+	return keys, nil
+}
+
+func (c *GrpcClient) RevokeApiKey(ctx context.Context, userId, id string) error {
+	_, err := c.aC.RevokeApiKey(c.serviceContext(ctx), &pb.RevokeApiKeyRequest{
+		UserId: userId,
+		Id:     id,
+	})
+	if err != nil {
+		return rpcError("failed to revoke api key", err)
+	}
+	return nil
+}
+
+// VerifyApiKey results aren't cached, so that revoking a key takes effect straight away
+func (c *GrpcClient) VerifyApiKey(ctx context.Context, key string) (*VerifyResult, error) {
+	res, err := c.aC.VerifyApiKey(ctx, &pb.VerifyApiKeyRequest{
+		Key: key,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify api key: %w", err)
+	}
+	return verifyResult(res), nil
+}
+
+func (c *GrpcClient) EnrolTotp(ctx context.Context, userId string) (*TotpEnrolment, error) {
+	res, err := c.aC.EnrolTotp(c.serviceContext(ctx), &pb.EnrolTotpRequest{
+		UserId: userId,
+	})
+	if err != nil {
+		return nil, rpcError("failed to enrol totp", err)
+	}
+	return &TotpEnrolment{Secret: res.Secret, URI: res.Uri}, nil
+}
+
+func (c *GrpcClient) ConfirmTotp(ctx context.Context, userId, code string) ([]string, error) {
+	res, err := c.aC.ConfirmTotp(c.serviceContext(ctx), &pb.ConfirmTotpRequest{
+		UserId: userId,
+		Code:   code,
+	})
+	if err != nil {
+		return nil, rpcError("failed to confirm totp", err)
+	}
+	// A cached ALLOW was for the password alone, which is no longer enough
+	c.forget(userId)
+	return res.RecoveryCodes, nil
+}
+
+func (c *GrpcClient) DisableTotp(ctx context.Context, userId, code string) error {
+	_, err := c.aC.DisableTotp(c.serviceContext(ctx), &pb.DisableTotpRequest{
+		UserId: userId,
+		Code:   code,
+	})
+	if err != nil {
+		return rpcError("failed to disable totp", err)
+	}
+	// Likewise a cached DENY for a missing code
+	c.forget(userId)
+	return nil
+}
+
+func (c *GrpcClient) ChangePassword(ctx context.Context, userId, currentPasswd, newPasswd string) error {
+	_, err := c.aC.ChangePassword(ctx, &pb.ChangePasswordRequest{
+		Id:              userId,
+		CurrentPassword: currentPasswd,
+		NewPassword:     newPasswd,
+		Source:          sourceFromContext(ctx),
+	})
+	if err != nil {
+		return rpcError("failed to change password", err)
+	}
+	c.forget(userId)
+	return nil
+}
+
+func (c *GrpcClient) DeactivateAccount(ctx context.Context, userId, currentPasswd string) error {
+	_, err := c.aC.DeactivateAccount(ctx, &pb.DeactivateAccountRequest{
+		Id:              userId,
+		CurrentPassword: currentPasswd,
+		Source:          sourceFromContext(ctx),
+	})
+	if err != nil {
+		return rpcError("failed to deactivate account", err)
+	}
+	c.forget(userId)
+	return nil
+}
+
+func (c *GrpcClient) ListLoginHistory(ctx context.Context, userId string, limit int) ([]LoginEvent, error) {
+	res, err := c.aC.ListLoginHistory(c.serviceContext(ctx), &pb.ListLoginHistoryRequest{
+		UserId: userId,
+		Limit:  int32(limit),
+	})
+	if err != nil {
+		return nil, rpcError("failed to list login history", err)
+	}
+	events := make([]LoginEvent, 0, len(res.Events))
+	for _, e := range res.Events {
+		events = append(events, LoginEvent{
+			Time:   time.Unix(e.Time, 0).UTC(),
+			Source: e.Source,
+			State:  pb.State_name[int32(e.State)],
+			Reason: pb.Reason_name[int32(e.Reason)],
+		})
+	}
+	return events, nil
+}
+
+// Forget the cached Verify results of a user whose password, status or TOTP has changed. Other
+// clients, in other processes, keep theirs until they expire.
+func (c *GrpcClient) forget(userId string) {
+	c.cache.DeleteGroup(c.cache.Key(userId))
+}
+
+// Turn a gRPC verify result into our output type
+func verifyResult(res *pb.VerifyResponse) *VerifyResult {
 	vR := &VerifyResult{
-		State: pb.State_name[int32(res.State)],
+		State:      pb.State_name[int32(res.State)],
+		Id:         res.Id,
+		Reason:     pb.Reason_name[int32(res.Reason)],
+		RetryAfter: time.Duration(res.RetryAfter) * time.Second,
+		Scopes:     res.Scopes,
+		Roles:      res.Roles,
+		SessionId:  res.SessionId,
+	}
+	if res.AuthMethod != pb.AuthMethod_UNKNOWN_METHOD {
+		vR.AuthMethod = pb.AuthMethod_name[int32(res.AuthMethod)]
 	}
+	return vR
+}
 
-	// Remember this verify result for next time
-	c.cache.Put(cacheKey, vR)
-	return vR, nil
+func apiKey(k *pb.ApiKey) ApiKey {
+	return ApiKey{
+		Id:      k.Id,
+		Name:    k.Name,
+		Scopes:  k.Scopes,
+		Prefix:  k.Prefix,
+		Created: time.Unix(k.Created, 0).UTC(),
+	}
+}
+
+func user(u *pb.User) *User {
+	return &User{
+		Id:       u.Id,
+		Status:   u.Status,
+		Roles:    u.Roles,
+		Created:  time.Unix(u.Created, 0).UTC(),
+		Modified: time.Unix(u.Modified, 0).UTC(),
+	}
+}
+
+// Wrap an RPC error, turning the gRPC codes that callers act on into ErrInvalidArgument,
+// ErrNotFound, ErrFailedPrecondition, ErrTooManyAttempts and ErrPermissionDenied
+func rpcError(msg string, err error) error {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return fmt.Errorf("%s: %w: %s", msg, ErrInvalidArgument, status.Convert(err).Message())
+	case codes.NotFound:
+		return fmt.Errorf("%s: %w: %s", msg, ErrNotFound, status.Convert(err).Message())
+	case codes.FailedPrecondition:
+		return fmt.Errorf("%s: %w: %s", msg, ErrFailedPrecondition, status.Convert(err).Message())
+	case codes.ResourceExhausted:
+		return fmt.Errorf("%s: %w: %s", msg, ErrTooManyAttempts, status.Convert(err).Message())
+	case codes.PermissionDenied:
+		return fmt.Errorf("%s: %w: %s", msg, ErrPermissionDenied, status.Convert(err).Message())
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+func tokenResult(res *pb.TokenResponse) *TokenResult {
+	return &TokenResult{
+		State:        pb.State_name[int32(res.State)],
+		Reason:       pb.Reason_name[int32(res.Reason)],
+		AccessToken:  res.AccessToken,
+		RefreshToken: res.RefreshToken,
+		ExpiresIn:    time.Duration(res.ExpiresIn) * time.Second,
+		RetryAfter:   time.Duration(res.RetryAfter) * time.Second,
+	}
+}
+
+// Check asks the auth service, with the standard gRPC health check, whether it is serving
+func (c *GrpcClient) Check(ctx context.Context) error {
+	res, err := c.hC.Check(ctx, &healthpb.HealthCheckRequest{
+		Service: pb.Auth_ServiceDesc.ServiceName,
+	})
+	if err != nil {
+		return fmt.Errorf("auth: health check failed (connection %s): %w", c.conn.GetState(), err)
+	}
+	if res.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("auth: %s", res.Status)
+	}
+	return nil
+}
+
+// The client is a prometheus.Collector for its cache metrics, so that the service using it can
+// register it:
+//
+//	auth_client_cache_hits_total    -- Verify calls answered from the cache
+//	auth_client_cache_misses_total  -- Verify calls that went to the auth service
+func (c *GrpcClient) Describe(ch chan<- *prometheus.Desc) {
+	c.cacheHits.Describe(ch)
+	c.cacheMisses.Describe(ch)
+}
+
+func (c *GrpcClient) Collect(ch chan<- prometheus.Metric) {
+	c.cacheHits.Collect(ch)
+	c.cacheMisses.Collect(ch)
 }
 
 func defaultOpts() []grpc.DialOption {
 	return []grpc.DialOption{
 		// TODO: insecure connection should move to TLS
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		// Send the trace context with each RPC, so the auth service's spans join the caller's trace
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
 	}
 }
 
@@ -94,22 +708,156 @@ func newClientWithOpts(ctx context.Context, target string, opts ...grpc.DialOpti
 		conn:   conn,
 		cancel: cancel,
 		aC:     pb.NewAuthClient(conn),
-		cache:  cache.New[VerifyResult](),
+		hC:     healthpb.NewHealthClient(conn),
+		cache:  cache.New[VerifyResult](verifyCacheTTL),
+		cacheHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "auth_client",
+			Name:      "cache_hits_total",
+			Help:      "Verify calls answered from the cache.",
+		}),
+		cacheMisses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "auth_client",
+			Name:      "cache_misses_total",
+			Help:      "Verify calls that went to the auth service.",
+		}),
 	}, nil
 }
 
-// Use this in tests to Mock out the client
+// Use this in tests to Mock out the client. It has no rules of its own, so tests of the api
+// check the api, and the rules are tested against the auth service in this package. Verify,
+// VerifyToken and VerifyApiKey return the result, IssueToken and RefreshToken deny, and every
+// other call returns zero values, unless responses are set for the method with On. Each call is
+// recorded, for Calls.
 type MockClient struct {
 	result *VerifyResult
+
+	mu        sync.Mutex
+	responses map[string][]mockResponse
+	calls     []MockCall
+}
+
+type mockResponse struct {
+	value interface{}
+	err   error
+}
+
+// MockCall is a call made to a MockClient
+type MockCall struct {
+	Method string
+	// The arguments after the context
+	Args []interface{}
+	// What NewSourceContext and NewOtpContext put in the context
+	Source string
+	Otp    string
 }
 
 func NewMockClient(result *VerifyResult) *MockClient {
 	return &MockClient{
-		result: result,
+		result:    result,
+		responses: map[string][]mockResponse{},
+	}
+}
+
+// On adds a response to the calls to method, like "IssueToken", to return. Responses are used
+// in the order they're added, and the last one is kept for any calls after that. value must have
+// the type the method returns, like *TokenResult, or be nil.
+func (ac *MockClient) On(method string, value interface{}, err error) *MockClient {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.responses[method] = append(ac.responses[method], mockResponse{value: value, err: err})
+	return ac
+}
+
+// Calls returns the calls made to method, oldest first
+func (ac *MockClient) Calls(method string) []MockCall {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	var calls []MockCall
+	for _, call := range ac.calls {
+		if call.Method == method {
+			calls = append(calls, call)
+		}
 	}
+	return calls
 }
 
-func (ac *MockClient) Close() error { return nil }
+// Record a call, and return the next response set for it, or def if there isn't one
+func mockCall[T any](ac *MockClient, ctx context.Context, method string, def T, args ...interface{}) (T, error) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.calls = append(ac.calls, MockCall{
+		Method: method,
+		Args:   args,
+		Source: sourceFromContext(ctx),
+		Otp:    otpFromContext(ctx),
+	})
+	responses := ac.responses[method]
+	if len(responses) == 0 {
+		return def, nil
+	}
+	res := responses[0]
+	if len(responses) > 1 {
+		ac.responses[method] = responses[1:]
+	}
+	var value T
+	if res.value != nil {
+		var ok bool
+		if value, ok = res.value.(T); !ok {
+			panic(fmt.Sprintf("auth: MockClient.On(%q) value is %T, want %T", method, res.value, value))
+		}
+	}
+	return value, res.err
+}
+
+func (ac *MockClient) Close() error                    { return nil }
+func (ac *MockClient) Check(ctx context.Context) error { return nil }
 func (ac *MockClient) Verify(ctx context.Context, id, passwd string) (*VerifyResult, error) {
-	return ac.result, nil
+	return mockCall(ac, ctx, "Verify", ac.result, id, passwd)
+}
+func (ac *MockClient) IssueToken(ctx context.Context, id, passwd string) (*TokenResult, error) {
+	return mockCall(ac, ctx, "IssueToken", &TokenResult{State: StateDeny}, id, passwd)
+}
+func (ac *MockClient) RefreshToken(ctx context.Context, refreshToken string) (*TokenResult, error) {
+	return mockCall(ac, ctx, "RefreshToken", &TokenResult{State: StateDeny}, refreshToken)
+}
+func (ac *MockClient) RevokeToken(ctx context.Context, refreshToken string) error {
+	_, err := mockCall[any](ac, ctx, "RevokeToken", nil, refreshToken)
+	return err
+}
+func (ac *MockClient) VerifyToken(ctx context.Context, accessToken string) (*VerifyResult, error) {
+	return mockCall(ac, ctx, "VerifyToken", ac.result, accessToken)
+}
+func (ac *MockClient) CreateApiKey(ctx context.Context, userId, name string, scopes []string) (*NewApiKey, error) {
+	return mockCall[*NewApiKey](ac, ctx, "CreateApiKey", nil, userId, name, scopes)
+}
+func (ac *MockClient) ListApiKeys(ctx context.Context, userId string) ([]ApiKey, error) {
+	return mockCall[[]ApiKey](ac, ctx, "ListApiKeys", nil, userId)
+}
+func (ac *MockClient) RevokeApiKey(ctx context.Context, userId, id string) error {
+	_, err := mockCall[any](ac, ctx, "RevokeApiKey", nil, userId, id)
+	return err
+}
+func (ac *MockClient) VerifyApiKey(ctx context.Context, key string) (*VerifyResult, error) {
+	return mockCall(ac, ctx, "VerifyApiKey", ac.result, key)
+}
+func (ac *MockClient) EnrolTotp(ctx context.Context, userId string) (*TotpEnrolment, error) {
+	return mockCall[*TotpEnrolment](ac, ctx, "EnrolTotp", nil, userId)
+}
+func (ac *MockClient) ConfirmTotp(ctx context.Context, userId, code string) ([]string, error) {
+	return mockCall[[]string](ac, ctx, "ConfirmTotp", nil, userId, code)
+}
+func (ac *MockClient) DisableTotp(ctx context.Context, userId, code string) error {
+	_, err := mockCall[any](ac, ctx, "DisableTotp", nil, userId, code)
+	return err
+}
+func (ac *MockClient) ChangePassword(ctx context.Context, userId, currentPasswd, newPasswd string) error {
+	_, err := mockCall[any](ac, ctx, "ChangePassword", nil, userId, currentPasswd, newPasswd)
+	return err
+}
+func (ac *MockClient) DeactivateAccount(ctx context.Context, userId, currentPasswd string) error {
+	_, err := mockCall[any](ac, ctx, "DeactivateAccount", nil, userId, currentPasswd)
+	return err
+}
+func (ac *MockClient) ListLoginHistory(ctx context.Context, userId string, limit int) ([]LoginEvent, error) {
+	return mockCall[[]LoginEvent](ac, ctx, "ListLoginHistory", nil, userId, limit)
 }
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net"
 	"sync"
@@ -9,7 +10,12 @@ import (
 	"time"
 
 	pb "github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/service"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 )
 
 // Internal grpcAuthService struct that implements the gRPC server interface
@@ -21,6 +27,8 @@ type mockGrpcAuthService struct {
 	err    error
 
 	Calls int
+	// The most recent request
+	Last *pb.VerifyRequest
 }
 
 func newMockGrpcService(result *pb.VerifyResponse, err error) *mockGrpcAuthService {
@@ -33,9 +41,20 @@ func newMockGrpcService(result *pb.VerifyResponse, err error) *mockGrpcAuthServi
 // Verify checks a Input for authentication validity
 func (as *mockGrpcAuthService) Verify(ctx context.Context, in *pb.VerifyRequest) (*pb.VerifyResponse, error) {
 	as.Calls += 1
+	as.Last = in
 	return as.result, as.err
 }
 
+// ChangePassword always succeeds
+func (as *mockGrpcAuthService) ChangePassword(ctx context.Context, in *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error) {
+	return &pb.ChangePasswordResponse{}, nil
+}
+
+// ConfirmTotp always succeeds
+func (as *mockGrpcAuthService) ConfirmTotp(ctx context.Context, in *pb.ConfirmTotpRequest) (*pb.ConfirmTotpResponse, error) {
+	return &pb.ConfirmTotpResponse{RecoveryCodes: []string{"AAAA-BBBB-CCCC-DDDD"}}, nil
+}
+
 func TestClientCreate(t *testing.T) {
 	config := Config{
 		Port: 8010,
@@ -286,8 +305,253 @@ func TestClientVerifyCacheResult(t *testing.T) {
 		t.Fatalf("verify did not cache result: %d calls to service, expected 1", mockService.Calls)
 	}
 
+	if hits, misses := testutil.ToFloat64(client.cacheHits), testutil.ToFloat64(client.cacheMisses); hits != 1 || misses != 1 {
+		done()
+		t.Fatalf("cache metrics: expected 1 hit and 1 miss, got %v and %v", hits, misses)
+	}
+
 	done()
 	if runErr != nil && runErr != grpc.ErrServerStopped {
 		t.Fatal(runErr)
 	}
 }
+
+func TestClientCheck(t *testing.T) {
+	listen := "localhost:8010"
+	lis, err := net.Listen("tcp", listen)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	grpcServer := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		grpcServer.Serve(lis)
+	}()
+	defer func() {
+		grpcServer.GracefulStop()
+		wg.Wait()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	client, err := NewClient(ctx, listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	healthServer.SetServingStatus(pb.Auth_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_NOT_SERVING)
+	if err := client.Check(ctx); err == nil {
+		t.Fatal("expected an error while the service is not serving")
+	}
+
+	healthServer.SetServingStatus(pb.Auth_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	if err := client.Check(ctx); err != nil {
+		t.Fatalf("expected no error while the service is serving, got %v", err)
+	}
+}
+
+func TestClientVerifyTooManyAttempts(t *testing.T) {
+	listen := "localhost:8010"
+	lis, err := net.Listen("tcp", listen)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	mockService := newMockGrpcService(&pb.VerifyResponse{
+		State:      pb.State_DENY,
+		Reason:     pb.Reason_TOO_MANY_ATTEMPTS,
+		RetryAfter: 30,
+	}, nil)
+
+	grpcServer := grpc.NewServer()
+	pb.RegisterAuthServer(grpcServer, mockService)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		grpcServer.Serve(lis)
+	}()
+	defer func() {
+		grpcServer.GracefulStop()
+		wg.Wait()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	client, err := NewClient(ctx, listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx = NewSourceContext(ctx, "192.0.2.1")
+	for i := 0; i < 2; i++ {
+		res, err := client.Verify(ctx, "example", "example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Reason != ReasonTooManyAttempts || res.RetryAfter != 30*time.Second {
+			t.Fatalf("expected %s with a 30s wait, got %s and %v", ReasonTooManyAttempts, res.Reason, res.RetryAfter)
+		}
+	}
+
+	// The wait will end, so the result isn't cached
+	if mockService.Calls != 2 {
+		t.Fatalf("expected 2 calls to the service, got %d", mockService.Calls)
+	}
+	if mockService.Last.Source != "192.0.2.1" {
+		t.Fatalf("expected the source to be sent, got %q", mockService.Last.Source)
+	}
+}
+
+func TestClientVerifyOtp(t *testing.T) {
+	listen := "localhost:8010"
+	lis, err := net.Listen("tcp", listen)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	mockService := newMockGrpcService(&pb.VerifyResponse{State: pb.State_ALLOW, Id: "example"}, nil)
+
+	grpcServer := grpc.NewServer()
+	pb.RegisterAuthServer(grpcServer, mockService)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		grpcServer.Serve(lis)
+	}()
+	defer func() {
+		grpcServer.GracefulStop()
+		wg.Wait()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	client, err := NewClient(ctx, listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx = NewOtpContext(ctx, "123456")
+	for i := 0; i < 2; i++ {
+		if _, err := client.Verify(ctx, "example", "example"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A one-time code can't be reused, so the result isn't cached
+	if mockService.Calls != 2 {
+		t.Fatalf("expected 2 calls to the service, got %d", mockService.Calls)
+	}
+	if mockService.Last.Otp != "123456" {
+		t.Fatalf("expected the otp to be sent, got %q", mockService.Last.Otp)
+	}
+}
+
+func TestClientForgetsCache(t *testing.T) {
+	changes := map[string]func(ctx context.Context, client *GrpcClient) error{
+		// The old password has to be checked again once it's changed
+		"change password": func(ctx context.Context, client *GrpcClient) error {
+			return client.ChangePassword(ctx, "example", "old-password", "new-password")
+		},
+		// And the password alone stops being enough once TOTP is turned on
+		"confirm totp": func(ctx context.Context, client *GrpcClient) error {
+			_, err := client.ConfirmTotp(ctx, "example", "123456")
+			return err
+		},
+	}
+	for name, change := range changes {
+		t.Run(name, func(t *testing.T) {
+			testClientForgetsCache(t, change)
+		})
+	}
+}
+
+func testClientForgetsCache(t *testing.T, change func(ctx context.Context, client *GrpcClient) error) {
+	listen := "localhost:8010"
+	lis, err := net.Listen("tcp", listen)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	mockService := newMockGrpcService(&pb.VerifyResponse{State: pb.State_ALLOW, Id: "example"}, nil)
+
+	grpcServer := grpc.NewServer()
+	pb.RegisterAuthServer(grpcServer, mockService)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		grpcServer.Serve(lis)
+	}()
+	defer func() {
+		grpcServer.GracefulStop()
+		wg.Wait()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	client, err := NewClient(ctx, listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.Verify(ctx, "example", "old-password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mockService.Calls != 1 {
+		t.Fatalf("expected the second verify to be cached, got %d calls", mockService.Calls)
+	}
+
+	if err := change(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Verify(ctx, "example", "old-password"); err != nil {
+		t.Fatal(err)
+	}
+	if mockService.Calls != 2 {
+		t.Fatalf("expected the cached result to be forgotten, got %d calls", mockService.Calls)
+	}
+}
+
+func TestClientRpcError(t *testing.T) {
+	err := rpcError("failed to revoke api key", status.Error(codes.NotFound, "revoke api key: no such key"))
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	err = rpcError("failed to create api key", status.Error(codes.InvalidArgument, "create api key: bad scope"))
+	if !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expected ErrInvalidArgument, got %v", err)
+	}
+	err = rpcError("failed to enrol totp", status.Error(codes.FailedPrecondition, "enrol totp: already enrolled"))
+	if !errors.Is(err, ErrFailedPrecondition) {
+		t.Fatalf("expected ErrFailedPrecondition, got %v", err)
+	}
+	err = rpcError("failed to disable totp", status.Error(codes.ResourceExhausted, "disable totp: too many attempts"))
+	if !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("expected ErrTooManyAttempts, got %v", err)
+	}
+	err = rpcError("failed to create user", status.Error(codes.PermissionDenied, "create user: admin token required"))
+	if !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("expected ErrPermissionDenied, got %v", err)
+	}
+	err = rpcError("failed to list api keys", status.Error(codes.Unavailable, "down"))
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrInvalidArgument) || status.Code(errors.Unwrap(err)) != codes.Unavailable {
+		t.Fatalf("expected the error to be wrapped as it was, got %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/password"
+	pb "github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/service"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v2"
+	"google.golang.org/grpc/metadata"
+)
+
+// A password policy that the test hashes, bcrypt at cost 10, already meet
+var testPasswordPolicy = password.Policy{Algorithm: password.AlgorithmBcrypt, BcryptCost: 10}
+
+// "banana", in bcrypt
+const bananaHash = "$2y$10$O8VPlcAPa/iKHrkdyzN1cu7TvF5Goq6nRjSdaz9uXm1zPcVgRxQnK"
+
+const testTotpSecret = "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+
+var testLockout = Lockout{
+	BackoffAfter:       3,
+	BackoffBase:        time.Second,
+	BackoffMax:         4 * time.Second,
+	UserLockoutAfter:   6,
+	SourceLockoutAfter: 8,
+	LockoutDuration:    time.Minute,
+}
+
+// A service with a mock database and a clock that only moves when the test says so
+func newMockDbService(t *testing.T) (*grpcAuthService, pgxmock.PgxPoolIface, *time.Time) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	t.Cleanup(mock.Close)
+
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	as := newGrpcService(Config{
+		TokenSecret:  "test-secret-which-is-long-enough",
+		Password:     testPasswordPolicy,
+		ServiceToken: "service-token",
+	})
+	as.tokens.now = func() time.Time { return now }
+	as.throttle.now = func() time.Time { return now }
+	as.pool = mock
+	return as, mock, &now
+}
+
+// A service that knows the admin token, and a context that sends it
+func newMockAdminService(t *testing.T) (*grpcAuthService, pgxmock.PgxPoolIface, *time.Time, context.Context) {
+	as, mock, now := newMockDbService(t)
+	as.adminToken = "admin-token"
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer admin-token"))
+	return as, mock, now, ctx
+}
+
+// The context of an RPC from the api, for the RPCs that act for a user
+var serviceCtx = metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer service-token"))
+
+func userRows(mock pgxmock.PgxPoolIface, now time.Time, id, accountStatus string, roles ...string) *pgxmock.Rows {
+	return mock.NewRows([]string{"id", "status", "roles", "created", "modified"}).
+		AddRow(id, accountStatus, roles, now, now)
+}
+
+// Expect the lookup of a user when their password is checked. An empty hash means there's no such user.
+func expectUser(mock pgxmock.PgxPoolIface, id, hash, accountStatus string) {
+	q := mock.ExpectQuery("^SELECT id, password, status, roles FROM public.user WHERE id = \\$1$").
+		WithArgs(id)
+	if hash == "" {
+		q.WillReturnError(pgx.ErrNoRows)
+		return
+	}
+	q.WillReturnRows(mock.NewRows([]string{"id", "password", "status", "roles"}).
+		AddRow(id, hash, accountStatus, []string{"user"}))
+}
+
+// Expect the lookup of a user's second factor, made once the password is right
+func expectTotp(mock pgxmock.PgxPoolIface, id, secret string) {
+	q := mock.ExpectQuery("^SELECT secret FROM public.user_totp WHERE user_id = \\$1 AND confirmed_at IS NOT NULL$").
+		WithArgs(id)
+	if secret == "" {
+		q.WillReturnError(pgx.ErrNoRows)
+		return
+	}
+	q.WillReturnRows(mock.NewRows([]string{"secret"}).AddRow(secret))
+}
+
+// Expect a user without a second factor
+func expectNoTotp(mock pgxmock.PgxPoolIface, id string) {
+	expectTotp(mock, id, "")
+}
+
+// Expect the check of a user's current password, which is "banana"
+func expectCurrentPassword(mock pgxmock.PgxPoolIface, id, accountStatus string) {
+	mock.ExpectQuery("^SELECT password, status FROM public.user WHERE id = \\$1$").
+		WithArgs(id).
+		WillReturnRows(mock.NewRows([]string{"password", "status"}).AddRow(bananaHash, accountStatus))
+}
+
+// Expect a password change. Users changing their own password must be active, which is passed
+// as the extra argument.
+func expectChange(mock pgxmock.PgxPoolIface, now time.Time, id string, changed int, active ...interface{}) {
+	args := append([]interface{}{pgxmock.AnyArg(), id, now}, active...)
+	mock.ExpectQuery("^WITH changed AS \\(UPDATE public.user SET password = \\$1 WHERE id = \\$2( AND status = \\$4)? RETURNING id\\), (.+) SELECT count\\(\\*\\) FROM changed$").
+		WithArgs(args...).
+		WillReturnRows(mock.NewRows([]string{"count"}).AddRow(changed))
+}
+
+// Expect a check of a user's password to have been queued for their login history
+func expectLogin(t *testing.T, as *grpcAuthService, id, source string, state pb.State, reason pb.Reason) {
+	t.Helper()
+	select {
+	case e := <-as.logins:
+		if e.userId != id || e.source != source || e.state != state.String() || e.reason != reason.String() {
+			t.Fatalf("expected a %v %v login for %s from %q, got %+v", state, reason, id, source, e)
+		}
+	default:
+		t.Fatalf("expected a login for %s to be queued", id)
+	}
+}
+
+// Expect nothing to have been queued for the login history
+func expectNoLogin(t *testing.T, as *grpcAuthService) {
+	t.Helper()
+	select {
+	case e := <-as.logins:
+		t.Fatalf("expected no login to be queued, got %+v", e)
+	default:
+	}
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	pb "github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/service"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A user's login history is every check of their password by Verify, kept in public.login_event
+// with the client IP and the outcome. Wrong passwords and codes are there too, so a user can see
+// someone trying to get into their account. Throttled attempts and unknown ids aren't: the first
+// never get as far as the password, and the second have no user to record them for.
+//
+// The api caches Verify results, so a user logging in with Basic auth over and over is only
+// recorded when the cached result is missing.
+//
+// Logins are queued and written in the background by writeLogins, rather than while Verify
+// waits: only real users have logins to write, so a write on the way would make a wrong password
+// slower to deny than an unknown id, and the timing would say which ids exist. If the queue is
+// full, logins are dropped. Logins older than Config.LoginHistoryRetention are purged.
+
+// Page sizes for ListLoginHistory
+const (
+	defaultLoginHistoryLimit = 20
+	// The most logins that can be listed at once
+	MaxLoginHistoryLimit = 100
+)
+
+// How long logins are kept, unless configured otherwise
+const DefaultLoginHistoryRetention = 90 * 24 * time.Hour
+
+const (
+	// Logins waiting to be written
+	loginQueueSize = 1000
+	// How often old logins are purged
+	loginPurgeInterval = time.Hour
+	// How long queued logins have to be written when the service stops
+	loginDrainTimeout = 5 * time.Second
+)
+
+// A login waiting to be written
+type loginEvent struct {
+	userId  string
+	source  string
+	state   string
+	reason  string
+	created time.Time
+}
+
+// Queue the outcome of checking a user's password, to be written by writeLogins
+func (as *grpcAuthService) recordLogin(userId, source string, res *pb.VerifyResponse) {
+	select {
+	case as.logins <- loginEvent{
+		userId:  userId,
+		source:  source,
+		state:   res.State.String(),
+		reason:  res.Reason.String(),
+		created: as.tokens.now(),
+	}:
+	default:
+		log.Printf("verify: id %v, login history queue full, dropping\n", userId)
+	}
+}
+
+// Write queued logins, and purge old ones every loginPurgeInterval, until ctx is done. Logins
+// still queued then are written before it returns, so call it once the server has stopped
+// taking RPCs.
+func (as *grpcAuthService) writeLogins(ctx context.Context, retention time.Duration) {
+	ticker := time.NewTicker(loginPurgeInterval)
+	defer ticker.Stop()
+	as.purgeLogins(ctx, retention)
+	for {
+		select {
+		case e := <-as.logins:
+			as.writeLogin(ctx, e)
+		case <-ticker.C:
+			as.purgeLogins(ctx, retention)
+		case <-ctx.Done():
+			drainCtx, cancel := context.WithTimeout(context.Background(), loginDrainTimeout)
+			defer cancel()
+			for {
+				select {
+				case e := <-as.logins:
+					as.writeLogin(drainCtx, e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Write a login. A failure is logged: the verify it's for has already been answered.
+func (as *grpcAuthService) writeLogin(ctx context.Context, e loginEvent) {
+	_, err := as.pool.Exec(ctx,
+		"INSERT INTO public.login_event (user_id, source, state, reason, created) VALUES ($1, $2, $3, $4, $5)",
+		e.userId, e.source, e.state, e.reason, e.created,
+	)
+	if err != nil {
+		log.Printf("verify: id %v, login history error: %v\n", e.userId, err)
+	}
+}
+
+// Delete logins older than retention
+func (as *grpcAuthService) purgeLogins(ctx context.Context, retention time.Duration) {
+	tag, err := as.pool.Exec(ctx,
+		"DELETE FROM public.login_event WHERE created < $1",
+		as.tokens.now().Add(-retention),
+	)
+	if err != nil {
+		log.Printf("login history: purge error: %v\n", err)
+		return
+	}
+	if n := tag.RowsAffected(); n > 0 {
+		log.Printf("login history: purged %d logins older than %v\n", n, retention)
+	}
+}
+
+// ListLoginHistory lists a user's most recent logins, newest first
+func (as *grpcAuthService) ListLoginHistory(ctx context.Context, in *pb.ListLoginHistoryRequest) (*pb.ListLoginHistoryResponse, error) {
+	if in.UserId == "" {
+		return nil, status.Error(codes.InvalidArgument, "list login history: user_id required")
+	}
+	if err := as.requireService(ctx, "list login history"); err != nil {
+		return nil, err
+	}
+	limit := int(in.Limit)
+	if limit == 0 {
+		limit = defaultLoginHistoryLimit
+	}
+	if limit < 0 || limit > MaxLoginHistoryLimit {
+		return nil, status.Errorf(codes.InvalidArgument, "list login history: limit must be 1 to %d", MaxLoginHistoryLimit)
+	}
+
+	rows, err := as.pool.Query(ctx,
+		`SELECT created, source, state, reason FROM public.login_event
+		WHERE user_id = $1 ORDER BY id DESC LIMIT $2`,
+		in.UserId, limit,
+	)
+	if err != nil {
+		log.Printf("list login history: query error: %v\n", err)
+		return nil, fmt.Errorf("list login history: %w", err)
+	}
+	defer rows.Close()
+
+	res := &pb.ListLoginHistoryResponse{Events: []*pb.LoginEvent{}}
+	for rows.Next() {
+		event := &pb.LoginEvent{}
+		var created time.Time
+		var state, reason string
+		if err := rows.Scan(&created, &event.Source, &state, &reason); err != nil {
+			return nil, fmt.Errorf("list login history: %w", err)
+		}
+		event.Time = created.Unix()
+		event.State = pb.State(pb.State_value[state])
+		event.Reason = pb.Reason(pb.Reason_value[reason])
+		res.Events = append(res.Events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list login history: %w", err)
+	}
+	return res, nil
+}
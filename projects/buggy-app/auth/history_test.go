@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/service"
+	"github.com/pashagolub/pgxmock/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWriteLogins(t *testing.T) {
+	as, mock, now := newMockDbService(t)
+	retention := 24 * time.Hour
+
+	// Old logins are purged when writing starts, and queued ones written
+	mock.ExpectExec("^DELETE FROM public.login_event WHERE created < \\$1$").
+		WithArgs(now.Add(-retention)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 3))
+	mock.ExpectExec("^INSERT INTO public.login_event \\(user_id, source, state, reason, created\\) VALUES \\(\\$1, \\$2, \\$3, \\$4, \\$5\\)$").
+		WithArgs("abc123", "192.0.2.1", "DENY", "INVALID_CREDENTIALS", *now).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	as.recordLogin("abc123", "192.0.2.1", &pb.VerifyResponse{State: pb.State_DENY, Reason: pb.Reason_INVALID_CREDENTIALS})
+	// With ctx already done, writeLogins writes what's queued and returns
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	as.writeLogins(ctx, retention)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListLoginHistory(t *testing.T) {
+	as, mock, now := newMockDbService(t)
+
+	if _, err := as.ListLoginHistory(serviceCtx, &pb.ListLoginHistoryRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument without a user, got %v", err)
+	}
+	_, err := as.ListLoginHistory(serviceCtx, &pb.ListLoginHistoryRequest{UserId: "abc123", Limit: MaxLoginHistoryLimit + 1})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a big limit, got %v", err)
+	}
+
+	mock.ExpectQuery("^SELECT created, source, state, reason FROM public.login_event WHERE user_id = \\$1 ORDER BY id DESC LIMIT \\$2$").
+		WithArgs("abc123", defaultLoginHistoryLimit).
+		WillReturnRows(mock.NewRows([]string{"created", "source", "state", "reason"}).
+			AddRow(*now, "192.0.2.1", "ALLOW", "NONE").
+			AddRow(now.Add(-time.Minute), "198.51.100.7", "DENY", "INVALID_CREDENTIALS"))
+	res, err := as.ListLoginHistory(serviceCtx, &pb.ListLoginHistoryRequest{UserId: "abc123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Events) != 2 {
+		t.Fatalf("expected 2 events, got %v", res.Events)
+	}
+	if e := res.Events[0]; e.Time != now.Unix() || e.Source != "192.0.2.1" || e.State != pb.State_ALLOW {
+		t.Fatalf("unexpected first event %v", e)
+	}
+	if e := res.Events[1]; e.State != pb.State_DENY || e.Reason != pb.Reason_INVALID_CREDENTIALS {
+		t.Fatalf("unexpected second event %v", e)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,230 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// This package hashes and checks passwords. Two formats are understood:
+//
+//   - bcrypt, as produced by bcrypt itself: $2a$10$...
+//   - Argon2id, as a PHC string: $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+//
+// A Policy says which algorithm and cost new hashes are made with. Hashes made under an older,
+// weaker policy still verify, and NeedsRehash says when one should be replaced -- which can only
+// be done when the password is known, after it has been checked.
+
+const (
+	AlgorithmBcrypt   = "bcrypt"
+	AlgorithmArgon2id = "argon2id"
+)
+
+var (
+	// ErrMismatch is returned by Compare when the password doesn't match the hash
+	ErrMismatch = errors.New("password: does not match")
+	// ErrUnknownFormat is returned by Compare for a hash it can't parse
+	ErrUnknownFormat = errors.New("password: unknown hash format")
+)
+
+// How long new passwords can be, in bytes. The maximum is bcrypt's, so that a password can be
+// hashed under either algorithm.
+const (
+	MinLength = 8
+	MaxLength = 72
+)
+
+// CheckNew checks that a password is allowed to be set. Existing passwords that break the rules
+// still verify.
+func CheckNew(passwd string) error {
+	if len(passwd) < MinLength || len(passwd) > MaxLength {
+		return fmt.Errorf("password: must be %d to %d bytes", MinLength, MaxLength)
+	}
+	return nil
+}
+
+// Argon2Params are the costs of an Argon2id hash
+type Argon2Params struct {
+	// Memory in KiB
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+// Policy is how new passwords are hashed
+type Policy struct {
+	// AlgorithmBcrypt or AlgorithmArgon2id
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+// DefaultPolicy uses Argon2id with the parameters OWASP recommends
+var DefaultPolicy = Policy{
+	Algorithm:  AlgorithmArgon2id,
+	BcryptCost: 12,
+	Argon2: Argon2Params{
+		Memory:  19 * 1024,
+		Time:    2,
+		Threads: 1,
+	},
+}
+
+// Argon2id salt and key lengths, in bytes
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// Validate checks that the policy can be used to hash passwords
+func (p Policy) Validate() error {
+	switch p.Algorithm {
+	case AlgorithmBcrypt:
+		if p.BcryptCost < bcrypt.MinCost || p.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("password: bcrypt cost must be between %d and %d, got %d", bcrypt.MinCost, bcrypt.MaxCost, p.BcryptCost)
+		}
+	case AlgorithmArgon2id:
+		if p.Argon2.Time < 1 || p.Argon2.Threads < 1 {
+			return fmt.Errorf("password: argon2id time and threads must be at least 1, got %d and %d", p.Argon2.Time, p.Argon2.Threads)
+		}
+		if p.Argon2.Memory < 8*uint32(p.Argon2.Threads) {
+			return fmt.Errorf("password: argon2id memory must be at least 8 KiB per thread, got %d KiB", p.Argon2.Memory)
+		}
+	default:
+		return fmt.Errorf("password: unknown algorithm %q", p.Algorithm)
+	}
+	return nil
+}
+
+// Hash a password with the policy's algorithm and cost
+func (p Policy) Hash(password string) (string, error) {
+	switch p.Algorithm {
+	case AlgorithmBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), p.BcryptCost)
+		if err != nil {
+			return "", fmt.Errorf("password: %w", err)
+		}
+		return string(hash), nil
+	case AlgorithmArgon2id:
+		salt := make([]byte, argon2SaltLength)
+		if _, err := rand.Read(salt); err != nil {
+			return "", fmt.Errorf("password: generating salt: %w", err)
+		}
+		key := argon2.IDKey([]byte(password), salt, p.Argon2.Time, p.Argon2.Memory, p.Argon2.Threads, argon2KeyLength)
+		return formatArgon2(p.Argon2, salt, key), nil
+	}
+	return "", fmt.Errorf("password: unknown algorithm %q", p.Algorithm)
+}
+
+// Compare a password with a hash in any of the known formats. It returns nil if they match,
+// ErrMismatch if they don't, and another error if the hash can't be used.
+func Compare(hash, password string) error {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := parseArgon2(hash)
+		if err != nil {
+			return err
+		}
+		other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(key, other) != 1 {
+			return ErrMismatch
+		}
+		return nil
+	}
+	if isBcrypt(hash) {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return ErrMismatch
+		}
+		if err != nil {
+			return fmt.Errorf("password: %w", err)
+		}
+		return nil
+	}
+	return ErrUnknownFormat
+}
+
+// NeedsRehash says whether a hash was made with a different algorithm, or a lower cost, than the
+// policy asks for. Hashes with a higher cost are left alone.
+func (p Policy) NeedsRehash(hash string) bool {
+	switch p.Algorithm {
+	case AlgorithmBcrypt:
+		if !isBcrypt(hash) {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost < p.BcryptCost
+	case AlgorithmArgon2id:
+		params, _, key, err := parseArgon2(hash)
+		if err != nil {
+			return true
+		}
+		return params.Memory < p.Argon2.Memory ||
+			params.Time < p.Argon2.Time ||
+			params.Threads < p.Argon2.Threads ||
+			len(key) < argon2KeyLength
+	}
+	return false
+}
+
+// Algorithm names the algorithm of a hash, or returns "" if it isn't known
+func Algorithm(hash string) string {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return AlgorithmArgon2id
+	case isBcrypt(hash):
+		return AlgorithmBcrypt
+	}
+	return ""
+}
+
+func isBcrypt(hash string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// PHC strings use unpadded standard base64
+var phcEncoding = base64.RawStdEncoding
+
+func formatArgon2(params Argon2Params, salt, key []byte) string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.Memory, params.Time, params.Threads,
+		phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key))
+}
+
+// Parse a PHC string: $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+func parseArgon2(hash string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != AlgorithmArgon2id {
+		return params, nil, nil, ErrUnknownFormat
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("password: unsupported argon2id version %q", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, fmt.Errorf("password: invalid argon2id parameters %q", parts[3])
+	}
+	if params.Time < 1 || params.Threads < 1 {
+		return params, nil, nil, fmt.Errorf("password: invalid argon2id parameters %q", parts[3])
+	}
+	salt, err := phcEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("password: invalid argon2id salt: %w", err)
+	}
+	key, err := phcEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, fmt.Errorf("password: invalid argon2id hash")
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,145 @@
+package password
+
+import (
+	"strings"
+	"testing"
+)
+
+// Cheap parameters, so the tests are quick
+var (
+	testBcrypt   = Policy{Algorithm: AlgorithmBcrypt, BcryptCost: 4}
+	testArgon2id = Policy{Algorithm: AlgorithmArgon2id, Argon2: Argon2Params{Memory: 64, Time: 1, Threads: 1}}
+)
+
+func TestHashAndCompare(t *testing.T) {
+	for _, policy := range []Policy{testBcrypt, testArgon2id} {
+		hash, err := policy.Hash("banana")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if algorithm := Algorithm(hash); algorithm != policy.Algorithm {
+			t.Fatalf("expected a %s hash, got %q", policy.Algorithm, hash)
+		}
+		if err := Compare(hash, "banana"); err != nil {
+			t.Fatalf("%s: expected the password to match, got %v", policy.Algorithm, err)
+		}
+		if err := Compare(hash, "apple"); err != ErrMismatch {
+			t.Fatalf("%s: expected ErrMismatch for the wrong password, got %v", policy.Algorithm, err)
+		}
+	}
+}
+
+func TestArgon2idFormat(t *testing.T) {
+	hash, err := testArgon2id.Hash("banana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("expected a PHC string with the policy's parameters, got %q", hash)
+	}
+
+	// Salts are random, so the same password hashes differently each time
+	other, err := testArgon2id.Hash("banana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash == other {
+		t.Fatal("expected different hashes for the same password")
+	}
+}
+
+func TestCompareExisting(t *testing.T) {
+	// The bcrypt hashes in the test data, made by PHP's password_hash
+	if err := Compare("$2y$10$O8VPlcAPa/iKHrkdyzN1cu7TvF5Goq6nRjSdaz9uXm1zPcVgRxQnK", "banana"); err != nil {
+		t.Fatalf("expected banana to match, got %v", err)
+	}
+
+	for _, hash := range []string{
+		"",
+		"banana",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA",
+		"$argon2id$v=16$m=64,t=1,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=64,t=0,p=1$c2FsdA$aGFzaA",
+		"$argon2i$v=19$m=64,t=1,p=1$c2FsdA$aGFzaA",
+	} {
+		if err := Compare(hash, "banana"); err == nil || err == ErrMismatch {
+			t.Fatalf("%q: expected a format error, got %v", hash, err)
+		}
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	bcrypt4, err := testBcrypt.Hash("banana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon64, err := testArgon2id.Hash("banana")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stronger := testArgon2id
+	stronger.Argon2.Memory = 128
+	costlier := testBcrypt
+	costlier.BcryptCost = 5
+
+	cases := []struct {
+		policy   Policy
+		hash     string
+		expected bool
+	}{
+		{testBcrypt, bcrypt4, false},
+		{testArgon2id, argon64, false},
+		// Another algorithm
+		{testArgon2id, bcrypt4, true},
+		{testBcrypt, argon64, true},
+		// A lower cost than the policy
+		{stronger, argon64, true},
+		{costlier, bcrypt4, true},
+		// A higher cost is kept
+		{testArgon2id, mustHash(t, stronger), false},
+		{testBcrypt, mustHash(t, costlier), false},
+	}
+	for i, c := range cases {
+		if needs := c.policy.NeedsRehash(c.hash); needs != c.expected {
+			t.Fatalf("case %d: expected NeedsRehash %v for %q, got %v", i, c.expected, c.hash, needs)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := DefaultPolicy.Validate(); err != nil {
+		t.Fatalf("expected the default policy to be valid, got %v", err)
+	}
+	for _, policy := range []Policy{
+		{Algorithm: "md5"},
+		{Algorithm: AlgorithmBcrypt, BcryptCost: 3},
+		{Algorithm: AlgorithmArgon2id, Argon2: Argon2Params{Memory: 64, Time: 0, Threads: 1}},
+		{Algorithm: AlgorithmArgon2id, Argon2: Argon2Params{Memory: 8, Time: 1, Threads: 2}},
+	} {
+		if err := policy.Validate(); err == nil {
+			t.Fatalf("expected %+v to be invalid", policy)
+		}
+	}
+}
+
+func mustHash(t *testing.T, policy Policy) string {
+	hash, err := policy.Hash("banana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestCheckNew(t *testing.T) {
+	for _, passwd := range []string{"", "banana", strings.Repeat("a", MaxLength+1)} {
+		if err := CheckNew(passwd); err == nil {
+			t.Fatalf("expected a %d byte password to be refused", len(passwd))
+		}
+	}
+	for _, passwd := range []string{"bananas!", strings.Repeat("a", MaxLength)} {
+		if err := CheckNew(passwd); err != nil {
+			t.Fatalf("expected a %d byte password to be allowed, got %v", len(passwd), err)
+		}
+	}
+}
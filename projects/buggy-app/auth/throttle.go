@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"sync"
+	"time"
+
+	pb "github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/service"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Failed password attempts are tracked by user and by source (the client's IP address, as passed
+// on by the api). After a few failures each attempt has to wait, with the wait doubling each time,
+// and after more the user or source is locked out for a while. While it has to wait, Verify
+// denies with TOO_MANY_ATTEMPTS without checking the password, so guessing gets no faster by
+// sending more requests, even with the right password.
+//
+// Failures are tracked for ids that don't exist too, so the responses don't reveal which do.
+//
+// The counts are kept in memory, so they're per auth service instance and are lost on restart.
+
+// Lockout configures brute-force protection. Zero fields take the value from DefaultLockout.
+type Lockout struct {
+	// Failures before each attempt has to wait. The wait starts at BackoffBase and doubles with
+	// each further failure, up to BackoffMax.
+	BackoffAfter int
+	BackoffBase  time.Duration
+	BackoffMax   time.Duration
+	// Failures before a user, or a source, is locked out for LockoutDuration. Sources get more,
+	// as many users can share an address.
+	UserLockoutAfter   int
+	SourceLockoutAfter int
+	LockoutDuration    time.Duration
+}
+
+var DefaultLockout = Lockout{
+	BackoffAfter:       3,
+	BackoffBase:        time.Second,
+	BackoffMax:         time.Minute,
+	UserLockoutAfter:   10,
+	SourceLockoutAfter: 100,
+	LockoutDuration:    15 * time.Minute,
+}
+
+// Fill in zero fields from DefaultLockout
+func (l Lockout) withDefaults() Lockout {
+	if l.BackoffAfter == 0 {
+		l.BackoffAfter = DefaultLockout.BackoffAfter
+	}
+	if l.BackoffBase == 0 {
+		l.BackoffBase = DefaultLockout.BackoffBase
+	}
+	if l.BackoffMax == 0 {
+		l.BackoffMax = DefaultLockout.BackoffMax
+	}
+	if l.UserLockoutAfter == 0 {
+		l.UserLockoutAfter = DefaultLockout.UserLockoutAfter
+	}
+	if l.SourceLockoutAfter == 0 {
+		l.SourceLockoutAfter = DefaultLockout.SourceLockoutAfter
+	}
+	if l.LockoutDuration == 0 {
+		l.LockoutDuration = DefaultLockout.LockoutDuration
+	}
+	return l
+}
+
+// When the throttle holds more entries than this, expired ones are swept out
+const throttleSweepSize = 10000
+
+// throttle tracks failed attempts by key
+type throttle struct {
+	policy Lockout
+
+	mu      sync.Mutex
+	entries map[string]*throttleEntry
+
+	// The clock, which tests replace
+	now func() time.Time
+}
+
+type throttleEntry struct {
+	failures int
+	// The most recent failure. The entry is forgotten LockoutDuration after it.
+	last time.Time
+	// No attempts are allowed before this
+	until time.Time
+}
+
+func newThrottle(policy Lockout) *throttle {
+	return &throttle{
+		policy:  policy.withDefaults(),
+		entries: map[string]*throttleEntry{},
+		now:     time.Now,
+	}
+}
+
+func userKey(id string) string { return "user:" + id }
+
+func sourceKey(source string) string { return "source:" + source }
+
+// How long the user and source must wait before another attempt, or zero if they can try now
+func (t *throttle) wait(id, source string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	wait := t.waitLocked(userKey(id), now)
+	if source != "" {
+		if w := t.waitLocked(sourceKey(source), now); w > wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+func (t *throttle) waitLocked(key string, now time.Time) time.Duration {
+	e, ok := t.entries[key]
+	if !ok {
+		return 0
+	}
+	if now.Sub(e.last) > t.policy.LockoutDuration {
+		delete(t.entries, key)
+		return 0
+	}
+	if wait := e.until.Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Record a failed attempt by the user from the source
+func (t *throttle) fail(id, source string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	if len(t.entries) > throttleSweepSize {
+		t.sweepLocked(now)
+	}
+	t.failLocked(userKey(id), t.policy.UserLockoutAfter, now)
+	if source != "" {
+		t.failLocked(sourceKey(source), t.policy.SourceLockoutAfter, now)
+	}
+}
+
+func (t *throttle) failLocked(key string, lockoutAfter int, now time.Time) {
+	e, ok := t.entries[key]
+	if !ok || now.Sub(e.last) > t.policy.LockoutDuration {
+		e = &throttleEntry{}
+		t.entries[key] = e
+	}
+	e.failures++
+	e.last = now
+
+	switch {
+	case e.failures >= lockoutAfter:
+		if e.failures == lockoutAfter {
+			log.Printf("throttle: %s locked out for %v after %d failures\n", key, t.policy.LockoutDuration, e.failures)
+		}
+		e.until = now.Add(t.policy.LockoutDuration)
+	case e.failures >= t.policy.BackoffAfter:
+		wait := t.policy.BackoffMax
+		// Stop shifting before it overflows: by then the wait is well past any sensible max
+		if n := e.failures - t.policy.BackoffAfter; n < 32 {
+			if w := t.policy.BackoffBase << n; w < wait {
+				wait = w
+			}
+		}
+		e.until = now.Add(wait)
+	}
+}
+
+// Forget the failures of a user, after they've logged in or been unlocked
+func (t *throttle) resetUser(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, userKey(id))
+}
+
+// Forget the failures of a source. Logging in doesn't do this: otherwise an attacker with one
+// account could keep their address unlocked.
+func (t *throttle) resetSource(source string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, sourceKey(source))
+}
+
+func (t *throttle) sweepLocked(now time.Time) {
+	for key, e := range t.entries {
+		if now.Sub(e.last) > t.policy.LockoutDuration {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// Whole seconds to wait, rounded up so that the caller doesn't retry too early
+func retryAfterSeconds(wait time.Duration) int64 {
+	return int64((wait + time.Second - 1) / time.Second)
+}
+
+// Unlock forgets the failed attempts of a user or source. Only admins can call it.
+func (as *grpcAuthService) Unlock(ctx context.Context, in *pb.UnlockRequest) (*pb.UnlockResponse, error) {
+	if err := as.requireAdmin(ctx, "unlock"); err != nil {
+		return nil, err
+	}
+	if in.Id == "" && in.Source == "" {
+		return nil, status.Error(codes.InvalidArgument, "unlock: id or source required")
+	}
+	if in.Id != "" {
+		as.throttle.resetUser(in.Id)
+	}
+	if in.Source != "" {
+		as.throttle.resetSource(in.Source)
+	}
+	log.Printf("unlock: id %q, source %q\n", in.Id, in.Source)
+	return &pb.UnlockResponse{}, nil
+}
+
+// Whether the RPC was sent with the admin token, as "authorization: Bearer <token>" metadata.
+// Nobody is an admin if there's no admin token configured.
+func (as *grpcAuthService) isAdmin(ctx context.Context) bool {
+	return sentToken(ctx, as.adminToken)
+}
+
+// Whether the RPC was sent with token, as "authorization: Bearer <token>" metadata. Nobody has
+// an empty token.
+func sentToken(ctx context.Context, token string) bool {
+	if token == "" {
+		return false
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(value), []byte("Bearer "+token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/service"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestThrottleBackoff(t *testing.T) {
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	th := newThrottle(testLockout)
+	th.now = func() time.Time { return now }
+
+	// The wait after each failure: nothing, then doubling up to the max, then locked out
+	expected := []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second, time.Minute}
+	for i, wait := range expected {
+		th.fail("abc123", "")
+		if w := th.wait("abc123", ""); w != wait {
+			t.Fatalf("after %d failures: expected a wait of %v, got %v", i+1, wait, w)
+		}
+	}
+
+	// Other users aren't affected
+	if w := th.wait("xyz789", ""); w != 0 {
+		t.Fatalf("expected no wait for another user, got %v", w)
+	}
+
+	// The lockout ends, and then the failures are forgotten
+	now = now.Add(time.Minute + time.Second)
+	if w := th.wait("abc123", ""); w != 0 {
+		t.Fatalf("expected the lockout to have ended, got a wait of %v", w)
+	}
+	th.fail("abc123", "")
+	if w := th.wait("abc123", ""); w != 0 {
+		t.Fatalf("expected old failures to be forgotten, got a wait of %v", w)
+	}
+}
+
+func TestThrottleSource(t *testing.T) {
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	th := newThrottle(testLockout)
+	th.now = func() time.Time { return now }
+
+	// Guessing a different user each time doesn't get around the limit for the source
+	for i := 0; i < testLockout.SourceLockoutAfter; i++ {
+		th.fail(string(rune('a'+i)), "192.0.2.1")
+	}
+	if w := th.wait("someone-new", "192.0.2.1"); w != time.Minute {
+		t.Fatalf("expected the source to be locked out for a minute, got %v", w)
+	}
+	if w := th.wait("someone-new", "192.0.2.2"); w != 0 {
+		t.Fatalf("expected no wait from another source, got %v", w)
+	}
+
+	// Logging in doesn't unlock the source
+	th.resetUser("someone-new")
+	if w := th.wait("someone-new", "192.0.2.1"); w != time.Minute {
+		t.Fatalf("expected the source to still be locked out, got %v", w)
+	}
+}
+
+func TestVerifyThrottled(t *testing.T) {
+	as, mock, _ := newMockDbService(t)
+	as.throttle.policy = testLockout
+
+	// Unknown users and wrong passwords both count
+	for i := 0; i < 3; i++ {
+		if i == 0 {
+			expectUser(mock, "abc123", "", "")
+		} else {
+			expectUser(mock, "abc123", bananaHash, "active")
+		}
+		res, err := as.Verify(context.Background(), &pb.VerifyRequest{Id: "abc123", Password: "apple", Source: "192.0.2.1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Reason != pb.Reason_INVALID_CREDENTIALS {
+			t.Fatalf("attempt %d: expected INVALID_CREDENTIALS, got %v", i+1, res.Reason)
+		}
+		// Only a user who exists has a login history
+		if i == 0 {
+			expectNoLogin(t, as)
+		} else {
+			expectLogin(t, as, "abc123", "192.0.2.1", pb.State_DENY, pb.Reason_INVALID_CREDENTIALS)
+		}
+	}
+
+	// Now even the right password is refused, without going to the database
+	res, err := as.Verify(context.Background(), &pb.VerifyRequest{Id: "abc123", Password: "banana", Source: "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.State != pb.State_DENY || res.Reason != pb.Reason_TOO_MANY_ATTEMPTS || res.RetryAfter != 1 {
+		t.Fatalf("expected DENY with TOO_MANY_ATTEMPTS and retry_after 1, got %v", res)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUnlock(t *testing.T) {
+	as, _, _ := newMockDbService(t)
+	as.throttle.policy = testLockout
+	as.adminToken = "admin-token"
+
+	for i := 0; i < testLockout.UserLockoutAfter; i++ {
+		as.throttle.fail("abc123", "192.0.2.1")
+	}
+
+	// Without the admin token, unlocking is refused
+	_, err := as.Unlock(context.Background(), &pb.UnlockRequest{Id: "abc123"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied, got %v", err)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer wrong"))
+	_, err = as.Unlock(ctx, &pb.UnlockRequest{Id: "abc123"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied with the wrong token, got %v", err)
+	}
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer admin-token"))
+	if _, err := as.Unlock(ctx, &pb.UnlockRequest{Id: "abc123", Source: "192.0.2.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if w := as.throttle.wait("abc123", "192.0.2.1"); w != 0 {
+		t.Fatalf("expected no wait after unlocking, got %v", w)
+	}
+}
@@ -0,0 +1,288 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	pb "github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/service"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// Tokens let a client log in once with a password and then authenticate cheaply.
+//
+// Access tokens are JWTs signed with HMAC-SHA256, naming the user (sub) and their session (sid).
+// They're short-lived, and checking one needs no password hash, so they can be verified on every
+// request. Verifying also checks that the session hasn't been revoked, which is one lookup by
+// primary key.
+//
+// Refresh tokens are random and opaque. Only their sha256 hash is stored, in public.auth_session.
+// Each one can be used once, to get a new access token and a new refresh token for the same
+// session.
+
+// How long tokens last, unless configured otherwise
+const (
+	DefaultAccessTokenTTL  = 15 * time.Minute
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// The shortest TokenSecret allowed: HMAC-SHA256 keys should be at least as long as the hash
+const MinTokenSecretLength = 32
+
+// tokenIssuer signs and checks access tokens
+type tokenIssuer struct {
+	secret     []byte
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+
+	// The clock, which tests replace
+	now func() time.Time
+}
+
+// Create a tokenIssuer. An empty secret is replaced with a random one, and zero TTLs with the
+// defaults.
+func newTokenIssuer(secret string, accessTTL, refreshTTL time.Duration) *tokenIssuer {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(fmt.Sprintf("auth: generating token secret: %v", err))
+		}
+	}
+	if accessTTL == 0 {
+		accessTTL = DefaultAccessTokenTTL
+	}
+	if refreshTTL == 0 {
+		refreshTTL = DefaultRefreshTokenTTL
+	}
+	return &tokenIssuer{
+		secret:     key,
+		accessTTL:  accessTTL,
+		refreshTTL: refreshTTL,
+		now:        time.Now,
+	}
+}
+
+type accessClaims struct {
+	Session string `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+// Sign an access token for a user's session
+func (ti *tokenIssuer) sign(userId, sessionId string) (string, error) {
+	now := ti.now()
+	claims := accessClaims{
+		Session: sessionId,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   userId,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ti.accessTTL)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(ti.secret)
+}
+
+// Check an access token's signature and expiry, and return its claims
+func (ti *tokenIssuer) parse(token string) (*accessClaims, error) {
+	var claims accessClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+		return ti.secret, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(ti.now),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" || claims.Session == "" {
+		return nil, errors.New("token has no subject or session")
+	}
+	return &claims, nil
+}
+
+// Generate a refresh token, returning it and the hash to store
+func newRefreshToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("generating refresh token: %w", err)
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashRefreshToken(token), nil
+}
+
+// Refresh tokens are long and random, so a fast hash is enough to make the stored value useless
+// for logging in
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueToken checks an id and password, and starts a session for the user if they're allowed
+func (as *grpcAuthService) IssueToken(ctx context.Context, in *pb.IssueTokenRequest) (*pb.TokenResponse, error) {
+	res, err := as.issueToken(ctx, in)
+	as.countToken("IssueToken", res.GetState(), err)
+	return res, err
+}
+
+func (as *grpcAuthService) issueToken(ctx context.Context, in *pb.IssueTokenRequest) (*pb.TokenResponse, error) {
+	verified, err := as.verify(ctx, &pb.VerifyRequest{Id: in.Id, Password: in.Password, Source: in.Source, Otp: in.Otp})
+	if err != nil {
+		return nil, err
+	}
+	if verified.State != pb.State_ALLOW {
+		return &pb.TokenResponse{State: pb.State_DENY, Reason: verified.Reason, RetryAfter: verified.RetryAfter}, nil
+	}
+
+	refresh, hash, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	var sessionId string
+	err = as.pool.QueryRow(ctx,
+		"INSERT INTO public.auth_session (user_id, refresh_hash, expires) VALUES ($1, $2, $3) RETURNING id",
+		in.Id, hash, as.tokens.now().Add(as.tokens.refreshTTL),
+	).Scan(&sessionId)
+	if err != nil {
+		log.Printf("issue token: id %v, insert error: %v\n", in.Id, err)
+		return nil, fmt.Errorf("issue token: %w", err)
+	}
+
+	log.Printf("issue token: id %v, session %v\n", in.Id, sessionId)
+	return as.tokenResponse(in.Id, sessionId, refresh)
+}
+
+// RefreshToken replaces a session's refresh token, and issues a new access token for it
+func (as *grpcAuthService) RefreshToken(ctx context.Context, in *pb.RefreshTokenRequest) (*pb.TokenResponse, error) {
+	res, err := as.refreshToken(ctx, in)
+	as.countToken("RefreshToken", res.GetState(), err)
+	return res, err
+}
+
+func (as *grpcAuthService) refreshToken(ctx context.Context, in *pb.RefreshTokenRequest) (*pb.TokenResponse, error) {
+	refresh, hash, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	// Swapping the hash in one statement means a refresh token can only be used once, even by
+	// concurrent requests. If the account is no longer active the swap still happens, but the
+	// new token isn't returned, so the session can't be refreshed again.
+	now := as.tokens.now()
+	var sessionId, userId, status string
+	err = as.pool.QueryRow(ctx,
+		`UPDATE public.auth_session s SET refresh_hash = $1, expires = $2
+		FROM public.user u
+		WHERE s.refresh_hash = $3 AND s.revoked_at IS NULL AND s.expires > $4 AND u.id = s.user_id
+		RETURNING s.id, s.user_id, u.status`,
+		hash, now.Add(as.tokens.refreshTTL), hashRefreshToken(in.RefreshToken), now,
+	).Scan(&sessionId, &userId, &status)
+	if err == pgx.ErrNoRows {
+		log.Printf("refresh token: deny\n")
+		return &pb.TokenResponse{State: pb.State_DENY, Reason: pb.Reason_INVALID_TOKEN}, nil
+	}
+	if err != nil {
+		log.Printf("refresh token: update error: %v\n", err)
+		return nil, fmt.Errorf("refresh token: %w", err)
+	}
+	if reason := statusReason(status); reason != pb.Reason_NONE {
+		log.Printf("refresh token: id %v, deny (status %v)\n", userId, status)
+		return &pb.TokenResponse{State: pb.State_DENY, Reason: reason}, nil
+	}
+
+	log.Printf("refresh token: id %v, session %v\n", userId, sessionId)
+	return as.tokenResponse(userId, sessionId, refresh)
+}
+
+// Build the response for a newly issued or refreshed session
+func (as *grpcAuthService) tokenResponse(userId, sessionId, refresh string) (*pb.TokenResponse, error) {
+	access, err := as.tokens.sign(userId, sessionId)
+	if err != nil {
+		return nil, fmt.Errorf("signing access token: %w", err)
+	}
+	return &pb.TokenResponse{
+		State:        pb.State_ALLOW,
+		AccessToken:  access,
+		RefreshToken: refresh,
+		ExpiresIn:    int64(as.tokens.accessTTL / time.Second),
+	}, nil
+}
+
+// RevokeToken ends the session of a refresh token. Unknown and already revoked tokens are
+// ignored, so the caller can't use this to find out whether a token is valid.
+func (as *grpcAuthService) RevokeToken(ctx context.Context, in *pb.RevokeTokenRequest) (*pb.RevokeTokenResponse, error) {
+	_, err := as.pool.Exec(ctx,
+		"UPDATE public.auth_session SET revoked_at = $1 WHERE refresh_hash = $2 AND revoked_at IS NULL",
+		as.tokens.now(), hashRefreshToken(in.RefreshToken),
+	)
+	if err != nil {
+		log.Printf("revoke token: update error: %v\n", err)
+		as.countToken("RevokeToken", pb.State_DENY, err)
+		return nil, fmt.Errorf("revoke token: %w", err)
+	}
+	as.countToken("RevokeToken", pb.State_ALLOW, nil)
+	return &pb.RevokeTokenResponse{}, nil
+}
+
+// VerifyToken checks an access token, and that its session is still live
+func (as *grpcAuthService) VerifyToken(ctx context.Context, in *pb.VerifyTokenRequest) (*pb.VerifyResponse, error) {
+	res, err := as.verifyToken(ctx, in)
+	as.countToken("VerifyToken", res.GetState(), err)
+	return res, err
+}
+
+func (as *grpcAuthService) verifyToken(ctx context.Context, in *pb.VerifyTokenRequest) (*pb.VerifyResponse, error) {
+	claims, err := as.tokens.parse(in.AccessToken)
+	if err != nil {
+		log.Printf("verify token: deny (%v)\n", err)
+		return &pb.VerifyResponse{State: pb.State_DENY, Reason: pb.Reason_INVALID_TOKEN}, nil
+	}
+
+	// The account's status is checked too, so that locking an account stops its tokens working
+	// straight away
+	var live bool
+	var status string
+	var roles []string
+	err = as.pool.QueryRow(ctx,
+		`SELECT s.revoked_at IS NULL, u.status, u.roles FROM public.auth_session s
+		JOIN public.user u ON u.id = s.user_id
+		WHERE s.id = $1 AND s.user_id = $2`,
+		claims.Session, claims.Subject,
+	).Scan(&live, &status, &roles)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Printf("verify token: query error: %v\n", err)
+		return nil, fmt.Errorf("verify token: %w", err)
+	}
+	if !live {
+		log.Printf("verify token: id %v, deny (session %v)\n", claims.Subject, claims.Session)
+		return &pb.VerifyResponse{State: pb.State_DENY, Reason: pb.Reason_INVALID_TOKEN}, nil
+	}
+	if reason := statusReason(status); reason != pb.Reason_NONE {
+		log.Printf("verify token: id %v, deny (status %v)\n", claims.Subject, status)
+		return &pb.VerifyResponse{State: pb.State_DENY, Reason: reason}, nil
+	}
+
+	return &pb.VerifyResponse{
+		State:      pb.State_ALLOW,
+		Id:         claims.Subject,
+		Roles:      roles,
+		AuthMethod: pb.AuthMethod_ACCESS_TOKEN,
+		SessionId:  claims.Session,
+	}, nil
+}
+
+// Count a token RPC in auth_token_total. Errors are counted with state="ERROR".
+func (as *grpcAuthService) countToken(rpc string, state pb.State, err error) {
+	label := state.String()
+	if err != nil {
+		label = "ERROR"
+	}
+	as.tokenRequests.WithLabelValues(rpc, label).Inc()
+}
@@ -0,0 +1,311 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/password"
+	pb "github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/service"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTokenIssuer(t *testing.T) {
+	now := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	ti := newTokenIssuer("test-secret-which-is-long-enough", 0, 0)
+	ti.now = func() time.Time { return now }
+
+	token, err := ti.sign("abc123", "sess1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := ti.parse(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "abc123" || claims.Session != "sess1" {
+		t.Fatalf("expected subject abc123 and session sess1, got %q and %q", claims.Subject, claims.Session)
+	}
+
+	// Another service's key doesn't verify
+	other := newTokenIssuer("", 0, 0)
+	other.now = ti.now
+	if _, err := other.parse(token); err == nil {
+		t.Fatal("expected a token signed with another key to fail")
+	}
+
+	// Tokens expire
+	now = now.Add(DefaultAccessTokenTTL + time.Second)
+	if _, err := ti.parse(token); err == nil {
+		t.Fatal("expected an expired token to fail")
+	}
+}
+
+func TestIssueToken(t *testing.T) {
+	as, mock, _ := newMockDbService(t)
+
+	expectUser(mock, "abc123", bananaHash, "active")
+	expectNoTotp(mock, "abc123")
+	mock.ExpectQuery("^INSERT INTO public.auth_session \\(user_id, refresh_hash, expires\\) (.+) RETURNING id$").
+		WithArgs("abc123", pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnRows(mock.NewRows([]string{"id"}).AddRow("sess1"))
+
+	res, err := as.IssueToken(context.Background(), &pb.IssueTokenRequest{Id: "abc123", Password: "banana"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLogin(t, as, "abc123", "", pb.State_ALLOW, pb.Reason_NONE)
+	if res.State != pb.State_ALLOW || res.RefreshToken == "" || res.ExpiresIn != 900 {
+		t.Fatalf("expected ALLOW with a refresh token and expires_in 900, got %v", res)
+	}
+	claims, err := as.tokens.parse(res.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "abc123" || claims.Session != "sess1" {
+		t.Fatalf("expected subject abc123 and session sess1, got %q and %q", claims.Subject, claims.Session)
+	}
+	if n := testutil.ToFloat64(as.tokenRequests.WithLabelValues("IssueToken", "ALLOW")); n != 1 {
+		t.Fatalf("expected 1 ALLOW in the token metric, got %v", n)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestIssueTokenDeny(t *testing.T) {
+	as, mock, _ := newMockDbService(t)
+
+	expectUser(mock, "abc123", bananaHash, "active")
+
+	res, err := as.IssueToken(context.Background(), &pb.IssueTokenRequest{Id: "abc123", Password: "apple"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLogin(t, as, "abc123", "", pb.State_DENY, pb.Reason_INVALID_CREDENTIALS)
+	if res.State != pb.State_DENY || res.AccessToken != "" || res.RefreshToken != "" {
+		t.Fatalf("expected DENY without tokens, got %v", res)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	as, mock, now := newMockDbService(t)
+
+	mock.ExpectQuery("^UPDATE public.auth_session s SET refresh_hash = \\$1, expires = \\$2 (.+) RETURNING s.id, s.user_id, u.status$").
+		WithArgs(pgxmock.AnyArg(), now.Add(DefaultRefreshTokenTTL), hashRefreshToken("old"), *now).
+		WillReturnRows(mock.NewRows([]string{"id", "user_id", "status"}).AddRow("sess1", "abc123", "active"))
+
+	res, err := as.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.State != pb.State_ALLOW || res.RefreshToken == "" || res.RefreshToken == "old" {
+		t.Fatalf("expected ALLOW with a new refresh token, got %v", res)
+	}
+
+	// The old token has been swapped out, so it finds nothing next time
+	mock.ExpectQuery("^UPDATE public.auth_session (.+)$").
+		WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), hashRefreshToken("old"), *now).
+		WillReturnError(pgx.ErrNoRows)
+
+	res, err = as.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.State != pb.State_DENY || res.Reason != pb.Reason_INVALID_TOKEN {
+		t.Fatalf("expected DENY with INVALID_TOKEN for a used refresh token, got %v", res)
+	}
+
+	// Locked accounts can't refresh
+	mock.ExpectQuery("^UPDATE public.auth_session (.+)$").
+		WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), hashRefreshToken("other"), *now).
+		WillReturnRows(mock.NewRows([]string{"id", "user_id", "status"}).AddRow("sess2", "abc123", "locked"))
+
+	res, err = as.RefreshToken(context.Background(), &pb.RefreshTokenRequest{RefreshToken: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.State != pb.State_DENY || res.Reason != pb.Reason_ACCOUNT_LOCKED || res.RefreshToken != "" {
+		t.Fatalf("expected DENY with ACCOUNT_LOCKED and no tokens, got %v", res)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	as, mock, now := newMockDbService(t)
+
+	mock.ExpectExec("^UPDATE public.auth_session SET revoked_at = \\$1 WHERE refresh_hash = \\$2 AND revoked_at IS NULL$").
+		WithArgs(*now, hashRefreshToken("refresh")).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	if _, err := as.RevokeToken(context.Background(), &pb.RevokeTokenRequest{RefreshToken: "refresh"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestVerifyToken(t *testing.T) {
+	as, mock, now := newMockDbService(t)
+
+	token, err := as.tokens.sign("abc123", "sess1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery("^SELECT s.revoked_at IS NULL, u.status, u.roles FROM public.auth_session s (.+) WHERE s.id = \\$1 AND s.user_id = \\$2$").
+		WithArgs("sess1", "abc123").
+		WillReturnRows(mock.NewRows([]string{"live", "status", "roles"}).AddRow(true, "active", []string{"user"}))
+	res, err := as.VerifyToken(context.Background(), &pb.VerifyTokenRequest{AccessToken: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.State != pb.State_ALLOW || res.Id != "abc123" || res.SessionId != "sess1" ||
+		res.AuthMethod != pb.AuthMethod_ACCESS_TOKEN || len(res.Roles) != 1 {
+		t.Fatalf("expected ALLOW for abc123's session sess1 with its roles, got %v", res)
+	}
+
+	// Revoked sessions don't verify
+	mock.ExpectQuery("^SELECT s.revoked_at IS NULL, u.status, u.roles (.+)$").
+		WithArgs("sess1", "abc123").
+		WillReturnRows(mock.NewRows([]string{"live", "status", "roles"}).AddRow(false, "active", []string{"user"}))
+	res, err = as.VerifyToken(context.Background(), &pb.VerifyTokenRequest{AccessToken: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.State != pb.State_DENY || res.Reason != pb.Reason_INVALID_TOKEN {
+		t.Fatalf("expected DENY with INVALID_TOKEN for a revoked session, got %v", res)
+	}
+
+	// Nor do sessions of accounts that have been deactivated since
+	mock.ExpectQuery("^SELECT s.revoked_at IS NULL, u.status, u.roles (.+)$").
+		WithArgs("sess1", "abc123").
+		WillReturnRows(mock.NewRows([]string{"live", "status", "roles"}).AddRow(true, "inactive", []string{"user"}))
+	res, err = as.VerifyToken(context.Background(), &pb.VerifyTokenRequest{AccessToken: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.State != pb.State_DENY || res.Reason != pb.Reason_ACCOUNT_INACTIVE {
+		t.Fatalf("expected DENY with ACCOUNT_INACTIVE, got %v", res)
+	}
+
+	// Expired tokens are denied without looking at the database
+	*now = now.Add(DefaultAccessTokenTTL + time.Second)
+	res, err = as.VerifyToken(context.Background(), &pb.VerifyTokenRequest{AccessToken: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.State != pb.State_DENY {
+		t.Fatalf("expected DENY for an expired token, got %v", res.State)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestVerifyAccountStatus(t *testing.T) {
+	as, mock, _ := newMockDbService(t)
+
+	cases := []struct {
+		status   string
+		password string
+		state    pb.State
+		reason   pb.Reason
+	}{
+		{"active", "banana", pb.State_ALLOW, pb.Reason_NONE},
+		{"inactive", "banana", pb.State_DENY, pb.Reason_ACCOUNT_INACTIVE},
+		{"locked", "banana", pb.State_DENY, pb.Reason_ACCOUNT_LOCKED},
+		{"pending_verification", "banana", pb.State_DENY, pb.Reason_ACCOUNT_PENDING_VERIFICATION},
+		// Without the password, the status isn't given away
+		{"locked", "apple", pb.State_DENY, pb.Reason_INVALID_CREDENTIALS},
+	}
+	for _, c := range cases {
+		expectUser(mock, "abc123", bananaHash, c.status)
+		if c.password == "banana" {
+			expectNoTotp(mock, "abc123")
+		}
+
+		res, err := as.Verify(context.Background(), &pb.VerifyRequest{Id: "abc123", Password: c.password})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectLogin(t, as, "abc123", "", c.state, c.reason)
+		if res.State != c.state || res.Reason != c.reason {
+			t.Fatalf("%s with %s: expected %v %v, got %v %v", c.status, c.password, c.state, c.reason, res.State, res.Reason)
+		}
+	}
+
+	// Unknown users look the same as wrong passwords
+	expectUser(mock, "nobody", "", "")
+	res, err := as.Verify(context.Background(), &pb.VerifyRequest{Id: "nobody", Password: "banana"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.State != pb.State_DENY || res.Reason != pb.Reason_INVALID_CREDENTIALS {
+		t.Fatalf("expected DENY with INVALID_CREDENTIALS for an unknown user, got %v %v", res.State, res.Reason)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestVerifyRehash(t *testing.T) {
+	as, mock, _ := newMockDbService(t)
+	as.passwords = password.Policy{
+		Algorithm: password.AlgorithmArgon2id,
+		Argon2:    password.Argon2Params{Memory: 64, Time: 1, Threads: 1},
+	}
+
+	oldHash := bananaHash
+	expectUser(mock, "abc123", oldHash, "active")
+	expectNoTotp(mock, "abc123")
+
+	mock.ExpectExec("^UPDATE public.user SET password = \\$1 WHERE id = \\$2 AND password = \\$3$").
+		WithArgs(pgxmock.AnyArg(), "abc123", oldHash).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	res, err := as.Verify(context.Background(), &pb.VerifyRequest{Id: "abc123", Password: "banana"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLogin(t, as, "abc123", "", pb.State_ALLOW, pb.Reason_NONE)
+	if res.State != pb.State_ALLOW {
+		t.Fatalf("expected ALLOW, got %v", res.State)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+
+	// Once rehashed, it isn't done again
+	newHash, err := as.passwords.Hash("banana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectUser(mock, "abc123", newHash, "active")
+	expectNoTotp(mock, "abc123")
+	res, err = as.Verify(context.Background(), &pb.VerifyRequest{Id: "abc123", Password: "banana"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLogin(t, as, "abc123", "", pb.State_ALLOW, pb.Reason_NONE)
+	if res.State != pb.State_ALLOW {
+		t.Fatalf("expected ALLOW with the new hash, got %v", res.State)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
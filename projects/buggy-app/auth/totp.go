@@ -0,0 +1,269 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+
+	pb "github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/service"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/totp"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Users can add a second factor: a TOTP secret in an authenticator app. Once they have, Verify
+// and IssueToken need a code from the app as well as the password.
+//
+// Enrolling takes two steps, so that a secret the user failed to scan can't lock them out:
+// EnrolTotp makes a secret, and ConfirmTotp turns it on once the user has sent a code from it.
+// Confirming also returns ten recovery codes, each of which can be used once instead of a code
+// from the app. Like API keys, only their sha256 hash is stored.
+//
+// Each code from the app is only accepted once: public.user_totp remembers the time step of the
+// last one used. Wrong codes count as failed attempts, like wrong passwords.
+//
+// As with API keys, the RPCs trust the caller to say which user it's acting for, so they need the
+// service token.
+
+// DefaultTotpIssuer is the name authenticator apps show for the service, unless configured
+// otherwise
+const DefaultTotpIssuer = "buggy-app"
+
+const (
+	// How many recovery codes a user gets
+	recoveryCodeCount = 10
+	// Random bytes in a recovery code, which make 16 base32 characters
+	recoveryCodeBytes = 10
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Generate recovery codes, returning them formatted like ABCD-EFGH-IJKL-MNOP and the hashes to
+// store
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for range recoveryCodeCount {
+		b := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, fmt.Errorf("generating recovery code: %w", err)
+		}
+		raw := recoveryEncoding.EncodeToString(b)
+		codes = append(codes, raw[0:4]+"-"+raw[4:8]+"-"+raw[8:12]+"-"+raw[12:16])
+		hashes = append(hashes, hashRecoveryCode(raw))
+	}
+	return codes, hashes, nil
+}
+
+// Recovery codes are typed by people, so dashes, spaces and case don't matter. They're random
+// enough that, as for API keys, a fast hash is enough.
+func hashRecoveryCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// Whether the code looks like one from an authenticator app, rather than a recovery code
+func isTotpCode(code string) bool {
+	if len(code) != totp.Digits {
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// The user's confirmed TOTP secret, or "" if they don't have one
+func (as *grpcAuthService) totpSecret(ctx context.Context, userId string) (string, error) {
+	var secret string
+	err := as.pool.QueryRow(ctx,
+		"SELECT secret FROM public.user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL",
+		userId,
+	).Scan(&secret)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("totp query: %w", err)
+	}
+	return secret, nil
+}
+
+// Check a second factor: a code from the app for the secret, or one of the user's unused
+// recovery codes. Either is used up if it's right.
+func (as *grpcAuthService) checkOtp(ctx context.Context, userId, secret, otp string) (bool, error) {
+	if isTotpCode(otp) {
+		counter, ok := totp.Validate(secret, otp, as.tokens.now())
+		if !ok {
+			return false, nil
+		}
+		// Only move forwards, so that neither this code nor any earlier one works again
+		tag, err := as.pool.Exec(ctx,
+			"UPDATE public.user_totp SET last_counter = $1 WHERE user_id = $2 AND last_counter < $1",
+			counter, userId,
+		)
+		if err != nil {
+			return false, fmt.Errorf("totp update: %w", err)
+		}
+		return tag.RowsAffected() == 1, nil
+	}
+
+	tag, err := as.pool.Exec(ctx,
+		"UPDATE public.totp_recovery_code SET used_at = $1 WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL",
+		as.tokens.now(), userId, hashRecoveryCode(otp),
+	)
+	if err != nil {
+		return false, fmt.Errorf("recovery code update: %w", err)
+	}
+	if tag.RowsAffected() == 1 {
+		log.Printf("verify: id %v, recovery code used\n", userId)
+		return true, nil
+	}
+	return false, nil
+}
+
+// EnrolTotp makes a new, unconfirmed secret for a user
+func (as *grpcAuthService) EnrolTotp(ctx context.Context, in *pb.EnrolTotpRequest) (*pb.EnrolTotpResponse, error) {
+	if in.UserId == "" {
+		return nil, status.Error(codes.InvalidArgument, "enrol totp: user_id required")
+	}
+	if err := as.requireService(ctx, "enrol totp"); err != nil {
+		return nil, err
+	}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return nil, err
+	}
+	// Replace an unconfirmed secret, but never a confirmed one
+	tag, err := as.pool.Exec(ctx,
+		`INSERT INTO public.user_totp (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, last_counter = 0, created = current_timestamp
+		WHERE public.user_totp.confirmed_at IS NULL`,
+		in.UserId, secret,
+	)
+	if err != nil {
+		log.Printf("enrol totp: id %v, insert error: %v\n", in.UserId, err)
+		return nil, fmt.Errorf("enrol totp: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, status.Error(codes.FailedPrecondition, "enrol totp: already enrolled")
+	}
+
+	log.Printf("enrol totp: id %v\n", in.UserId)
+	return &pb.EnrolTotpResponse{
+		Secret: secret,
+		Uri:    totp.URI(as.totpIssuer, in.UserId, secret),
+	}, nil
+}
+
+// ConfirmTotp turns on a user's new secret, if the code is right, and gives them recovery codes
+func (as *grpcAuthService) ConfirmTotp(ctx context.Context, in *pb.ConfirmTotpRequest) (*pb.ConfirmTotpResponse, error) {
+	if in.UserId == "" || in.Code == "" {
+		return nil, status.Error(codes.InvalidArgument, "confirm totp: user_id and code required")
+	}
+	if err := as.requireService(ctx, "confirm totp"); err != nil {
+		return nil, err
+	}
+	if wait := as.throttle.wait(in.UserId, ""); wait > 0 {
+		return nil, status.Errorf(codes.ResourceExhausted, "confirm totp: too many attempts, retry after %ds", retryAfterSeconds(wait))
+	}
+
+	var secret string
+	err := as.pool.QueryRow(ctx,
+		"SELECT secret FROM public.user_totp WHERE user_id = $1 AND confirmed_at IS NULL",
+		in.UserId,
+	).Scan(&secret)
+	if err == pgx.ErrNoRows {
+		return nil, status.Error(codes.FailedPrecondition, "confirm totp: nothing to confirm")
+	}
+	if err != nil {
+		log.Printf("confirm totp: query error: %v\n", err)
+		return nil, fmt.Errorf("confirm totp: %w", err)
+	}
+	counter, ok := totp.Validate(secret, in.Code, as.tokens.now())
+	if !ok {
+		as.throttle.fail(in.UserId, "")
+		log.Printf("confirm totp: id %v, wrong code\n", in.UserId)
+		return nil, status.Error(codes.InvalidArgument, "confirm totp: wrong code")
+	}
+
+	recoveryCodes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	// Confirm and store the recovery codes together, so the user can't end up with one and not
+	// the other. The code used to confirm can't be used again.
+	tag, err := as.pool.Exec(ctx,
+		`WITH confirmed AS (
+			UPDATE public.user_totp SET confirmed_at = $1, last_counter = $2
+			WHERE user_id = $3 AND secret = $4 AND confirmed_at IS NULL
+			RETURNING user_id
+		)
+		INSERT INTO public.totp_recovery_code (user_id, code_hash)
+		SELECT user_id, unnest($5::TEXT[]) FROM confirmed`,
+		as.tokens.now(), counter, in.UserId, secret, hashes,
+	)
+	if err != nil {
+		log.Printf("confirm totp: id %v, update error: %v\n", in.UserId, err)
+		return nil, fmt.Errorf("confirm totp: %w", err)
+	}
+	// Confirmed, or replaced by a new enrolment, since we looked
+	if tag.RowsAffected() == 0 {
+		return nil, status.Error(codes.FailedPrecondition, "confirm totp: nothing to confirm")
+	}
+
+	log.Printf("confirm totp: id %v\n", in.UserId)
+	return &pb.ConfirmTotpResponse{RecoveryCodes: recoveryCodes}, nil
+}
+
+// DisableTotp removes a user's second factor and recovery codes, if the code is right
+func (as *grpcAuthService) DisableTotp(ctx context.Context, in *pb.DisableTotpRequest) (*pb.DisableTotpResponse, error) {
+	if in.UserId == "" || in.Code == "" {
+		return nil, status.Error(codes.InvalidArgument, "disable totp: user_id and code required")
+	}
+	if err := as.requireService(ctx, "disable totp"); err != nil {
+		return nil, err
+	}
+	if wait := as.throttle.wait(in.UserId, ""); wait > 0 {
+		return nil, status.Errorf(codes.ResourceExhausted, "disable totp: too many attempts, retry after %ds", retryAfterSeconds(wait))
+	}
+
+	secret, err := as.totpSecret(ctx, in.UserId)
+	if err != nil {
+		log.Printf("disable totp: %v\n", err)
+		return nil, fmt.Errorf("disable totp: %w", err)
+	}
+	if secret == "" {
+		return nil, status.Error(codes.FailedPrecondition, "disable totp: not enrolled")
+	}
+	ok, err := as.checkOtp(ctx, in.UserId, secret, in.Code)
+	if err != nil {
+		log.Printf("disable totp: %v\n", err)
+		return nil, fmt.Errorf("disable totp: %w", err)
+	}
+	if !ok {
+		as.throttle.fail(in.UserId, "")
+		log.Printf("disable totp: id %v, wrong code\n", in.UserId)
+		return nil, status.Error(codes.InvalidArgument, "disable totp: wrong code")
+	}
+
+	_, err = as.pool.Exec(ctx,
+		`WITH codes AS (DELETE FROM public.totp_recovery_code WHERE user_id = $1)
+		DELETE FROM public.user_totp WHERE user_id = $1`,
+		in.UserId,
+	)
+	if err != nil {
+		log.Printf("disable totp: id %v, delete error: %v\n", in.UserId, err)
+		return nil, fmt.Errorf("disable totp: %w", err)
+	}
+
+	log.Printf("disable totp: id %v\n", in.UserId)
+	return &pb.DisableTotpResponse{}, nil
+}
@@ -0,0 +1,100 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// This package implements time-based one-time passwords (RFC 6238), as used by authenticator
+// apps: HMAC-SHA1, 6 digits, changing every 30 seconds. These are the defaults every app
+// supports, so they're not configurable.
+//
+// Times are always passed in, rather than read from the clock, so that callers can test with a
+// fake one.
+
+const (
+	// Digits in a code
+	Digits = 6
+	// How long each code lasts
+	Period = 30 * time.Second
+	// Codes from this many periods either side of now are accepted, for clocks that are a
+	// little out and codes typed just as they change
+	Skew = 1
+	// Bytes in a secret, as RFC 4226 recommends
+	SecretLength = 20
+)
+
+// Secrets are shown to people, and typed by some, as unpadded base32
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret generates a random secret, base32 encoded
+func NewSecret() (string, error) {
+	b := make([]byte, SecretLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("totp: generating secret: %w", err)
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// Counter is the number of the period t is in
+func Counter(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code is the code for a secret at a counter
+func Code(secret string, counter int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("totp: invalid secret: %w", err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, value%1000000), nil
+}
+
+// Validate checks a code against a secret at time t, allowing for Skew. It returns the counter
+// the code was for, so the caller can refuse to accept it, or any earlier one, again.
+func Validate(secret, code string, t time.Time) (int64, bool) {
+	if len(code) != Digits {
+		return 0, false
+	}
+	now := Counter(t)
+	for counter := now - Skew; counter <= now+Skew; counter++ {
+		expected, err := Code(secret, counter)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// URI is an otpauth:// URI for the secret, which authenticator apps can read from a QR code.
+// issuer is the name of the service and account the user it's for, which apps show together.
+func URI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(Digits))
+	q.Set("period", fmt.Sprint(int(Period/time.Second)))
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
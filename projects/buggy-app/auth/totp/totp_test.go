@@ -0,0 +1,89 @@
+package totp
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// The SHA1 secret from RFC 6238 appendix B, "12345678901234567890"
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	// RFC 6238 gives 8-digit codes: ours are the last 6 of them
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, c := range cases {
+		code, err := Code(rfcSecret, Counter(time.Unix(c.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != c.code {
+			t.Fatalf("at %d: expected %s, got %s", c.unix, c.code, code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	code, err := Code(rfcSecret, Counter(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Accepted a period either side, but not two
+	for _, offset := range []time.Duration{0, -Period, Period} {
+		counter, ok := Validate(rfcSecret, code, now.Add(offset))
+		if !ok || counter != Counter(now) {
+			t.Fatalf("offset %v: expected the code to be valid for counter %d, got %d, %v", offset, Counter(now), counter, ok)
+		}
+	}
+	for _, offset := range []time.Duration{-2 * Period, 2 * Period} {
+		if _, ok := Validate(rfcSecret, code, now.Add(offset)); ok {
+			t.Fatalf("offset %v: expected the code to be too old or new", offset)
+		}
+	}
+
+	for _, wrong := range []string{"", "12345", "1234567", "abcdef", "000000"} {
+		if _, ok := Validate(rfcSecret, wrong, now); ok {
+			t.Fatalf("expected %q to be invalid", wrong)
+		}
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != 32 {
+		t.Fatalf("expected 32 base32 characters for 20 bytes, got %q", secret)
+	}
+	if _, err := Code(secret, 1); err != nil {
+		t.Fatalf("expected a usable secret, got %v", err)
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri, err := url.Parse(URI("buggy app", "abc123", "JBSWY3DPEHPK3PXP"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/buggy app:abc123" {
+		t.Fatalf("unexpected uri %v", uri)
+	}
+	q := uri.Query()
+	if q.Get("secret") != "JBSWY3DPEHPK3PXP" || q.Get("issuer") != "buggy app" || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Fatalf("unexpected query %v", q)
+	}
+}
@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	pb "github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/service"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/totp"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestEnrolTotp(t *testing.T) {
+	as, mock, _ := newMockDbService(t)
+
+	mock.ExpectExec("^INSERT INTO public.user_totp \\(user_id, secret\\) (.+) WHERE public.user_totp.confirmed_at IS NULL$").
+		WithArgs("abc123", pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	res, err := as.EnrolTotp(serviceCtx, &pb.EnrolTotpRequest{UserId: "abc123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := totp.Code(res.Secret, 1); err != nil {
+		t.Fatalf("expected a usable secret, got %q: %v", res.Secret, err)
+	}
+	if res.Uri != totp.URI(DefaultTotpIssuer, "abc123", res.Secret) {
+		t.Fatalf("unexpected uri %q", res.Uri)
+	}
+
+	// A confirmed secret isn't replaced
+	mock.ExpectExec("^INSERT INTO public.user_totp (.+)$").
+		WithArgs("abc123", pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 0))
+	_, err = as.EnrolTotp(serviceCtx, &pb.EnrolTotpRequest{UserId: "abc123"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestConfirmTotp(t *testing.T) {
+	as, mock, now := newMockDbService(t)
+
+	expectPending := func() {
+		mock.ExpectQuery("^SELECT secret FROM public.user_totp WHERE user_id = \\$1 AND confirmed_at IS NULL$").
+			WithArgs("abc123").
+			WillReturnRows(mock.NewRows([]string{"secret"}).AddRow(testTotpSecret))
+	}
+
+	// A code from the wrong time step is refused
+	expectPending()
+	old, _ := totp.Code(testTotpSecret, totp.Counter(*now)-5)
+	_, err := as.ConfirmTotp(serviceCtx, &pb.ConfirmTotpRequest{UserId: "abc123", Code: old})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+
+	expectPending()
+	counter := totp.Counter(*now)
+	code, _ := totp.Code(testTotpSecret, counter)
+	mock.ExpectExec("^WITH confirmed AS \\( UPDATE public.user_totp SET confirmed_at = \\$1, last_counter = \\$2 (.+) INSERT INTO public.totp_recovery_code (.+)$").
+		WithArgs(*now, counter, "abc123", testTotpSecret, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", recoveryCodeCount))
+	res, err := as.ConfirmTotp(serviceCtx, &pb.ConfirmTotpRequest{UserId: "abc123", Code: code})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes, got %v", recoveryCodeCount, res.RecoveryCodes)
+	}
+	format := regexp.MustCompile("^[A-Z2-7]{4}-[A-Z2-7]{4}-[A-Z2-7]{4}-[A-Z2-7]{4}$")
+	for _, c := range res.RecoveryCodes {
+		if !format.MatchString(c) {
+			t.Fatalf("unexpected recovery code %q", c)
+		}
+	}
+
+	// Nothing left to confirm
+	mock.ExpectQuery("^SELECT secret FROM public.user_totp (.+)$").
+		WithArgs("abc123").
+		WillReturnError(pgx.ErrNoRows)
+	_, err = as.ConfirmTotp(serviceCtx, &pb.ConfirmTotpRequest{UserId: "abc123", Code: code})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestVerifyTotp(t *testing.T) {
+	as, mock, now := newMockDbService(t)
+
+	// Verify with the otp. use sets up the expectations for using it up, if it's checked.
+	verify := func(otp string, use func()) *pb.VerifyResponse {
+		t.Helper()
+		expectUser(mock, "abc123", bananaHash, "active")
+		expectTotp(mock, "abc123", testTotpSecret)
+		if use != nil {
+			use()
+		}
+		res, err := as.Verify(context.Background(), &pb.VerifyRequest{Id: "abc123", Password: "banana", Otp: otp})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectLogin(t, as, "abc123", "", res.State, res.Reason)
+		return res
+	}
+
+	// The password alone isn't enough
+	if res := verify("", nil); res.State != pb.State_DENY || res.Reason != pb.Reason_OTP_REQUIRED {
+		t.Fatalf("expected DENY OTP_REQUIRED, got %v %v", res.State, res.Reason)
+	}
+	if res := verify("000000", nil); res.State != pb.State_DENY || res.Reason != pb.Reason_INVALID_OTP {
+		t.Fatalf("expected DENY INVALID_OTP, got %v %v", res.State, res.Reason)
+	}
+
+	// The current code works once
+	counter := totp.Counter(*now)
+	code, _ := totp.Code(testTotpSecret, counter)
+	if res := verify(code, func() {
+		mock.ExpectExec("^UPDATE public.user_totp SET last_counter = \\$1 WHERE user_id = \\$2 AND last_counter < \\$1$").
+			WithArgs(counter, "abc123").
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	}); res.State != pb.State_ALLOW || res.Id != "abc123" {
+		t.Fatalf("expected ALLOW, got %v %v", res.State, res.Reason)
+	}
+	if res := verify(code, func() {
+		mock.ExpectExec("^UPDATE public.user_totp SET last_counter (.+)$").
+			WithArgs(counter, "abc123").
+			WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+	}); res.State != pb.State_DENY || res.Reason != pb.Reason_INVALID_OTP {
+		t.Fatalf("expected a reused code to be DENY INVALID_OTP, got %v %v", res.State, res.Reason)
+	}
+
+	// A recovery code works instead, however it's typed
+	if res := verify("abcd-efgh ijkl-mnop", func() {
+		mock.ExpectExec("^UPDATE public.totp_recovery_code SET used_at = \\$1 WHERE user_id = \\$2 AND code_hash = \\$3 AND used_at IS NULL$").
+			WithArgs(*now, "abc123", hashRecoveryCode("ABCDEFGHIJKLMNOP")).
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	}); res.State != pb.State_ALLOW {
+		t.Fatalf("expected ALLOW with a recovery code, got %v %v", res.State, res.Reason)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDisableTotp(t *testing.T) {
+	as, mock, now := newMockDbService(t)
+
+	// Wrong codes count as failures, and after a few the user has to wait
+	for range DefaultLockout.BackoffAfter {
+		expectTotp(mock, "abc123", testTotpSecret)
+		_, err := as.DisableTotp(serviceCtx, &pb.DisableTotpRequest{UserId: "abc123", Code: "000000"})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("expected InvalidArgument, got %v", err)
+		}
+	}
+	_, err := as.DisableTotp(serviceCtx, &pb.DisableTotpRequest{UserId: "abc123", Code: "000000"})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted, got %v", err)
+	}
+
+	*now = now.Add(DefaultLockout.BackoffMax)
+	counter := totp.Counter(*now)
+	code, _ := totp.Code(testTotpSecret, counter)
+	expectTotp(mock, "abc123", testTotpSecret)
+	mock.ExpectExec("^UPDATE public.user_totp SET last_counter (.+)$").
+		WithArgs(counter, "abc123").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectExec("^WITH codes AS \\(DELETE FROM public.totp_recovery_code WHERE user_id = \\$1\\) DELETE FROM public.user_totp WHERE user_id = \\$1$").
+		WithArgs("abc123").
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	if _, err := as.DisableTotp(serviceCtx, &pb.DisableTotpRequest{UserId: "abc123", Code: code}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once disabled, there's nothing to disable
+	expectNoTotp(mock, "abc123")
+	_, err = as.DisableTotp(serviceCtx, &pb.DisableTotpRequest{UserId: "abc123", Code: code})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,377 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/password"
+	pb "github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/service"
+	"github.com/jackc/pgx/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The user RPCs are how accounts are made and managed, so that the rules for passwords, statuses
+// and roles live here and not with each caller. They need the admin token, as Unlock does --
+// except ChangePassword, which a user can call for themselves with their current password, and
+// DeactivateAccount, which always needs it.
+//
+// Passwords are never returned, and are hashed under the service's password policy.
+
+// Roles a user can have, as in public.user.roles
+const (
+	RoleUser   = "user"
+	RoleReader = "reader"
+)
+
+// Roles lists every role, in the order they're stored
+var Roles = []string{RoleUser, RoleReader}
+
+// Page sizes for ListUsers
+const (
+	defaultListUsersLimit = 50
+	maxListUsersLimit     = 200
+)
+
+const userColumns = "id, status, roles, created, modified"
+
+// Refuse the RPC unless it was sent with the admin token
+func (as *grpcAuthService) requireAdmin(ctx context.Context, rpc string) error {
+	if !as.isAdmin(ctx) {
+		return status.Errorf(codes.PermissionDenied, "%s: admin token required", rpc)
+	}
+	return nil
+}
+
+// Refuse an RPC that acts for the user it names, like CreateApiKey, unless it was sent with the
+// service token, by a service that has authenticated the user. Admins can call them too.
+func (as *grpcAuthService) requireService(ctx context.Context, rpc string) error {
+	if !sentToken(ctx, as.serviceToken) && !as.isAdmin(ctx) {
+		return status.Errorf(codes.PermissionDenied, "%s: service token required", rpc)
+	}
+	return nil
+}
+
+// Check a status, which must be one of Statuses
+func checkStatus(s string) error {
+	if !slices.Contains(Statuses, s) {
+		return fmt.Errorf("unknown status %q, expected one of: %s", s, strings.Join(Statuses, ", "))
+	}
+	return nil
+}
+
+// Check the roles asked for, returning them without duplicates, in the order of Roles. No roles
+// means just RoleUser.
+func normaliseRoles(roles []string) ([]string, error) {
+	if len(roles) == 0 {
+		return []string{RoleUser}, nil
+	}
+	for _, role := range roles {
+		if !slices.Contains(Roles, role) {
+			return nil, fmt.Errorf("unknown role %q, expected one of: %s", role, strings.Join(Roles, ", "))
+		}
+	}
+	var normalised []string
+	for _, role := range Roles {
+		if slices.Contains(roles, role) {
+			normalised = append(normalised, role)
+		}
+	}
+	return normalised, nil
+}
+
+// Scan a row of userColumns
+func scanUser(row pgx.Row) (*pb.User, error) {
+	user := &pb.User{}
+	var created, modified time.Time
+	if err := row.Scan(&user.Id, &user.Status, &user.Roles, &created, &modified); err != nil {
+		return nil, err
+	}
+	user.Created = created.Unix()
+	user.Modified = modified.Unix()
+	return user, nil
+}
+
+// CreateUser makes a new user with a password, which must follow password.CheckNew
+func (as *grpcAuthService) CreateUser(ctx context.Context, in *pb.CreateUserRequest) (*pb.User, error) {
+	if err := as.requireAdmin(ctx, "create user"); err != nil {
+		return nil, err
+	}
+	if err := password.CheckNew(in.Password); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "create user: %v", err)
+	}
+	accountStatus := in.Status
+	if accountStatus == "" {
+		accountStatus = StatusActive
+	}
+	if err := checkStatus(accountStatus); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "create user: %v", err)
+	}
+	roles, err := normaliseRoles(in.Roles)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "create user: %v", err)
+	}
+
+	hash, err := as.passwords.Hash(in.Password)
+	if err != nil {
+		log.Printf("create user: hash error: %v\n", err)
+		return nil, fmt.Errorf("create user: %w", err)
+	}
+	user, err := scanUser(as.pool.QueryRow(ctx,
+		"INSERT INTO public.user (status, password, roles) VALUES ($1, $2, $3) RETURNING "+userColumns,
+		accountStatus, hash, roles,
+	))
+	if err != nil {
+		log.Printf("create user: insert error: %v\n", err)
+		return nil, fmt.Errorf("create user: %w", err)
+	}
+	log.Printf("create user: id %v, status %v, roles %v\n", user.Id, user.Status, user.Roles)
+	return user, nil
+}
+
+// GetUser looks up a user by id
+func (as *grpcAuthService) GetUser(ctx context.Context, in *pb.GetUserRequest) (*pb.User, error) {
+	if err := as.requireAdmin(ctx, "get user"); err != nil {
+		return nil, err
+	}
+	if in.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "get user: id required")
+	}
+	user, err := scanUser(as.pool.QueryRow(ctx,
+		"SELECT "+userColumns+" FROM public.user WHERE id = $1",
+		in.Id,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, status.Error(codes.NotFound, "get user: no such user")
+	}
+	if err != nil {
+		log.Printf("get user: query error: %v\n", err)
+		return nil, fmt.Errorf("get user: %w", err)
+	}
+	return user, nil
+}
+
+// UpdateUserStatus sets a user's status. Tokens and API keys stop working as soon as the user
+// isn't active, because verifying them checks the status.
+func (as *grpcAuthService) UpdateUserStatus(ctx context.Context, in *pb.UpdateUserStatusRequest) (*pb.User, error) {
+	if err := as.requireAdmin(ctx, "update user status"); err != nil {
+		return nil, err
+	}
+	if in.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "update user status: id required")
+	}
+	if err := checkStatus(in.Status); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "update user status: %v", err)
+	}
+	user, err := scanUser(as.pool.QueryRow(ctx,
+		"UPDATE public.user SET status = $1 WHERE id = $2 RETURNING "+userColumns,
+		in.Status, in.Id,
+	))
+	if err == pgx.ErrNoRows {
+		return nil, status.Error(codes.NotFound, "update user status: no such user")
+	}
+	if err != nil {
+		log.Printf("update user status: update error: %v\n", err)
+		return nil, fmt.Errorf("update user status: %w", err)
+	}
+	log.Printf("update user status: id %v, status %v\n", user.Id, user.Status)
+	return user, nil
+}
+
+// ChangePassword sets a user's password and revokes their sessions, so anyone holding their
+// tokens has to log in again. API keys keep working: they're revoked one at a time.
+//
+// Without the admin token the current password is needed, checking it is throttled like Verify
+// (a wrong one counts as a failed attempt, and goes in the login history), and the account has
+// to be active. An admin can change the password of an account in any state.
+func (as *grpcAuthService) ChangePassword(ctx context.Context, in *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error) {
+	if in.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "change password: id required")
+	}
+	admin := as.isAdmin(ctx)
+	if !admin {
+		if err := as.checkCurrentPassword(ctx, "change password", in.Id, in.CurrentPassword, in.Source); err != nil {
+			return nil, err
+		}
+	}
+	if err := password.CheckNew(in.NewPassword); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "change password: %v", err)
+	}
+
+	hash, err := as.passwords.Hash(in.NewPassword)
+	if err != nil {
+		log.Printf("change password: hash error: %v\n", err)
+		return nil, fmt.Errorf("change password: %w", err)
+	}
+	// Users changing their own password must still be active when it's changed, in case an
+	// admin has locked them since the check
+	args := []interface{}{hash, in.Id, as.tokens.now()}
+	active := ""
+	if !admin {
+		args = append(args, StatusActive)
+		active = " AND status = $4"
+	}
+	var changed int
+	err = as.pool.QueryRow(ctx,
+		`WITH changed AS (UPDATE public.user SET password = $1 WHERE id = $2`+active+` RETURNING id),
+		revoked AS (UPDATE public.auth_session SET revoked_at = $3
+			WHERE user_id IN (SELECT id FROM changed) AND revoked_at IS NULL)
+		SELECT count(*) FROM changed`,
+		args...,
+	).Scan(&changed)
+	if err != nil {
+		log.Printf("change password: update error: %v\n", err)
+		return nil, fmt.Errorf("change password: %w", err)
+	}
+	if changed == 0 {
+		if !admin {
+			return nil, status.Error(codes.FailedPrecondition, "change password: account is not active")
+		}
+		return nil, status.Error(codes.NotFound, "change password: no such user")
+	}
+	// The old password's failures don't count against the new one
+	as.throttle.resetUser(in.Id)
+	log.Printf("change password: id %v\n", in.Id)
+	return &pb.ChangePasswordResponse{}, nil
+}
+
+// Check a user's current password, for a change they're making themselves. Unknown users are
+// refused the same way as wrong passwords, after the same amount of work. Like Verify, failures
+// are throttled by user and by source, and go in the user's login history. Only active users can
+// make changes, but as in Verify that's only checked once the password is right. rpc names the
+// RPC, for the log and the error.
+func (as *grpcAuthService) checkCurrentPassword(ctx context.Context, rpc, id, passwd, source string) error {
+	if passwd == "" {
+		return status.Errorf(codes.PermissionDenied, "%s: current password required", rpc)
+	}
+	if wait := as.throttle.wait(id, source); wait > 0 {
+		log.Printf("%s: id %v, source %v, deny (throttled for %v)\n", rpc, id, source, wait)
+		return status.Errorf(codes.ResourceExhausted, "%s: too many attempts, retry after %ds", rpc, retryAfterSeconds(wait))
+	}
+	var hash, accountStatus string
+	err := as.pool.QueryRow(ctx, "SELECT password, status FROM public.user WHERE id = $1", id).Scan(&hash, &accountStatus)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Printf("%s: query error: %v\n", rpc, err)
+		return fmt.Errorf("%s: %w", rpc, err)
+	}
+	if err == pgx.ErrNoRows {
+		comparePassword(ctx, as.dummyHash(), passwd)
+	} else {
+		err = comparePassword(ctx, hash, passwd)
+	}
+	if err != nil {
+		if err != pgx.ErrNoRows && err != password.ErrMismatch {
+			log.Printf("%s: compare error: %v\n", rpc, err)
+		}
+		as.throttle.fail(id, source)
+		if hash != "" {
+			as.recordLogin(id, source, &pb.VerifyResponse{State: pb.State_DENY, Reason: pb.Reason_INVALID_CREDENTIALS})
+		}
+		log.Printf("%s: id %v, deny (password)\n", rpc, id)
+		return status.Errorf(codes.PermissionDenied, "%s: wrong current password", rpc)
+	}
+	if accountStatus != StatusActive {
+		log.Printf("%s: id %v, deny (status %v)\n", rpc, id, accountStatus)
+		return status.Errorf(codes.FailedPrecondition, "%s: account is %s", rpc, accountStatus)
+	}
+	return nil
+}
+
+// DeactivateAccount makes an active user inactive and revokes their sessions. Tokens and API keys
+// would stop working anyway, as they're only verified for active users, but the sessions are
+// ended so that reactivating the account doesn't bring them back. Accounts in any other state,
+// like one an admin has locked, are left as they are.
+func (as *grpcAuthService) DeactivateAccount(ctx context.Context, in *pb.DeactivateAccountRequest) (*pb.DeactivateAccountResponse, error) {
+	if in.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "deactivate account: id required")
+	}
+	if err := as.checkCurrentPassword(ctx, "deactivate account", in.Id, in.CurrentPassword, in.Source); err != nil {
+		return nil, err
+	}
+
+	var deactivated int
+	err := as.pool.QueryRow(ctx,
+		`WITH deactivated AS (UPDATE public.user SET status = $1 WHERE id = $2 AND status = $4 RETURNING id),
+		revoked AS (UPDATE public.auth_session SET revoked_at = $3
+			WHERE user_id IN (SELECT id FROM deactivated) AND revoked_at IS NULL)
+		SELECT count(*) FROM deactivated`,
+		StatusInactive, in.Id, as.tokens.now(), StatusActive,
+	).Scan(&deactivated)
+	if err != nil {
+		log.Printf("deactivate account: update error: %v\n", err)
+		return nil, fmt.Errorf("deactivate account: %w", err)
+	}
+	// The status changed since the check
+	if deactivated == 0 {
+		return nil, status.Error(codes.FailedPrecondition, "deactivate account: account is not active")
+	}
+	log.Printf("deactivate account: id %v\n", in.Id)
+	return &pb.DeactivateAccountResponse{}, nil
+}
+
+// DeleteUser deletes a user. Their notes, shares, sessions, keys and second factor go with them.
+func (as *grpcAuthService) DeleteUser(ctx context.Context, in *pb.DeleteUserRequest) (*pb.DeleteUserResponse, error) {
+	if err := as.requireAdmin(ctx, "delete user"); err != nil {
+		return nil, err
+	}
+	if in.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "delete user: id required")
+	}
+	tag, err := as.pool.Exec(ctx, "DELETE FROM public.user WHERE id = $1", in.Id)
+	if err != nil {
+		log.Printf("delete user: delete error: %v\n", err)
+		return nil, fmt.Errorf("delete user: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, status.Error(codes.NotFound, "delete user: no such user")
+	}
+	as.throttle.resetUser(in.Id)
+	log.Printf("delete user: id %v\n", in.Id)
+	return &pb.DeleteUserResponse{}, nil
+}
+
+// ListUsers lists users in id order, a page at a time
+func (as *grpcAuthService) ListUsers(ctx context.Context, in *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	if err := as.requireAdmin(ctx, "list users"); err != nil {
+		return nil, err
+	}
+	limit := int(in.Limit)
+	if limit == 0 {
+		limit = defaultListUsersLimit
+	}
+	if limit < 0 || limit > maxListUsersLimit {
+		return nil, status.Errorf(codes.InvalidArgument, "list users: limit must be 1 to %d", maxListUsersLimit)
+	}
+
+	// Ask for one more than the page, to know whether there's another page after it
+	rows, err := as.pool.Query(ctx,
+		"SELECT "+userColumns+" FROM public.user WHERE id > $1 ORDER BY id LIMIT $2",
+		in.After, limit+1,
+	)
+	if err != nil {
+		log.Printf("list users: query error: %v\n", err)
+		return nil, fmt.Errorf("list users: %w", err)
+	}
+	defer rows.Close()
+
+	res := &pb.ListUsersResponse{Users: []*pb.User{}}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("list users: %w", err)
+		}
+		res.Users = append(res.Users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list users: %w", err)
+	}
+	if len(res.Users) > limit {
+		res.Users = res.Users[:limit]
+		res.NextAfter = res.Users[limit-1].Id
+	}
+	return res, nil
+}
@@ -0,0 +1,366 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	pb "github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/service"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestUserRpcsNeedAdmin(t *testing.T) {
+	as, _, _, _ := newMockAdminService(t)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer wrong"))
+
+	calls := map[string]func() error{
+		"CreateUser": func() error {
+			_, err := as.CreateUser(ctx, &pb.CreateUserRequest{Password: "banana-split"})
+			return err
+		},
+		"GetUser": func() error {
+			_, err := as.GetUser(ctx, &pb.GetUserRequest{Id: "abc123"})
+			return err
+		},
+		"UpdateUserStatus": func() error {
+			_, err := as.UpdateUserStatus(ctx, &pb.UpdateUserStatusRequest{Id: "abc123", Status: "inactive"})
+			return err
+		},
+		"ChangePassword": func() error {
+			_, err := as.ChangePassword(ctx, &pb.ChangePasswordRequest{Id: "abc123", NewPassword: "banana-split"})
+			return err
+		},
+		"DeleteUser": func() error {
+			_, err := as.DeleteUser(ctx, &pb.DeleteUserRequest{Id: "abc123"})
+			return err
+		},
+		"ListUsers": func() error {
+			_, err := as.ListUsers(ctx, &pb.ListUsersRequest{})
+			return err
+		},
+	}
+	for name, call := range calls {
+		if err := call(); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("%s: expected PermissionDenied, got %v", name, err)
+		}
+	}
+}
+
+func TestUserScopedRpcsNeedService(t *testing.T) {
+	as, _, _, _ := newMockAdminService(t)
+
+	for _, ctx := range []context.Context{
+		context.Background(),
+		metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer wrong")),
+	} {
+		calls := map[string]func() error{
+			"CreateApiKey": func() error {
+				_, err := as.CreateApiKey(ctx, &pb.CreateApiKeyRequest{UserId: "abc123", Name: "backup", Scopes: []string{ScopeNotesWrite}})
+				return err
+			},
+			"ListApiKeys": func() error {
+				_, err := as.ListApiKeys(ctx, &pb.ListApiKeysRequest{UserId: "abc123"})
+				return err
+			},
+			"RevokeApiKey": func() error {
+				_, err := as.RevokeApiKey(ctx, &pb.RevokeApiKeyRequest{UserId: "abc123", Id: "key1"})
+				return err
+			},
+			"EnrolTotp": func() error {
+				_, err := as.EnrolTotp(ctx, &pb.EnrolTotpRequest{UserId: "abc123"})
+				return err
+			},
+			"ConfirmTotp": func() error {
+				_, err := as.ConfirmTotp(ctx, &pb.ConfirmTotpRequest{UserId: "abc123", Code: "123456"})
+				return err
+			},
+			"DisableTotp": func() error {
+				_, err := as.DisableTotp(ctx, &pb.DisableTotpRequest{UserId: "abc123", Code: "123456"})
+				return err
+			},
+			"ListLoginHistory": func() error {
+				_, err := as.ListLoginHistory(ctx, &pb.ListLoginHistoryRequest{UserId: "abc123"})
+				return err
+			},
+		}
+		for name, call := range calls {
+			if err := call(); status.Code(err) != codes.PermissionDenied {
+				t.Errorf("%s: expected PermissionDenied, got %v", name, err)
+			}
+		}
+	}
+
+	// The service token doesn't make the api an admin
+	if _, err := as.GetUser(serviceCtx, &pb.GetUserRequest{Id: "abc123"}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied for the service token, got %v", err)
+	}
+}
+
+func TestCreateUser(t *testing.T) {
+	as, mock, now, ctx := newMockAdminService(t)
+
+	for _, in := range []*pb.CreateUserRequest{
+		{Password: "short"},
+		{Password: "banana-split", Status: "deleted"},
+		{Password: "banana-split", Roles: []string{"admin"}},
+	} {
+		if _, err := as.CreateUser(ctx, in); status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("expected InvalidArgument for %v, got %v", in, err)
+		}
+	}
+
+	// Defaults are filled in, and the password is hashed
+	mock.ExpectQuery("^INSERT INTO public.user \\(status, password, roles\\) VALUES \\(\\$1, \\$2, \\$3\\) RETURNING id, status, roles, created, modified$").
+		WithArgs("active", pgxmock.AnyArg(), []string{"user"}).
+		WillReturnRows(userRows(mock, *now, "abc123", "active", "user"))
+	user, err := as.CreateUser(ctx, &pb.CreateUserRequest{Password: "banana-split"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Id != "abc123" || user.Status != "active" || user.Created != now.Unix() {
+		t.Fatalf("unexpected user %v", user)
+	}
+
+	// Roles are deduplicated and put in order
+	mock.ExpectQuery("^INSERT INTO public.user (.+)$").
+		WithArgs("inactive", pgxmock.AnyArg(), []string{"user", "reader"}).
+		WillReturnRows(userRows(mock, *now, "def456", "inactive", "user", "reader"))
+	_, err = as.CreateUser(ctx, &pb.CreateUserRequest{Password: "banana-split", Status: "inactive", Roles: []string{"reader", "user", "reader"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetAndUpdateUser(t *testing.T) {
+	as, mock, now, ctx := newMockAdminService(t)
+
+	mock.ExpectQuery("^SELECT id, status, roles, created, modified FROM public.user WHERE id = \\$1$").
+		WithArgs("abc123").
+		WillReturnRows(userRows(mock, *now, "abc123", "active", "user"))
+	if user, err := as.GetUser(ctx, &pb.GetUserRequest{Id: "abc123"}); err != nil || user.Id != "abc123" {
+		t.Fatalf("unexpected user %v, %v", user, err)
+	}
+	mock.ExpectQuery("^SELECT (.+) FROM public.user WHERE id = \\$1$").
+		WithArgs("nope").
+		WillReturnError(pgx.ErrNoRows)
+	if _, err := as.GetUser(ctx, &pb.GetUserRequest{Id: "nope"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+
+	if _, err := as.UpdateUserStatus(ctx, &pb.UpdateUserStatusRequest{Id: "abc123", Status: ""}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+	mock.ExpectQuery("^UPDATE public.user SET status = \\$1 WHERE id = \\$2 RETURNING id, status, roles, created, modified$").
+		WithArgs("locked", "abc123").
+		WillReturnRows(userRows(mock, *now, "abc123", "locked", "user"))
+	if user, err := as.UpdateUserStatus(ctx, &pb.UpdateUserStatusRequest{Id: "abc123", Status: "locked"}); err != nil || user.Status != "locked" {
+		t.Fatalf("unexpected user %v, %v", user, err)
+	}
+	mock.ExpectQuery("^UPDATE public.user SET status (.+)$").
+		WithArgs("locked", "nope").
+		WillReturnError(pgx.ErrNoRows)
+	if _, err := as.UpdateUserStatus(ctx, &pb.UpdateUserStatusRequest{Id: "nope", Status: "locked"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	as, mock, now := newMockDbService(t)
+
+	source := "192.0.2.1"
+	expectCurrent := func() {
+		expectCurrentPassword(mock, "abc123", StatusActive)
+	}
+
+	// Without the admin token, the current password is needed
+	_, err := as.ChangePassword(context.Background(), &pb.ChangePasswordRequest{Id: "abc123", NewPassword: "banana-split"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied, got %v", err)
+	}
+	for range DefaultLockout.BackoffAfter {
+		expectCurrent()
+		_, err = as.ChangePassword(context.Background(), &pb.ChangePasswordRequest{Id: "abc123", CurrentPassword: "apple", NewPassword: "banana-split", Source: source})
+		if status.Code(err) != codes.PermissionDenied {
+			t.Fatalf("expected PermissionDenied, got %v", err)
+		}
+		// Wrong passwords go in the login history, like failed logins
+		expectLogin(t, as, "abc123", source, pb.State_DENY, pb.Reason_INVALID_CREDENTIALS)
+	}
+	// ... and guessing it is throttled, by user and by source
+	_, err = as.ChangePassword(context.Background(), &pb.ChangePasswordRequest{Id: "abc123", CurrentPassword: "banana", NewPassword: "banana-split"})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted, got %v", err)
+	}
+	if w := as.throttle.wait("someone-else", source); w == 0 {
+		t.Fatalf("expected the source to have to wait too")
+	}
+
+	*now = now.Add(DefaultLockout.BackoffMax)
+	expectCurrent()
+	_, err = as.ChangePassword(context.Background(), &pb.ChangePasswordRequest{Id: "abc123", CurrentPassword: "banana", NewPassword: "short"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+	expectCurrent()
+	expectChange(mock, *now, "abc123", 1, StatusActive)
+	if _, err := as.ChangePassword(context.Background(), &pb.ChangePasswordRequest{Id: "abc123", CurrentPassword: "banana", NewPassword: "banana-split"}); err != nil {
+		t.Fatal(err)
+	}
+	expectNoLogin(t, as)
+	if w := as.throttle.wait("abc123", ""); w != 0 {
+		t.Fatalf("expected no wait after changing the password, got %v", w)
+	}
+
+	// An admin doesn't need the current password
+	as.adminToken = "admin-token"
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer admin-token"))
+	expectChange(mock, *now, "nope", 0)
+	if _, err := as.ChangePassword(ctx, &pb.ChangePasswordRequest{Id: "nope", NewPassword: "banana-split"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	as, mock, _, ctx := newMockAdminService(t)
+
+	mock.ExpectExec("^DELETE FROM public.user WHERE id = \\$1$").
+		WithArgs("abc123").
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	if _, err := as.DeleteUser(ctx, &pb.DeleteUserRequest{Id: "abc123"}); err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectExec("^DELETE FROM public.user (.+)$").
+		WithArgs("abc123").
+		WillReturnResult(pgxmock.NewResult("DELETE", 0))
+	if _, err := as.DeleteUser(ctx, &pb.DeleteUserRequest{Id: "abc123"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	as, mock, now, ctx := newMockAdminService(t)
+
+	if _, err := as.ListUsers(ctx, &pb.ListUsersRequest{Limit: maxListUsersLimit + 1}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+
+	// One more than the page is asked for, to tell whether there's another page
+	mock.ExpectQuery("^SELECT id, status, roles, created, modified FROM public.user WHERE id > \\$1 ORDER BY id LIMIT \\$2$").
+		WithArgs("", 3).
+		WillReturnRows(userRows(mock, *now, "a", "active", "user").
+			AddRow("b", "inactive", []string{"reader"}, *now, *now).
+			AddRow("c", "active", []string{"user"}, *now, *now))
+	res, err := as.ListUsers(ctx, &pb.ListUsersRequest{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Users) != 2 || res.Users[1].Id != "b" || res.NextAfter != "b" {
+		t.Fatalf("unexpected page %v, next %q", res.Users, res.NextAfter)
+	}
+
+	mock.ExpectQuery("^SELECT (.+) FROM public.user WHERE id > \\$1 ORDER BY id LIMIT \\$2$").
+		WithArgs("b", 3).
+		WillReturnRows(userRows(mock, *now, "c", "active", "user"))
+	res, err = as.ListUsers(ctx, &pb.ListUsersRequest{Limit: 2, After: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Users) != 1 || res.NextAfter != "" {
+		t.Fatalf("unexpected last page %v, next %q", res.Users, res.NextAfter)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestNormaliseRolesAndStatus(t *testing.T) {
+	if roles, err := normaliseRoles(nil); err != nil || len(roles) != 1 || roles[0] != RoleUser {
+		t.Fatalf("expected the default role, got %v, %v", roles, err)
+	}
+	if _, err := normaliseRoles([]string{"admin"}); err == nil {
+		t.Fatal("expected an unknown role to be refused")
+	}
+	if err := checkStatus("deleted"); err == nil {
+		t.Fatal("expected an unknown status to be refused")
+	}
+}
+
+func TestDeactivateAccount(t *testing.T) {
+	as, mock, now := newMockDbService(t)
+
+	// The current password is always needed, even with the admin token
+	as.adminToken = "admin-token"
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer admin-token"))
+	if _, err := as.DeactivateAccount(ctx, &pb.DeactivateAccountRequest{Id: "abc123"}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied, got %v", err)
+	}
+
+	expectCurrentPassword(mock, "abc123", StatusActive)
+	mock.ExpectQuery("^WITH deactivated AS \\(UPDATE public.user SET status = \\$1 WHERE id = \\$2 AND status = \\$4 RETURNING id\\), (.+) SELECT count\\(\\*\\) FROM deactivated$").
+		WithArgs("inactive", "abc123", *now, "active").
+		WillReturnRows(mock.NewRows([]string{"count"}).AddRow(1))
+	if _, err := as.DeactivateAccount(context.Background(), &pb.DeactivateAccountRequest{Id: "abc123", CurrentPassword: "banana"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAccountChangesNeedActiveUser(t *testing.T) {
+	as, mock, now := newMockDbService(t)
+
+	// A locked user with the right password can't deactivate themselves, which would unlock
+	// them as far as an admin is concerned, or change their password
+	expectCurrentPassword(mock, "abc123", StatusLocked)
+	_, err := as.DeactivateAccount(context.Background(), &pb.DeactivateAccountRequest{Id: "abc123", CurrentPassword: "banana"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition, got %v", err)
+	}
+	expectCurrentPassword(mock, "abc123", StatusLocked)
+	_, err = as.ChangePassword(context.Background(), &pb.ChangePasswordRequest{Id: "abc123", CurrentPassword: "banana", NewPassword: "banana-split"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition, got %v", err)
+	}
+
+	// An admin locking them between the check and the update doesn't let them through either
+	expectCurrentPassword(mock, "abc123", StatusActive)
+	mock.ExpectQuery("^WITH deactivated AS (.+)$").
+		WithArgs("inactive", "abc123", *now, "active").
+		WillReturnRows(mock.NewRows([]string{"count"}).AddRow(0))
+	_, err = as.DeactivateAccount(context.Background(), &pb.DeactivateAccountRequest{Id: "abc123", CurrentPassword: "banana"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition, got %v", err)
+	}
+	expectCurrentPassword(mock, "abc123", StatusActive)
+	expectChange(mock, *now, "abc123", 0, StatusActive)
+	_, err = as.ChangePassword(context.Background(), &pb.ChangePasswordRequest{Id: "abc123", CurrentPassword: "banana", NewPassword: "banana-split"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("unfulfilled expectations: %s", err)
+	}
+}
@@ -1,40 +1,36 @@
 package main
 
 import (
+	"errors"
 	"flag"
-	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 
 	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api"
-	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/config"
 	"golang.org/x/net/context"
 )
 
 func main() {
-	port := flag.Int("port", 80, "port the server will listen on")
-	flag.Parse()
-
-	// Get the postgres password from a file supplied in an environment variable
-	// TODO: it would be better for this to come from DATABASE_URL or to "figure out"
-	// the best auth params from environment variables
-	passwd, err := util.ReadPasswd()
+	// Configuration comes from flags, the environment and an optional config file.
+	// Run with -help to see the flags, or -print-config to see the result.
+	cfg, err := config.LoadApi(os.Args[1:])
+	if errors.Is(err, config.ErrPrinted) || errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
+	slog.SetDefault(cfg.Log)
 
 	// The NotifyContext will signal Done when these signals are sent, allowing the server
 	// to shutdown gracefully
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
 	defer stop()
 
-	as := api.New(api.Config{
-		Port:           *port,
-		Log:            log.Default(),
-		AuthServiceUrl: "auth:80",
-		DatabaseUrl:    fmt.Sprintf("postgres://postgres:%s@postgres:5432/app", passwd),
-	})
+	as := api.New(cfg)
 	if err := as.Run(ctx); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// The healthcheck command checks whether a service is ready, exiting 0 if it is and 1 if not.
+// It's used for docker-compose healthchecks, because the images don't have curl or a gRPC
+// health probe.
+//
+// Check the API's /readyz:
+//
+//	healthcheck -http http://localhost:80/readyz
+//
+// Check the auth service with the standard gRPC health service:
+//
+//	healthcheck -grpc localhost:80
+
+func main() {
+	httpUrl := flag.String("http", "", "URL to GET, which must respond 200")
+	grpcTarget := flag.String("grpc", "", "host:port of a gRPC server, which must report SERVING")
+	service := flag.String("service", "", "gRPC service to check (empty for the server as a whole)")
+	timeout := flag.Duration("timeout", 3*time.Second, "how long to wait for an answer")
+	flag.Parse()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	var err error
+	switch {
+	case *httpUrl != "":
+		err = checkHttp(ctx, *httpUrl)
+	case *grpcTarget != "":
+		err = checkGrpc(ctx, *grpcTarget, *service)
+	default:
+		err = fmt.Errorf("one of -http or -grpc is required")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "healthcheck: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func checkHttp(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, res.Status)
+	}
+	return nil
+}
+
+func checkGrpc(ctx context.Context, target, service string) error {
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	res, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		return err
+	}
+	if res.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("%s: %s", target, res.Status)
+	}
+	return nil
+}
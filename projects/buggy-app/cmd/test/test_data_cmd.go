@@ -8,22 +8,26 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
 	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util"
 	"github.com/jackc/pgx/v5"
-	"golang.org/x/crypto/bcrypt"
 )
 
-// This package is a CLI tool for interacting with the database to create/update/delete data for testing. It
-// can create users and notes.
+// This package is a CLI tool for creating and managing data for testing. Users are managed through
+// the auth service, so its rules for passwords, statuses and roles apply; notes are written to the
+// database directly.
 //
 // Use it like this:
 //
-//	> go run ./cmd/test user -password banana
+//	> go run ./cmd/test user -password banana-split
 //		2022/10/16 16:40:56 new user created
 //		2022/10/16 16:40:56 	id: FxoAB2gl
-//		2022/10/16 16:40:56 	password: banana
-//		2022/10/16 16:40:56 base64 for auth: RnhvQUIyZ2w6YmFuYW5h
+//		2022/10/16 16:40:56 	password: banana-split
+//		2022/10/16 16:40:56 base64 for auth: RnhvQUIyZ2w6YmFuYW5hLXNwbGl0
 //
 // > go run ./cmd/test note -owner FxoAB2gl
 // 		2022/10/16 16:41:42 new note created
@@ -31,25 +35,45 @@ import (
 // 		2022/10/16 16:41:42 	owner: FxoAB2gl
 // 		2022/10/16 16:41:42 	content: "Example note content"
 //
+// The user commands need the auth service's admin token, which is read from $ADMIN_TOKEN or
+// volumes/secrets/admin-token.
 
 type Flags struct {
 	cmd string
 
-	hostport string
-	db       string
-
 	// Number of entities to generate
 	n int
 
+	// Auth service flags, for the user commands
+	authServiceUrl string
+	timeout        time.Duration
+
+	// Database flags, for the note command
+	hostport string
+	db       string
+
 	// User flags
+	id     string
 	passwd string
 	status string
+	roles  string
+	limit  int
 
 	// Note flags
 	content string
 	owner   string
 }
 
+// The commands, and what they do
+var commands = map[string]string{
+	"user":          "create users",
+	"users":         "list users",
+	"user-status":   "set the status of a user",
+	"user-password": "set the password of a user",
+	"user-delete":   "delete a user, and their notes",
+	"note":          "create notes",
+}
+
 func usage() {
 	flag.Usage()
 	os.Exit(2)
@@ -58,120 +82,200 @@ func usage() {
 func main() {
 	f := &Flags{}
 	if len(os.Args) < 2 {
-		log.Println("error: not enough arguments, expected one of: user, note")
+		log.Println("error: not enough arguments, expected one of: user, users, user-status, user-password, user-delete, note")
 		usage()
 	}
 
 	f.cmd = os.Args[1]
-	userFlagSet := userFlags(f)
-	noteFlagSet := noteFlags(f)
-
-	var err error
-	var fs *flag.FlagSet
-	switch f.cmd {
-	case "user":
-		fs = userFlagSet
-	case "note":
-		fs = noteFlagSet
-	default:
+	if _, ok := commands[f.cmd]; !ok {
 		log.Println("error: command not recognised")
 		usage()
 	}
-
-	// Attach base flags to this flag and parse
-	baseFlags(f, fs)
-	err = fs.Parse(os.Args[2:])
-	if err != nil {
-		log.Println("error: could not parse flags")
-		fmt.Fprintf(fs.Output(), "Usage of %s:\n", f.cmd)
-		usage()
+	fs := flag.NewFlagSet(f.cmd, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s, to %s:\n", f.cmd, commands[f.cmd])
+		fs.PrintDefaults()
 	}
-
-	// Set up a default POSTGRES_PASSWORD_FILE because we know where it's likely to be...
-	if os.Getenv("POSTGRES_PASSWORD_FILE") == "" {
-		os.Setenv("POSTGRES_PASSWORD_FILE", "volumes/secrets/postgres-passwd")
+	if f.cmd == "note" {
+		noteFlags(f, fs)
+	} else {
+		userFlags(f, fs)
 	}
-	// ... and the read it. $POSTGRES_USER will still take precedence.
-	dbPasswd, err := util.ReadPasswd()
-	if err != nil {
-		log.Fatal(err)
+	if err := fs.Parse(os.Args[2:]); err != nil {
+		log.Println("error: could not parse flags")
+		fs.Usage()
+		os.Exit(2)
 	}
 
 	// The NotifyContext will signal Done when these signals are sent, allowing others to shut down safely
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
 	defer stop()
 
-	// Connect to the database
-	connString := fmt.Sprintf("postgres://postgres:%s@%s/%s?sslmode=disable", dbPasswd, f.hostport, f.db)
-	conn, err := pgx.Connect(ctx, connString)
-	if err != nil {
-		log.Fatalf("error connecting to database: %v", err)
-	}
-
-	i := 0
-	for i < f.n {
-		i += 1
-		// Run the right command
-		switch f.cmd {
-		case "user":
-			err = userCmd(ctx, f, conn)
-		case "note":
-			err = noteCmd(ctx, f, conn)
-		default:
-			log.Fatalf("unrecognised command: %s", f.cmd)
-		}
+	var err error
+	if f.cmd == "note" {
+		err = runNotes(ctx, f)
+	} else {
+		err = runUsers(ctx, f)
 	}
-
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-// Base flags apply to all commands
-func baseFlags(f *Flags, fs *flag.FlagSet) {
-	fs.StringVar(&f.hostport, "hostport", "localhost:5432", "host:port of Postgres")
-	fs.StringVar(&f.db, "db", "app", "target database")
-	fs.IntVar(&f.n, "n", 1, "number of entities to generate")
+// Flags for the commands that go through the auth service
+func userFlags(f *Flags, fs *flag.FlagSet) {
+	fs.StringVar(&f.authServiceUrl, "auth-service-url", "localhost:8080", "host:port of the auth service")
+	fs.DurationVar(&f.timeout, "timeout", 5*time.Second, "how long to wait for each request to the auth service")
+	switch f.cmd {
+	case "user":
+		fs.IntVar(&f.n, "n", 1, "number of users to create")
+		fs.StringVar(&f.passwd, "password", "password", "password of the created user")
+		fs.StringVar(&f.status, "status", auth.StatusActive, "status of the created user: "+strings.Join(auth.Statuses, ", "))
+		fs.StringVar(&f.roles, "roles", auth.RoleUser, "comma-separated roles of the created user: "+strings.Join(auth.Roles, ", "))
+	case "users":
+		fs.IntVar(&f.limit, "limit", 50, "number of users to list")
+		fs.StringVar(&f.id, "after", "", "list users with ids after this one")
+	case "user-status":
+		fs.StringVar(&f.id, "id", "", "the user")
+		fs.StringVar(&f.status, "status", "", "the new status: "+strings.Join(auth.Statuses, ", "))
+	case "user-password":
+		fs.StringVar(&f.id, "id", "", "the user")
+		fs.StringVar(&f.passwd, "password", "", "the new password")
+	case "user-delete":
+		fs.StringVar(&f.id, "id", "", "the user")
+	}
 }
 
-// Flags associated with the user command
-func userFlags(f *Flags) *flag.FlagSet {
-	fs := flag.NewFlagSet("user", flag.ExitOnError)
-	fs.StringVar(&f.passwd, "password", "password", "password of the created user")
-	fs.StringVar(&f.status, "status", "active", "status of the created user")
-	return fs
+// Read the admin token, from the environment or where make puts it
+func adminToken() (string, error) {
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		return token, nil
+	}
+	b, err := os.ReadFile("volumes/secrets/admin-token")
+	if err != nil {
+		return "", fmt.Errorf("set $ADMIN_TOKEN to the auth service's -admin-token: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
 }
 
-// Create a user from command-line configuration
-func userCmd(ctx context.Context, f *Flags, conn *pgx.Conn) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(f.passwd), 10)
+// Run one of the user commands against the auth service
+func runUsers(ctx context.Context, f *Flags) error {
+	token, err := adminToken()
 	if err != nil {
-		return fmt.Errorf("user: could not hash password, %w", err)
+		return fmt.Errorf("%s: %w", f.cmd, err)
 	}
+	client, err := auth.NewClient(ctx, f.authServiceUrl)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.cmd, err)
+	}
+	defer client.Close()
 
-	if f.status != "active" && f.status != "inactive" {
-		return fmt.Errorf("user: invalid status, %s", f.status)
+	if f.cmd == "user" {
+		for i := 0; i < f.n; i++ {
+			if err := userCmd(ctx, f, client, token); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
-	var id string
-	err = conn.QueryRow(ctx, "INSERT INTO public.user (status, password) VALUES ($1, $2) RETURNING id", f.status, hash).Scan(&id)
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+	if f.cmd == "users" {
+		return usersCmd(ctx, f, client, token)
+	}
+	if f.id == "" {
+		return fmt.Errorf("%s: please supply a user with -id", f.cmd)
+	}
+	switch f.cmd {
+	case "user-status":
+		user, err := client.UpdateUserStatus(ctx, token, f.id, f.status)
+		if err != nil {
+			return fmt.Errorf("user-status: %w", err)
+		}
+		log.Printf("user %s is now %s\n", user.Id, user.Status)
+	case "user-password":
+		if err := client.SetPassword(ctx, token, f.id, f.passwd); err != nil {
+			return fmt.Errorf("user-password: %w", err)
+		}
+		log.Printf("user %s has a new password, and their sessions have ended\n", f.id)
+		log.Printf("base64 for auth: %s\n", util.BasicAuthValue(f.id, f.passwd))
+	case "user-delete":
+		if err := client.DeleteUser(ctx, token, f.id); err != nil {
+			return fmt.Errorf("user-delete: %w", err)
+		}
+		log.Printf("user %s deleted\n", f.id)
+	}
+	return nil
+}
+
+// Create a user from command-line configuration
+func userCmd(ctx context.Context, f *Flags, client *auth.GrpcClient, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+	user, err := client.CreateUser(ctx, token, f.passwd, f.status, strings.Split(f.roles, ","))
 	if err != nil {
-		return fmt.Errorf("user: could not insert user, %w", err)
+		return fmt.Errorf("user: %w", err)
 	}
 	log.Printf("new user created\n")
-	log.Printf("\tid: %s\n", id)
-	log.Printf("\tstatus: %s\n", f.status)
+	log.Printf("\tid: %s\n", user.Id)
+	log.Printf("\tstatus: %s\n", user.Status)
+	log.Printf("\troles: %s\n", strings.Join(user.Roles, ","))
 	log.Printf("\tpassword: %s\n", f.passwd)
-	log.Printf("base64 for auth: %s\n", util.BasicAuthValue(id, f.passwd))
+	log.Printf("base64 for auth: %s\n", util.BasicAuthValue(user.Id, f.passwd))
+	return nil
+}
+
+// List a page of users
+func usersCmd(ctx context.Context, f *Flags, client *auth.GrpcClient, token string) error {
+	users, next, err := client.ListUsers(ctx, token, f.limit, f.id)
+	if err != nil {
+		return fmt.Errorf("users: %w", err)
+	}
+	for _, user := range users {
+		log.Printf("%s\t%s\t%s\tcreated %s\n", user.Id, user.Status, strings.Join(user.Roles, ","), user.Created.Format(time.RFC3339))
+	}
+	if next != "" {
+		log.Printf("more users: -after %s\n", next)
+	}
 	return nil
 }
 
 // Flags associated with the note command
-func noteFlags(f *Flags) *flag.FlagSet {
-	fs := flag.NewFlagSet("note", flag.ExitOnError)
+func noteFlags(f *Flags, fs *flag.FlagSet) {
+	fs.StringVar(&f.hostport, "hostport", "localhost:5432", "host:port of Postgres")
+	fs.StringVar(&f.db, "db", "app", "target database")
+	fs.IntVar(&f.n, "n", 1, "number of notes to create")
 	fs.StringVar(&f.content, "content", "Example note content", "content of the created note")
 	fs.StringVar(&f.owner, "owner", "", "owner of the created note")
-	return fs
+}
+
+// Connect to the database and create notes
+func runNotes(ctx context.Context, f *Flags) error {
+	// Set up a default POSTGRES_PASSWORD_FILE because we know where it's likely to be...
+	if os.Getenv("POSTGRES_PASSWORD_FILE") == "" {
+		os.Setenv("POSTGRES_PASSWORD_FILE", "volumes/secrets/postgres-passwd")
+	}
+	// ... and the read it. $POSTGRES_USER will still take precedence.
+	dbPasswd, err := util.ReadPasswd()
+	if err != nil {
+		return err
+	}
+
+	// Connect to the database
+	connString := fmt.Sprintf("postgres://postgres:%s@%s/%s?sslmode=disable", dbPasswd, f.hostport, f.db)
+	conn, err := pgx.Connect(ctx, connString)
+	if err != nil {
+		return fmt.Errorf("error connecting to database: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	for i := 0; i < f.n; i++ {
+		if err := noteCmd(ctx, f, conn); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Create a note from command-line configuration
@@ -185,13 +289,13 @@ func noteCmd(ctx context.Context, f *Flags, conn *pgx.Conn) error {
 		return fmt.Errorf("note: could not find owner, %w", err)
 	}
 
-	var id string
-	err = conn.QueryRow(ctx, "INSERT INTO public.note (owner, content) VALUES ($1, $2) RETURNING id", f.owner, f.content).Scan(&id)
+	// Go through the model so that derived data (like tags) is written too
+	note, err := model.CreateNote(ctx, conn, f.owner, f.content)
 	if err != nil {
 		return fmt.Errorf("note: could not insert note, %w", err)
 	}
 	log.Printf("new note created\n")
-	log.Printf("\tid: %s\n", id)
+	log.Printf("\tid: %s\n", note.Id)
 	log.Printf("\towner: %s\n", f.owner)
 	log.Printf("\tcontent: %q\n", f.content)
 	return nil
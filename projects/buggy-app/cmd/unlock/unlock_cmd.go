@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/config"
+)
+
+// The unlock command ends the backoff or lockout of a user, or of a client IP, after too many
+// failed logins. It needs the auth service's -admin-token, which like the other secrets can be
+// given in $ADMIN_TOKEN or read from the file named by $ADMIN_TOKEN_FILE:
+//
+//	ADMIN_TOKEN=... go run ./cmd/unlock -auth-service-url localhost:8080 -id A2RPq6To
+//	ADMIN_TOKEN_FILE=volumes/secrets/admin-token go run ./cmd/unlock -source 192.0.2.1
+
+func main() {
+	cfg, err := config.LoadUnlock(os.Args[1:])
+	if errors.Is(err, config.ErrPrinted) || errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	client, err := auth.NewClient(ctx, cfg.AuthServiceUrl)
+	if err != nil {
+		log.Fatalf("unlock: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.Unlock(ctx, cfg.AdminToken, cfg.Id, cfg.Source); err != nil {
+		log.Fatalf("unlock: %v", err)
+	}
+	log.Printf("unlock: unlocked id %q, source %q", cfg.Id, cfg.Source)
+}
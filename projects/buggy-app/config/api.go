@@ -0,0 +1,85 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/tracing"
+)
+
+// LoadApi builds the configuration for the API service from args (without the program name),
+// the environment and the config file. It returns ErrPrinted if -print-config was given.
+func LoadApi(args []string) (api.Config, error) {
+	return loadApi(args, os.LookupEnv, os.Stdout, os.Stderr)
+}
+
+func loadApi(args []string, lookupEnv func(string) (string, bool), out, logOut io.Writer) (api.Config, error) {
+	l := newLoader("api", lookupEnv, out)
+	var config api.Config
+	var logFormat string
+	fs := l.fs
+	fs.IntVar(&config.Port, "port", 80, "port the server will listen on")
+	fs.IntVar(&config.AdminPort, "admin-port", 9090, "port the admin server, with /metrics, will listen on (0 for none)")
+	fs.StringVar(&logFormat, "log-format", "text", "format of log lines: text or json")
+	fs.StringVar(&config.DatabaseUrl, "database-url", "", "Postgres connection URL (default: built from $POSTGRES_PASSWORD_FILE)")
+	fs.StringVar(&config.AuthServiceUrl, "auth-service-url", "auth:80", "host:port of the auth service")
+	fs.StringVar(&config.AuthServiceToken, "auth-service-token", "", "the auth service's -service-token, for managing API keys, TOTP and login history")
+	trashRetentionVar(fs, &config.TrashRetention)
+	fs.Float64Var(&config.UserRateLimit.Rate, "user-rate", 10, "requests per second allowed for each user (0 for no limit)")
+	fs.IntVar(&config.UserRateLimit.Burst, "user-burst", 20, "requests each user can make at once")
+	fs.Float64Var(&config.IpRateLimit.Rate, "ip-rate", 1, "failed authentication attempts per second allowed for each client IP (0 for no limit)")
+	fs.IntVar(&config.IpRateLimit.Burst, "ip-burst", 10, "failed authentication attempts each client IP can make at once")
+	fs.StringVar(&config.Tracing.Exporter, "trace-exporter", "", "where to send trace spans: stdout, otlp, or empty to not trace")
+	fs.StringVar(&config.Tracing.Endpoint, "otlp-endpoint", "", "host:port of the OTLP collector, if -trace-exporter is otlp")
+	l.secretUrl("database-url")
+	l.secret("auth-service-token")
+	config.Tracing.ServiceName = "api"
+
+	if err := l.load(args); err != nil {
+		return api.Config{}, err
+	}
+	if err := l.defaultDatabaseUrl(&config.DatabaseUrl); err != nil {
+		return api.Config{}, err
+	}
+
+	errs := []error{
+		checkPort("port", config.Port, false),
+		checkPort("admin-port", config.AdminPort, true),
+		checkOneOf("log-format", logFormat, "text", "json"),
+		checkDatabaseUrl(config.DatabaseUrl),
+		checkOneOf("trace-exporter", config.Tracing.Exporter, tracing.ExporterNone, tracing.ExporterStdout, tracing.ExporterOTLP),
+		checkRateLimit("user", config.UserRateLimit),
+		checkRateLimit("ip", config.IpRateLimit),
+	}
+	if config.AdminPort == config.Port {
+		errs = append(errs, fmt.Errorf("config: admin-port: must be different from port %d", config.Port))
+	}
+	if config.AuthServiceUrl == "" {
+		errs = append(errs, errors.New("config: auth-service-url: must be set"))
+	}
+	errs = append(errs, checkPositive("trash-retention", config.TrashRetention))
+	if err := l.finish(errs); err != nil {
+		return api.Config{}, err
+	}
+
+	if logFormat == "json" {
+		config.Log = slog.New(slog.NewJSONHandler(logOut, nil))
+	} else {
+		config.Log = slog.New(slog.NewTextHandler(logOut, nil))
+	}
+	return config, nil
+}
+
+func checkRateLimit(prefix string, limit api.RateLimit) error {
+	if limit.Rate < 0 {
+		return fmt.Errorf("config: %s-rate: must not be negative, got %v", prefix, limit.Rate)
+	}
+	if limit.Rate > 0 && limit.Burst < 1 {
+		return fmt.Errorf("config: %s-burst: must be at least 1, got %d", prefix, limit.Burst)
+	}
+	return nil
+}
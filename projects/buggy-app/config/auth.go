@@ -0,0 +1,108 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/auth/password"
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/util/tracing"
+)
+
+// LoadAuth builds the configuration for the auth service from args (without the program name),
+// the environment and the config file. It returns ErrPrinted if -print-config was given.
+func LoadAuth(args []string) (auth.Config, error) {
+	return loadAuth(args, os.LookupEnv, os.Stdout)
+}
+
+func loadAuth(args []string, lookupEnv func(string) (string, bool), out io.Writer) (auth.Config, error) {
+	l := newLoader("auth", lookupEnv, out)
+	var config auth.Config
+	fs := l.fs
+	fs.IntVar(&config.Port, "port", 80, "port the server will listen on")
+	fs.IntVar(&config.AdminPort, "admin-port", 9090, "port the admin server, with /metrics, will listen on (0 for none)")
+	fs.StringVar(&config.DatabaseUrl, "database-url", "", "Postgres connection URL (default: built from $POSTGRES_PASSWORD_FILE)")
+	fs.StringVar(&config.Tracing.Exporter, "trace-exporter", "", "where to send trace spans: stdout, otlp, or empty to not trace")
+	fs.StringVar(&config.Tracing.Endpoint, "otlp-endpoint", "", "host:port of the OTLP collector, if -trace-exporter is otlp")
+	fs.StringVar(&config.TokenSecret, "token-secret", "", "key for signing access tokens, at least 32 bytes (default: random, so tokens don't survive a restart)")
+	fs.DurationVar(&config.AccessTokenTTL, "access-token-ttl", auth.DefaultAccessTokenTTL, "how long access tokens last")
+	fs.DurationVar(&config.RefreshTokenTTL, "refresh-token-ttl", auth.DefaultRefreshTokenTTL, "how long refresh tokens last without being used")
+	fs.StringVar(&config.AdminToken, "admin-token", "", "token admin RPCs, like Unlock, must be sent with (default: none, so admin RPCs are refused)")
+	fs.StringVar(&config.ServiceToken, "service-token", "", "token the api sends with RPCs for the users it authenticates, like CreateApiKey (default: none, so only admins can call them)")
+	fs.IntVar(&config.Lockout.BackoffAfter, "backoff-after", auth.DefaultLockout.BackoffAfter, "failed logins before each attempt has to wait")
+	fs.DurationVar(&config.Lockout.BackoffBase, "backoff-base", auth.DefaultLockout.BackoffBase, "first wait after -backoff-after failures, doubling with each further failure")
+	fs.DurationVar(&config.Lockout.BackoffMax, "backoff-max", auth.DefaultLockout.BackoffMax, "longest wait between attempts before a lockout")
+	fs.IntVar(&config.Lockout.UserLockoutAfter, "user-lockout-after", auth.DefaultLockout.UserLockoutAfter, "failed logins before a user is locked out")
+	fs.IntVar(&config.Lockout.SourceLockoutAfter, "source-lockout-after", auth.DefaultLockout.SourceLockoutAfter, "failed logins before a client IP is locked out")
+	fs.DurationVar(&config.Lockout.LockoutDuration, "lockout-duration", auth.DefaultLockout.LockoutDuration, "how long lockouts last, and how long failures are remembered")
+	fs.StringVar(&config.Password.Algorithm, "password-algorithm", password.DefaultPolicy.Algorithm, "algorithm new password hashes are made with: bcrypt or argon2id")
+	fs.IntVar(&config.Password.BcryptCost, "bcrypt-cost", password.DefaultPolicy.BcryptCost, "cost of new bcrypt hashes")
+	fs.StringVar(&config.TotpIssuer, "totp-issuer", auth.DefaultTotpIssuer, "name authenticator apps show for TOTP secrets")
+	fs.DurationVar(&config.LoginHistoryRetention, "login-history-retention", auth.DefaultLoginHistoryRetention, "how long logins are kept in users' login history")
+	// The flag package has no uint32 or uint8, so these are converted after loading
+	var argon2Memory, argon2Time, argon2Threads uint
+	fs.UintVar(&argon2Memory, "argon2-memory", uint(password.DefaultPolicy.Argon2.Memory), "memory of new argon2id hashes, in KiB")
+	fs.UintVar(&argon2Time, "argon2-time", uint(password.DefaultPolicy.Argon2.Time), "iterations of new argon2id hashes")
+	fs.UintVar(&argon2Threads, "argon2-threads", uint(password.DefaultPolicy.Argon2.Threads), "parallelism of new argon2id hashes")
+	l.secretUrl("database-url")
+	l.secret("token-secret")
+	l.secret("admin-token")
+	l.secret("service-token")
+	config.Tracing.ServiceName = "auth"
+
+	if err := l.load(args); err != nil {
+		return auth.Config{}, err
+	}
+	if err := l.defaultDatabaseUrl(&config.DatabaseUrl); err != nil {
+		return auth.Config{}, err
+	}
+
+	config.Password.Argon2 = password.Argon2Params{
+		Memory:  uint32(min(argon2Memory, math.MaxUint32)),
+		Time:    uint32(min(argon2Time, math.MaxUint32)),
+		Threads: uint8(min(argon2Threads, math.MaxUint8)),
+	}
+
+	errs := []error{
+		checkPort("port", config.Port, false),
+		checkPort("admin-port", config.AdminPort, true),
+		checkDatabaseUrl(config.DatabaseUrl),
+		checkOneOf("trace-exporter", config.Tracing.Exporter, tracing.ExporterNone, tracing.ExporterStdout, tracing.ExporterOTLP),
+		checkPositive("access-token-ttl", config.AccessTokenTTL),
+		checkPositive("refresh-token-ttl", config.RefreshTokenTTL),
+		checkAtLeast("backoff-after", config.Lockout.BackoffAfter, 1),
+		checkPositive("backoff-base", config.Lockout.BackoffBase),
+		checkPositive("backoff-max", config.Lockout.BackoffMax),
+		checkAtLeast("user-lockout-after", config.Lockout.UserLockoutAfter, config.Lockout.BackoffAfter),
+		checkAtLeast("source-lockout-after", config.Lockout.SourceLockoutAfter, config.Lockout.BackoffAfter),
+		checkPositive("lockout-duration", config.Lockout.LockoutDuration),
+		checkPositive("login-history-retention", config.LoginHistoryRetention),
+	}
+	// The costs are only checked for a known algorithm, so an unknown one is reported once
+	if err := checkOneOf("password-algorithm", config.Password.Algorithm, password.AlgorithmBcrypt, password.AlgorithmArgon2id); err != nil {
+		errs = append(errs, err)
+	} else if err := config.Password.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("config: %w", err))
+	}
+	if config.TotpIssuer == "" {
+		errs = append(errs, fmt.Errorf("config: totp-issuer: must not be empty"))
+	}
+	if config.TokenSecret != "" && len(config.TokenSecret) < auth.MinTokenSecretLength {
+		errs = append(errs, fmt.Errorf("config: token-secret: must be at least %d bytes", auth.MinTokenSecretLength))
+	}
+	if config.RefreshTokenTTL <= config.AccessTokenTTL {
+		errs = append(errs, fmt.Errorf("config: refresh-token-ttl: must be longer than access-token-ttl %v", config.AccessTokenTTL))
+	}
+	if config.AdminPort == config.Port {
+		errs = append(errs, fmt.Errorf("config: admin-port: must be different from port %d", config.Port))
+	}
+	if err := l.finish(errs); err != nil {
+		return auth.Config{}, err
+	}
+
+	config.Log = log.Default()
+	return config, nil
+}
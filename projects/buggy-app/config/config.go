@@ -0,0 +1,298 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// This package builds the configuration of the services from, in order of precedence:
+//
+//  1. flags on the command line: -port 8080
+//  2. environment variables, named after the flag in upper case: PORT=8080
+//  3. a YAML or TOML config file, named by -config or $CONFIG_FILE, with the flag names as keys:
+//     port: 8080
+//  4. defaults
+//
+// Secrets, like -admin-token, can also be read from the file named by their environment variable
+// with _FILE on the end: ADMIN_TOKEN_FILE=/run/secrets/admin-token. That keeps them out of the
+// command line and the environment, where ps and docker inspect would show them.
+//
+// The database URL comes from -database-url or $DATABASE_URL. If neither is set it is built from
+// the Postgres password in $POSTGRES_PASSWORD or $POSTGRES_PASSWORD_FILE, as Docker Compose
+// supplies it.
+//
+// Run a service with -print-config to see the configuration it would use, and where each value
+// came from, without starting it. Secrets are redacted.
+
+// ErrPrinted is returned by the Load functions after -print-config has printed the
+// configuration. The service should exit without starting.
+var ErrPrinted = errors.New("config: printed")
+
+// Where the database is when running under Docker Compose. The password is added as userinfo.
+var defaultDatabase = url.URL{Scheme: "postgres", Host: "postgres:5432", Path: "/app"}
+
+// loader reads flags defined on its FlagSet from all of the sources
+type loader struct {
+	fs        *flag.FlagSet
+	lookupEnv func(string) (string, bool)
+	out       io.Writer
+
+	file        string
+	printConfig bool
+
+	// Where each flag's value came from, for -print-config
+	sources map[string]string
+	// Flags whose values must not be printed, and how to redact them
+	secrets map[string]func(string) string
+}
+
+func newLoader(name string, lookupEnv func(string) (string, bool), out io.Writer) *loader {
+	l := &loader{
+		fs:        flag.NewFlagSet(name, flag.ContinueOnError),
+		lookupEnv: lookupEnv,
+		out:       out,
+		sources:   map[string]string{},
+		secrets:   map[string]func(string) string{},
+	}
+	l.fs.StringVar(&l.file, "config", "", "YAML (.yaml, .yml) or TOML (.toml) config file")
+	l.fs.BoolVar(&l.printConfig, "print-config", false, "print the configuration, with secrets redacted, and exit")
+	return l
+}
+
+// Flags that control loading, rather than being configuration themselves
+func isMeta(name string) bool {
+	return name == "config" || name == "print-config"
+}
+
+// The environment variable for a flag: database-url -> DATABASE_URL
+func envName(flagName string) string {
+	return strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Parse args, then fill in anything not set on the command line from the environment and the
+// config file
+func (l *loader) load(args []string) error {
+	if err := l.fs.Parse(args); err != nil {
+		return err
+	}
+
+	explicit := map[string]bool{}
+	l.fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	l.fs.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] {
+			l.sources[f.Name] = "flag"
+		} else {
+			l.sources[f.Name] = "default"
+		}
+	})
+
+	if !explicit["config"] {
+		if file, ok := l.lookupEnv("CONFIG_FILE"); ok {
+			l.file = file
+		}
+	}
+	if l.file != "" {
+		values, err := readFile(l.file)
+		if err != nil {
+			return err
+		}
+		for key, value := range values {
+			f := l.fs.Lookup(key)
+			if f == nil || isMeta(key) {
+				return fmt.Errorf("config: %s: unknown key %q", l.file, key)
+			}
+			if explicit[key] {
+				continue
+			}
+			if err := f.Value.Set(fmt.Sprint(value)); err != nil {
+				return fmt.Errorf("config: %s: %s: %w", l.file, key, err)
+			}
+			l.sources[key] = "file " + l.file
+		}
+	}
+
+	var err error
+	l.fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || isMeta(f.Name) {
+			return
+		}
+		env := envName(f.Name)
+		value, ok := l.lookupEnv(env)
+		if !ok || value == "" {
+			if _, secret := l.secrets[f.Name]; !secret {
+				return
+			}
+			file, ok := l.lookupEnv(env + "_FILE")
+			if !ok || file == "" {
+				return
+			}
+			b, readErr := os.ReadFile(file)
+			if readErr != nil {
+				err = fmt.Errorf("config: $%s_FILE: %w", env, readErr)
+				return
+			}
+			value, env = strings.TrimSpace(string(b)), env+"_FILE"
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("config: $%s: %w", env, setErr)
+			return
+		}
+		l.sources[f.Name] = "env " + env
+	})
+	return err
+}
+
+// Read a flat map of keys to values from a YAML or TOML file, chosen by its extension
+func readFile(path string) (map[string]interface{}, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+
+	values := map[string]interface{}{}
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &values)
+	case ".toml":
+		err = toml.Unmarshal(b, &values)
+	default:
+		return nil, fmt.Errorf("config: %s: unknown file type %q, expected .yaml, .yml or .toml", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config: %s: %w", path, err)
+	}
+	return values, nil
+}
+
+// Fill in the database URL from the Postgres password, if it wasn't configured
+func (l *loader) defaultDatabaseUrl(databaseUrl *string) error {
+	if *databaseUrl != "" {
+		return nil
+	}
+	source := "POSTGRES_PASSWORD"
+	passwd, ok := l.lookupEnv("POSTGRES_PASSWORD")
+	if !ok || passwd == "" {
+		file, ok := l.lookupEnv("POSTGRES_PASSWORD_FILE")
+		if !ok || file == "" {
+			return errors.New("config: database-url: set -database-url, $DATABASE_URL, $POSTGRES_PASSWORD or $POSTGRES_PASSWORD_FILE")
+		}
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("config: database-url: %w", err)
+		}
+		// Like the other _FILE secrets, so a trailing newline isn't part of the password
+		passwd, source = strings.TrimSpace(string(b)), "POSTGRES_PASSWORD_FILE"
+	}
+	u := defaultDatabase
+	u.User = url.UserPassword("postgres", passwd)
+	*databaseUrl = u.String()
+	l.sources["database-url"] = "env " + source
+	return nil
+}
+
+// Mark a flag holding a URL as secret: its password is redacted when printed
+func (l *loader) secretUrl(name string) {
+	l.secrets[name] = func(value string) string {
+		u, err := url.Parse(value)
+		if err != nil {
+			return "REDACTED"
+		}
+		return u.Redacted()
+	}
+}
+
+// Mark a flag as secret: it is printed as REDACTED
+func (l *loader) secret(name string) {
+	l.secrets[name] = func(string) string {
+		return "REDACTED"
+	}
+}
+
+// Print the configuration as YAML, which can be used as a config file, with the source of
+// each value in a comment
+func (l *loader) print() {
+	l.fs.VisitAll(func(f *flag.Flag) {
+		if isMeta(f.Name) {
+			return
+		}
+		value := f.Value.String()
+		if redact, ok := l.secrets[f.Name]; ok && value != "" {
+			value = redact(value)
+		}
+		fmt.Fprintf(l.out, "%s: %s # %s\n", f.Name, strconv.Quote(value), l.sources[f.Name])
+	})
+}
+
+// Finish loading: print the configuration if asked to, and report validation errors
+func (l *loader) finish(errs []error) error {
+	if l.printConfig {
+		l.print()
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	if l.printConfig {
+		return ErrPrinted
+	}
+	return nil
+}
+
+// Validation helpers, which return an error naming the flag
+
+func checkPort(name string, port int, allowZero bool) error {
+	if port == 0 && allowZero {
+		return nil
+	}
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("config: %s: must be between 1 and 65535, got %d", name, port)
+	}
+	return nil
+}
+
+func checkOneOf(name, value string, allowed ...string) error {
+	for _, a := range allowed {
+		if value == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("config: %s: must be one of %q, got %q", name, allowed, value)
+}
+
+func checkPositive(name string, d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("config: %s: must be positive, got %v", name, d)
+	}
+	return nil
+}
+
+func checkAtLeast(name string, n, min int) error {
+	if n < min {
+		return fmt.Errorf("config: %s: must be at least %d, got %d", name, min, n)
+	}
+	return nil
+}
+
+func checkDatabaseUrl(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		// The error includes the URL, which has the password in it
+		return errors.New("config: database-url: not a valid URL")
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return fmt.Errorf("config: database-url: scheme must be postgres, got %q", u.Scheme)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/CodeYourFuture/immersive-go-course/buggy-app/api/model"
+)
+
+// Purge is the configuration of cmd/purge
+type Purge struct {
+	DatabaseUrl string
+	// How long deleted notes are kept in the trash. It's the api's -trash-retention, so that
+	// notes can't be restored after they've been purged.
+	TrashRetention time.Duration
+	// Purge repeatedly with this interval between runs. Zero means purge once.
+	Interval time.Duration
+}
+
+// LoadPurge builds the configuration for cmd/purge from args (without the program name), the
+// environment and the config file. It returns ErrPrinted if -print-config was given.
+func LoadPurge(args []string) (Purge, error) {
+	return loadPurge(args, os.LookupEnv, os.Stdout)
+}
+
+func loadPurge(args []string, lookupEnv func(string) (string, bool), out io.Writer) (Purge, error) {
+	l := newLoader("purge", lookupEnv, out)
+	var config Purge
+	fs := l.fs
+	fs.StringVar(&config.DatabaseUrl, "database-url", "", "Postgres connection URL (default: built from $POSTGRES_PASSWORD_FILE)")
+	trashRetentionVar(fs, &config.TrashRetention)
+	fs.DurationVar(&config.Interval, "interval", 0, "purge repeatedly with this interval between runs (0 means purge once and exit)")
+	l.secretUrl("database-url")
+
+	if err := l.load(args); err != nil {
+		return Purge{}, err
+	}
+	if err := l.defaultDatabaseUrl(&config.DatabaseUrl); err != nil {
+		return Purge{}, err
+	}
+
+	errs := []error{
+		checkDatabaseUrl(config.DatabaseUrl),
+		checkPositive("trash-retention", config.TrashRetention),
+	}
+	if config.Interval < 0 {
+		errs = append(errs, fmt.Errorf("config: interval: must not be negative, got %v", config.Interval))
+	}
+	if err := l.finish(errs); err != nil {
+		return Purge{}, err
+	}
+	return config, nil
+}
+
+// The trash retention is shared by the api, which stops restoring notes after it, and cmd/purge,
+// which deletes them after it. Both read it from -trash-retention or $TRASH_RETENTION.
+func trashRetentionVar(fs *flag.FlagSet, retention *time.Duration) {
+	fs.DurationVar(retention, "trash-retention", model.DefaultTrashRetention, "how long deleted notes can be restored from the trash, before cmd/purge deletes them")
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// Unlock is the configuration of cmd/unlock
+type Unlock struct {
+	AuthServiceUrl string
+	// The auth service's -admin-token
+	AdminToken string
+	// The user and client IP address to unlock. At least one is needed.
+	Id     string
+	Source string
+	// How long to wait for the auth service
+	Timeout time.Duration
+}
+
+// LoadUnlock builds the configuration for cmd/unlock from args (without the program name), the
+// environment and the config file. It returns ErrPrinted if -print-config was given.
+func LoadUnlock(args []string) (Unlock, error) {
+	return loadUnlock(args, os.LookupEnv, os.Stdout)
+}
+
+func loadUnlock(args []string, lookupEnv func(string) (string, bool), out io.Writer) (Unlock, error) {
+	l := newLoader("unlock", lookupEnv, out)
+	var config Unlock
+	fs := l.fs
+	fs.StringVar(&config.AuthServiceUrl, "auth-service-url", "auth:80", "host:port of the auth service")
+	fs.StringVar(&config.AdminToken, "admin-token", "", "the auth service's -admin-token")
+	fs.StringVar(&config.Id, "id", "", "user to unlock")
+	fs.StringVar(&config.Source, "source", "", "client IP address to unlock")
+	fs.DurationVar(&config.Timeout, "timeout", 5*time.Second, "how long to wait for the auth service")
+	l.secret("admin-token")
+
+	if err := l.load(args); err != nil {
+		return Unlock{}, err
+	}
+
+	errs := []error{
+		checkPositive("timeout", config.Timeout),
+	}
+	if config.AuthServiceUrl == "" {
+		errs = append(errs, errors.New("config: auth-service-url: must be set"))
+	}
+	if config.AdminToken == "" {
+		errs = append(errs, errors.New("config: admin-token: must be set to the auth service's -admin-token"))
+	}
+	if config.Id == "" && config.Source == "" {
+		errs = append(errs, errors.New("config: id or source: one must be set"))
+	}
+	if err := l.finish(errs); err != nil {
+		return Unlock{}, err
+	}
+	return config, nil
+}
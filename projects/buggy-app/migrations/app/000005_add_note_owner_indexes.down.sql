@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS public.note_owner_modified_idx;
+
+DROP INDEX IF EXISTS public.note_owner_created_idx;
\ No newline at end of file
@@ -0,0 +1,6 @@
+-- Notes are listed per-owner, ordered by created or modified, with the ID as a tie-breaker.
+-- These indexes match the WHERE/ORDER BY of model.GetNotesForOwner so pages can be read
+-- straight from the index. Postgres can scan a btree backwards, so DESC order is covered too.
+CREATE INDEX IF NOT EXISTS note_owner_created_idx ON public.note (owner, created, id);
+
+CREATE INDEX IF NOT EXISTS note_owner_modified_idx ON public.note (owner, modified, id);
\ No newline at end of file
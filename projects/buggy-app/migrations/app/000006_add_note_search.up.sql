@@ -0,0 +1,7 @@
+-- Full-text search over note content. The tsvector is generated by Postgres from the content,
+-- so it can never get out of sync with the text it indexes.
+ALTER TABLE public.note
+   ADD COLUMN IF NOT EXISTS search tsvector
+   GENERATED ALWAYS AS (to_tsvector('english', content)) STORED;
+
+CREATE INDEX IF NOT EXISTS note_search_idx ON public.note USING GIN (search);
\ No newline at end of file
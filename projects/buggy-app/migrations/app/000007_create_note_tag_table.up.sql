@@ -0,0 +1,18 @@
+-- Tags extracted from note content by the API (see model.extractTags), stored so they can be
+-- counted and used to filter notes. Rows are replaced whenever a note is written.
+CREATE TABLE IF NOT EXISTS public.note_tag(
+   note_id VARCHAR (20) NOT NULL REFERENCES public.note (id) ON DELETE CASCADE,
+   tag TEXT NOT NULL,
+   PRIMARY KEY (note_id, tag)
+);
+
+-- Filtering notes by tag looks up note IDs from tags
+CREATE INDEX IF NOT EXISTS note_tag_tag_idx ON public.note_tag (tag, note_id);
+
+-- Backfill tags for existing notes. This mirrors model.extractTags: everything after a #
+-- up to the next #, with surrounding whitespace trimmed.
+INSERT INTO public.note_tag (note_id, tag)
+SELECT DISTINCT n.id, btrim(m[1], E' \t\n\r\f\v')
+FROM public.note n, regexp_matches(n.content, '#([^#]+)', 'g') m
+WHERE btrim(m[1], E' \t\n\r\f\v') <> ''
+ON CONFLICT DO NOTHING;
\ No newline at end of file
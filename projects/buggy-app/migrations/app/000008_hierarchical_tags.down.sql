@@ -0,0 +1,10 @@
+DROP INDEX IF EXISTS public.note_tag_tag_pattern_idx;
+
+-- Restore tags as they were extracted before hierarchical tags
+DELETE FROM public.note_tag;
+
+INSERT INTO public.note_tag (note_id, tag)
+SELECT DISTINCT n.id, btrim(m[1], E' \t\n\r\f\v')
+FROM public.note n, regexp_matches(n.content, '#([^#]+)', 'g') m
+WHERE btrim(m[1], E' \t\n\r\f\v') <> ''
+ON CONFLICT DO NOTHING;
\ No newline at end of file
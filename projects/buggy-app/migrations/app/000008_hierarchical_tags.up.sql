@@ -0,0 +1,13 @@
+-- Tags now follow a grammar that supports /-separated hierarchies (see model/tags.go), so
+-- re-extract the stored tags for every note using the new rules.
+DELETE FROM public.note_tag;
+
+INSERT INTO public.note_tag (note_id, tag)
+SELECT DISTINCT n.id, m[1]
+FROM public.note n,
+   regexp_matches(n.content, '(?:^|[^[:alnum:]_&/])#([[:alnum:]_-]+(?:/[[:alnum:]_-]+)*)', 'g') m
+ON CONFLICT DO NOTHING;
+
+-- Filtering by tag matches descendants with LIKE 'tag/%', which needs a pattern_ops index
+-- to use the index regardless of the database collation
+CREATE INDEX IF NOT EXISTS note_tag_tag_pattern_idx ON public.note_tag (tag text_pattern_ops);
\ No newline at end of file
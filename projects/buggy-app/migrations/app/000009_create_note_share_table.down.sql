@@ -0,0 +1 @@
+DROP TABLE IF EXISTS public.note_share;
\ No newline at end of file
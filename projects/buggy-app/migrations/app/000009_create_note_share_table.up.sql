@@ -0,0 +1,12 @@
+-- Shares give another user read or write access to a note. Only the owner can delete a note
+-- or manage its shares. Shares are removed with the note or the user they were granted to.
+CREATE TABLE IF NOT EXISTS public.note_share(
+   note_id VARCHAR (20) NOT NULL REFERENCES public.note (id) ON DELETE CASCADE,
+   user_id VARCHAR (20) NOT NULL REFERENCES public.user (id) ON DELETE CASCADE,
+   permission VARCHAR (10) NOT NULL CHECK (permission IN ('read', 'write')),
+   granted timestamp default current_timestamp,
+   PRIMARY KEY (note_id, user_id)
+);
+
+-- Listing notes shared with a user
+CREATE INDEX IF NOT EXISTS note_share_user_idx ON public.note_share (user_id);
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS public.note_revision;
\ No newline at end of file
@@ -0,0 +1,15 @@
+-- Every version of a note's content, numbered from 1 per note. Revisions are written by the
+-- api in the same transaction as the note. The author is kept as NULL if that user is deleted.
+CREATE TABLE IF NOT EXISTS public.note_revision(
+   note_id VARCHAR (20) NOT NULL REFERENCES public.note (id) ON DELETE CASCADE,
+   revision INT NOT NULL,
+   content TEXT NOT NULL,
+   author VARCHAR (20) REFERENCES public.user (id) ON DELETE SET NULL,
+   created timestamp default current_timestamp,
+   PRIMARY KEY (note_id, revision)
+);
+
+-- Existing notes start with their current content as revision 1
+INSERT INTO public.note_revision (note_id, revision, content, author, created)
+SELECT id, 1, content, owner, modified FROM public.note
+ON CONFLICT DO NOTHING;
\ No newline at end of file
@@ -0,0 +1,4 @@
+-- Notes in the trash would reappear as live notes, so remove them first
+DELETE FROM public.note WHERE deleted_at IS NOT NULL;
+DROP INDEX IF EXISTS note_deleted_idx;
+ALTER TABLE public.note DROP COLUMN IF EXISTS deleted_at;
\ No newline at end of file
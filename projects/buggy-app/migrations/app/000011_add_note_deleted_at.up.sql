@@ -0,0 +1,6 @@
+-- Deleting a note sets deleted_at, moving it to the trash. Rows are only removed when the
+-- trash is purged.
+ALTER TABLE public.note ADD COLUMN IF NOT EXISTS deleted_at timestamp;
+
+-- Listing a user's trash, and finding expired notes to purge
+CREATE INDEX IF NOT EXISTS note_deleted_idx ON public.note (deleted_at) WHERE deleted_at IS NOT NULL;
\ No newline at end of file
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS public.auth_session;
\ No newline at end of file
@@ -0,0 +1,18 @@
+-- A session is started when auth issues tokens to a user, and ends when it is revoked or its
+-- refresh token expires. Only a sha256 hash of the refresh token is kept, so the table can't
+-- be used to log in. Access tokens name their session, so revoking it stops them verifying.
+CREATE TABLE IF NOT EXISTS public.auth_session(
+   id VARCHAR (20) PRIMARY KEY,
+   user_id VARCHAR (20) NOT NULL REFERENCES public.user (id) ON DELETE CASCADE,
+   refresh_hash CHAR (64) NOT NULL UNIQUE,
+   created timestamp default current_timestamp,
+   expires timestamp NOT NULL,
+   revoked_at timestamp
+);
+
+CREATE TRIGGER auth_session_gen_id
+BEFORE INSERT ON public.auth_session
+FOR EACH ROW EXECUTE PROCEDURE gen_id();
+
+-- Revoking all of a user's sessions
+CREATE INDEX IF NOT EXISTS auth_session_user_idx ON public.auth_session (user_id);
\ No newline at end of file
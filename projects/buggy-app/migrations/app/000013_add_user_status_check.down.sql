@@ -0,0 +1 @@
+ALTER TABLE public.user DROP CONSTRAINT IF EXISTS user_status_check;
\ No newline at end of file
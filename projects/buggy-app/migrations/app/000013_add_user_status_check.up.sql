@@ -0,0 +1,4 @@
+-- Accounts can be active, inactive, locked or pending_verification. Only active accounts can
+-- authenticate: the auth service gives the others as the reason for denying.
+ALTER TABLE public.user ADD CONSTRAINT user_status_check
+CHECK (status IN ('active', 'inactive', 'locked', 'pending_verification'));
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE public.user ALTER COLUMN password TYPE VARCHAR (100);
\ No newline at end of file
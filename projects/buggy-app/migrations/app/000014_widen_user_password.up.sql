@@ -0,0 +1,3 @@
+-- Argon2id hashes are PHC strings, which with their parameters, salt and key can be longer than
+-- the 60 characters of bcrypt. Leave plenty of room for stronger parameters.
+ALTER TABLE public.user ALTER COLUMN password TYPE VARCHAR (255);
\ No newline at end of file
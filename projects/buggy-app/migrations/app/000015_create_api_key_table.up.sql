@@ -0,0 +1,20 @@
+-- API keys let scripts authenticate as a user without their password. Each key is named, limited
+-- to a set of scopes, and can be revoked. Only a sha256 hash of the key is kept, along with its
+-- first few characters so the owner can tell their keys apart.
+CREATE TABLE IF NOT EXISTS public.api_key(
+   id VARCHAR (20) PRIMARY KEY,
+   user_id VARCHAR (20) NOT NULL REFERENCES public.user (id) ON DELETE CASCADE,
+   name VARCHAR (100) NOT NULL,
+   prefix VARCHAR (20) NOT NULL,
+   key_hash CHAR (64) NOT NULL UNIQUE,
+   scopes TEXT[] NOT NULL,
+   created timestamp default current_timestamp,
+   revoked_at timestamp
+);
+
+CREATE TRIGGER api_key_gen_id
+BEFORE INSERT ON public.api_key
+FOR EACH ROW EXECUTE PROCEDURE gen_id();
+
+-- Listing a user's keys
+CREATE INDEX IF NOT EXISTS api_key_user_idx ON public.api_key (user_id);
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE public.user DROP CONSTRAINT IF EXISTS user_roles_check;
+ALTER TABLE public.user DROP COLUMN IF EXISTS roles;
\ No newline at end of file
@@ -0,0 +1,7 @@
+-- Roles say what a user may do with their account, beyond owning their notes. New users are a
+-- `user`, who can read and write notes and manage API keys. A `reader` can only read. The API
+-- decides what each role allows; the auth service only passes the roles on.
+ALTER TABLE public.user ADD COLUMN IF NOT EXISTS roles TEXT[] NOT NULL DEFAULT '{user}';
+
+ALTER TABLE public.user ADD CONSTRAINT user_roles_check
+CHECK (roles <@ ARRAY['user', 'reader']::TEXT[]);
\ No newline at end of file
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.totp_recovery_code;
+DROP TABLE IF EXISTS public.user_totp;
\ No newline at end of file
@@ -0,0 +1,19 @@
+-- A user's TOTP second factor. The secret has to be kept, not hashed, to check codes against.
+-- It isn't used until confirmed_at is set, by the user entering a code from it. last_counter is
+-- the time step of the last code accepted, so that no code can be used twice.
+CREATE TABLE IF NOT EXISTS public.user_totp(
+   user_id VARCHAR (20) PRIMARY KEY REFERENCES public.user (id) ON DELETE CASCADE,
+   secret VARCHAR (64) NOT NULL,
+   last_counter BIGINT NOT NULL DEFAULT 0,
+   created timestamp default current_timestamp,
+   confirmed_at timestamp
+);
+
+-- Single-use codes for logging in without the authenticator app. Like API keys, only a sha256
+-- hash of each code is kept.
+CREATE TABLE IF NOT EXISTS public.totp_recovery_code(
+   user_id VARCHAR (20) NOT NULL REFERENCES public.user (id) ON DELETE CASCADE,
+   code_hash CHAR (64) NOT NULL,
+   used_at timestamp,
+   PRIMARY KEY (user_id, code_hash)
+);
\ No newline at end of file
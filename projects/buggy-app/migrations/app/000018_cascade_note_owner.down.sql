@@ -0,0 +1,2 @@
+ALTER TABLE public.note DROP CONSTRAINT IF EXISTS note_owner_fkey;
+ALTER TABLE public.note ADD CONSTRAINT note_owner_fkey FOREIGN KEY (owner) REFERENCES public.user (id);
\ No newline at end of file
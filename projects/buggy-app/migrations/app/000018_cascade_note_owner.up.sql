@@ -0,0 +1,6 @@
+-- Deleting a user deletes their notes too. Everything else that refers to a user already goes
+-- with them, or forgets them, as note_revision.author does.
+ALTER TABLE public.note DROP CONSTRAINT IF EXISTS note_owner_fkey;
+
+ALTER TABLE public.note ADD CONSTRAINT note_owner_fkey
+FOREIGN KEY (owner) REFERENCES public.user (id) ON DELETE CASCADE;
\ No newline at end of file
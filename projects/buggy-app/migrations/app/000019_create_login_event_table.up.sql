@@ -0,0 +1,14 @@
+-- Every check of a user's password by the auth service, whatever the outcome, so users can see
+-- when and where their account was logged in to -- and when someone tried. Unknown ids aren't
+-- recorded: there's no user to record them for.
+CREATE TABLE IF NOT EXISTS public.login_event(
+   id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+   user_id VARCHAR (20) NOT NULL REFERENCES public.user (id) ON DELETE CASCADE,
+   source VARCHAR (100) NOT NULL DEFAULT '',
+   state VARCHAR (10) NOT NULL,
+   reason VARCHAR (40) NOT NULL,
+   created timestamp default current_timestamp
+);
+
+-- Listing a user's logins, newest first
+CREATE INDEX IF NOT EXISTS login_event_user_idx ON public.login_event (user_id, id);
\ No newline at end of file
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS public.login_event_created_idx;
\ No newline at end of file
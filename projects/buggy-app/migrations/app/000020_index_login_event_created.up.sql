@@ -0,0 +1,2 @@
+-- Purging old logins, which the auth service does every hour
+CREATE INDEX IF NOT EXISTS login_event_created_idx ON public.login_event (created);
\ No newline at end of file
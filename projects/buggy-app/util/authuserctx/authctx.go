@@ -4,21 +4,50 @@ import (
 	"context"
 )
 
-// This package has methods for adding authenticated user's ID to a context.
+// This package has methods for adding the authenticated user to a context.
 // For more on this idea, see https://go.dev/blog/context
 
+// Principal is who a request is authenticated as, and how
+type Principal struct {
+	UserId string
+	// What the user's account may do
+	Roles []string
+	// What the credentials may do, if they're limited, as API keys are. Nil means not limited.
+	Scopes []string
+	// How the user authenticated, like "PASSWORD", "ACCESS_TOKEN" or "API_KEY"
+	AuthMethod string
+	// The session, when the user authenticated with an access token
+	SessionId string
+}
+
 type key int
 
-// `authenticatedIdKey“ is the context key for the user identifier.
+// `principalKey“ is the context key for the Principal.
 // The 0 is arbitrary -- but if another key were added to this package, it would need
 // another value.
-const authenticatedIdKey key = 0
+const principalKey key = 0
+
+// NewPrincipalContext returns a context authenticated as the principal
+func NewPrincipalContext(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey, p)
+}
+
+// PrincipalFromContext returns who the context is authenticated as
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey).(Principal)
+	return p, ok
+}
 
+// NewAuthenticatedContext returns a context authenticated as the user, with no roles or scopes
 func NewAuthenticatedContext(ctx context.Context, id string) context.Context {
-	return context.WithValue(ctx, authenticatedIdKey, id)
+	return NewPrincipalContext(ctx, Principal{UserId: id})
 }
 
+// FromAuthenticatedContext returns the ID of the user the context is authenticated as
 func FromAuthenticatedContext(ctx context.Context) (string, bool) {
-	id, ok := ctx.Value(authenticatedIdKey).(string)
-	return id, ok
+	p, ok := PrincipalFromContext(ctx)
+	if !ok || p.UserId == "" {
+		return "", false
+	}
+	return p.UserId, true
 }
@@ -0,0 +1,34 @@
+package logctx
+
+import (
+	"context"
+	"log/slog"
+)
+
+// This package has methods for adding a request-scoped logger to a context, so that anything
+// handling the request -- HTTP handlers, the model layer -- logs with the same fields (like the
+// request ID) without having them passed down explicitly.
+
+type key int
+
+// `loggerKey` is the context key for the logger.
+const loggerKey key = 0
+
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// FromContext returns the logger in the context, or slog.Default() if there isn't one, so it
+// is always safe to log with the result.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// With adds attributes to the logger in the context, returning the new context and logger
+func With(ctx context.Context, args ...any) (context.Context, *slog.Logger) {
+	logger := FromContext(ctx).With(args...)
+	return NewContext(ctx, logger), logger
+}